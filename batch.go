@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// Formats of a batch body
+const (
+	batchJSON   = "json"
+	batchNDJSON = "ndjson"
+)
+
+// batcher groups the encoded flows into a single message of up to size flows, flushed after delay at the latest
+type batcher struct {
+	size        int
+	delay       time.Duration
+	format      string
+	compression string
+	body        bytes.Buffer
+	count       int
+	compressed  bytes.Buffer
+	gzip        *gzip.Writer
+	snappy      []byte
+}
+
+func newBatcher(size int, delay time.Duration, format string, compression string) (*batcher, error) {
+	switch format {
+	case batchJSON, batchNDJSON:
+	default:
+		return nil, fmt.Errorf("batch: unknown format %q", format)
+	}
+	b := &batcher{size: size, delay: delay, format: format}
+	switch compression {
+	case "", "none":
+	case "gzip":
+		b.compression = compression
+		b.gzip = gzip.NewWriter(&b.compressed)
+	case "snappy":
+		b.compression = compression
+	default:
+		return nil, fmt.Errorf("batch: unknown compression %q", compression)
+	}
+	return b, nil
+}
+
+// add appends an encoded flow, it returns true when the batch is full
+func (b *batcher) add(body []byte) bool {
+	switch {
+	case b.format == batchNDJSON:
+		b.body.Write(body)
+		b.body.WriteByte('\n')
+	case b.count == 0:
+		b.body.WriteByte('[')
+		b.body.Write(body)
+	default:
+		b.body.WriteByte(',')
+		b.body.Write(body)
+	}
+	b.count++
+	return b.count >= b.size
+}
+
+func (b *batcher) empty() bool {
+	return b.count == 0
+}
+
+// contentType is the type of the uncompressed body
+func (b *batcher) contentType() string {
+	if b.format == batchNDJSON {
+		return "application/x-ndjson"
+	}
+	return "application/json"
+}
+
+// take returns the body of the batch, valid until the next add, and starts a new batch
+func (b *batcher) take() ([]byte, error) {
+	if b.format == batchJSON {
+		b.body.WriteByte(']')
+	}
+	b.count = 0
+	defer b.body.Reset()
+	switch b.compression {
+	case "gzip":
+		b.compressed.Reset()
+		b.gzip.Reset(&b.compressed)
+		if _, err := b.gzip.Write(b.body.Bytes()); err != nil {
+			return nil, err
+		}
+		if err := b.gzip.Close(); err != nil {
+			return nil, err
+		}
+		return b.compressed.Bytes(), nil
+	case "snappy":
+		// The block format, not the framed stream
+		b.snappy = snappy.Encode(b.snappy[:cap(b.snappy)], b.body.Bytes())
+		return b.snappy, nil
+	}
+	return b.body.Bytes(), nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"gitlab.com/OpenWifiPortal/conntrack-event-collector/conntrack"
+)
+
+func batchFlow(t *testing.T, id uint32) *conntrack.Buffer {
+	flow := conntrack.Flow{
+		Type: "NEW",
+		Id:   id,
+		Original: conntrack.Meta{
+			Layer3: conntrack.Layer3{Protonum: 2, Protoname: "ipv4", Src: net.IP{10, 0, 0, 1}, Dst: net.IP{10, 0, 0, 2}},
+			Layer4: conntrack.Layer4{Protonum: 6, Protoname: "tcp", Sport: 1234, Dport: 80},
+		},
+	}
+	buffer, err := conntrack.EncodeFlow(&flow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer
+}
+
+// decodeBatch uncompresses a body and returns the ids of its flows
+func decodeBatch(t *testing.T, body []byte, format, compression string) []uint32 {
+	switch compression {
+	case "gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body, err = ioutil.ReadAll(reader); err != nil {
+			t.Fatal(err)
+		}
+	case "snappy":
+		var err error
+		if body, err = snappy.Decode(nil, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var flows []struct{ Id uint32 }
+	if format == batchJSON {
+		if err := json.Unmarshal(body, &flows); err != nil {
+			t.Fatalf("%s: %s", body, err)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			var flow struct{ Id uint32 }
+			if err := json.Unmarshal(scanner.Bytes(), &flow); err != nil {
+				t.Fatalf("%s: %s", scanner.Bytes(), err)
+			}
+			flows = append(flows, flow)
+		}
+	}
+	ids := make([]uint32, len(flows))
+	for i, flow := range flows {
+		ids[i] = flow.Id
+	}
+	return ids
+}
+
+func TestBatcher(t *testing.T) {
+	contentTypes := map[string]string{batchJSON: "application/json", batchNDJSON: "application/x-ndjson"}
+	encodings := map[string]string{"none": "", "gzip": "gzip", "snappy": "snappy"}
+	for _, format := range []string{batchJSON, batchNDJSON} {
+		for _, compression := range []string{"none", "gzip", "snappy"} {
+			b, err := newBatcher(3, time.Second, format, compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b.contentType() != contentTypes[format] || b.compression != encodings[compression] {
+				t.Errorf("%s %s: got %s %q", format, compression, b.contentType(), b.compression)
+			}
+			// The second batch reuses the buffers of the first one
+			for round, ids := range [][]uint32{{1, 2, 3}, {4}} {
+				for i, id := range ids {
+					if full := b.add(batchFlow(t, id).B); full != (i == 2) {
+						t.Errorf("%s %s: got full %v after %d flows", format, compression, full, i+1)
+					}
+				}
+				body, err := b.take()
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := decodeBatch(t, body, format, compression)
+				if len(got) != len(ids) || got[0] != ids[0] || got[len(got)-1] != ids[len(ids)-1] {
+					t.Errorf("%s %s: batch %d: got %v, want %v", format, compression, round, got, ids)
+				}
+				if !b.empty() {
+					t.Errorf("%s %s: batch not empty once taken", format, compression)
+				}
+			}
+		}
+	}
+
+	if _, err := newBatcher(3, time.Second, "xml", ""); err == nil {
+		t.Error("got no error with an unknown format")
+	}
+	if _, err := newBatcher(3, time.Second, batchJSON, "lz4"); err == nil {
+		t.Error("got no error with an unknown compression")
+	}
+}
+
+func TestPublishFlowFlush(t *testing.T) {
+	type published struct {
+		body     []byte
+		encoding string
+		at       time.Time
+	}
+	publishedChan := make(chan published, 8)
+	defer func(body func(string, string, []byte, string, string)) { publishBody = body }(publishBody)
+	publishBody = func(routerId string, routingKey string, body []byte, contentType string, contentEncoding string) {
+		// The body is reused by the next batch
+		publishedChan <- published{append([]byte(nil), body...), contentEncoding, time.Now()}
+	}
+
+	batch, err := newBatcher(3, 100*time.Millisecond, batchNDJSON, "gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messageChan := make(chan message)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		publishFlow(messageChan, batch, nil, nil)
+	}()
+	receive := func(step string, want int) published {
+		select {
+		case p := <-publishedChan:
+			if ids := decodeBatch(t, p.body, batchNDJSON, p.encoding); len(ids) != want {
+				t.Errorf("%s: got %v, want %d flows", step, ids, want)
+			}
+			return p
+		case <-time.After(time.Second):
+			t.Fatalf("%s: nothing published", step)
+		}
+		return published{}
+	}
+
+	// A full batch is published at once
+	for id := uint32(1); id <= 3; id++ {
+		messageChan <- message{buffer: batchFlow(t, id)}
+	}
+	receive("size", 3)
+
+	// A batch which doesn't fill is published after the delay from its first flow
+	start := time.Now()
+	messageChan <- message{buffer: batchFlow(t, 4)}
+	messageChan <- message{buffer: batchFlow(t, 5)}
+	if p := receive("time", 2); p.at.Sub(start) < 100*time.Millisecond {
+		t.Errorf("got the batch published after %s, before the delay", p.at.Sub(start))
+	}
+
+	// The last batch is published when the flows end
+	messageChan <- message{buffer: batchFlow(t, 6)}
+	close(messageChan)
+	receive("close", 1)
+	<-done
+	if len(publishedChan) > 0 {
+		t.Errorf("got %d more batches", len(publishedChan))
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"fmt"
+	"gitlab.com/OpenWifiPortal/conntrack-event-collector/conntrack"
 	"gitlab.com/OpenWifiPortal/go-libs/amqp_tools"
 	"net"
+	"time"
 )
 
 var (
@@ -16,6 +18,38 @@ var (
 type ServiceConfig struct {
 	ClientAMQPConfig amqp_tools.ClientConfig
 	NatOnly          bool
+	Source           string
+	TrackState       bool
+	Snapshot         bool
+	ActiveTimeout    int
+	Resync           bool
+	MaxRestarts      int
+	MinBackoff       time.Duration
+	MaxBackoff       time.Duration
+	ShutdownTimeout  time.Duration
+	Expect           bool
+	ExpectRoutingKey string
+	Netns            []string
+	EventType        []string
+	Format           string
+	Filter           conntrack.Filter
+	PollInterval     time.Duration
+	UlogdInput       string
+	ReplayFile       string
+	ReplaySpeed      float64
+	PcapFile         string
+	Workers          int
+	QueueSize        int
+	QueuePolicy      string
+	BatchSize        int
+	BatchDelay       time.Duration
+	BatchFormat      string
+	BatchCompression string
+	StatsInterval    time.Duration
+	StatsWatermark   float64
+	StatsRoutingKey  string
+	Preflight        bool
+	EnableSysctl     bool
 }
 
 func GetMacAddr() (addr string) {
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// confirmTracker counts the publisher confirms still expected on the current AMQP channel
+type confirmTracker struct {
+	mutex     sync.Mutex
+	channel   *amqp.Channel
+	published uint64
+	confirmed uint64
+}
+
+// watch listens to the confirms of channel, it must be called before publishing on it
+func (t *confirmTracker) watch(channel *amqp.Channel) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if channel == t.channel {
+		return
+	}
+	// Delivery tags restart on a new channel, confirms of the old one are lost
+	t.channel = channel
+	t.published = 0
+	t.confirmed = 0
+	confirms := channel.NotifyPublish(make(chan amqp.Confirmation, 128))
+	go func() {
+		for range confirms {
+			t.mutex.Lock()
+			if t.channel == channel {
+				t.confirmed++
+			}
+			t.mutex.Unlock()
+		}
+	}()
+}
+
+func (t *confirmTracker) publish() {
+	t.mutex.Lock()
+	t.published++
+	t.mutex.Unlock()
+}
+
+func (t *confirmTracker) pending() uint64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.published - t.confirmed
+}
+
+// wait blocks until every publish is confirmed or the deadline, it returns the number still pending
+func (t *confirmTracker) wait(deadline time.Time) uint64 {
+	for {
+		pending := t.pending()
+		if pending == 0 || time.Now().After(deadline) {
+			return pending
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/sirupsen/logrus"
@@ -11,14 +12,38 @@ import (
 	"gitlab.com/OpenWifiPortal/conntrack-event-collector/conntrack"
 	"gitlab.com/OpenWifiPortal/go-libs/amqp_tools"
 	log "gitlab.com/OpenWifiPortal/go-libs/logger"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 var amqpClient *amqp_tools.ClientWrapper
+var confirms = &confirmTracker{}
 var cli = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		runConntrackMonitor()
 	},
 }
+var cliOptionRecord = &cobra.Command{
+	Use:   "record",
+	Short: "Record conntrack events.",
+	Long:  "Save the raw conntrack events with their arrival time, to be replayed with --source replay",
+	Run: func(cmd *cobra.Command, args []string) {
+		runRecord()
+	},
+}
+var cliOptionDoctor = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check the collector setup.",
+	Long:  "Run the preflight checks of the source in every namespace and report the problems",
+	Run: func(cmd *cobra.Command, args []string) {
+		runDoctor()
+	},
+}
 var cliOptionVersion = &cobra.Command{
 	Use:   "version",
 	Short: "Print the version.",
@@ -30,8 +55,14 @@ var cliOptionVersion = &cobra.Command{
 
 func init() {
 	cli.AddCommand(cliOptionVersion)
+	cli.AddCommand(cliOptionRecord)
+	cli.AddCommand(cliOptionDoctor)
+
+	cliOptionRecord.Flags().StringP("output", "o", "-", "File receiving the events, - for the standard output")
+	viper.BindPFlag("record_output", cliOptionRecord.Flags().Lookup("output"))
 
-	flags := cli.Flags()
+	// Shared with the record command
+	flags := cli.PersistentFlags()
 
 	flags.BoolP("verbose", "v", false, "Enable verbose")
 	viper.BindPFlag("verbose", flags.Lookup("verbose"))
@@ -39,6 +70,111 @@ func init() {
 	flags.BoolP("nat-only", "n", false, "Track nat only")
 	viper.BindPFlag("nat_only", flags.Lookup("nat-only"))
 
+	flags.Bool("track-state", false, "Track UPDATE events and publish state transitions")
+	viper.BindPFlag("track_state", flags.Lookup("track-state"))
+
+	flags.Bool("expect", false, "Collect expectation events")
+	viper.BindPFlag("expect", flags.Lookup("expect"))
+
+	flags.Bool("snapshot", false, "Publish the existing connections before the events")
+	viper.BindPFlag("snapshot", flags.Lookup("snapshot"))
+
+	flags.Bool("resync", false, "Publish a snapshot after events were lost")
+	viper.BindPFlag("resync", flags.Lookup("resync"))
+
+	flags.Duration("shutdown-timeout", 5*time.Second, "Maximum time to publish the queued events on exit")
+	viper.BindPFlag("shutdown_timeout", flags.Lookup("shutdown-timeout"))
+
+	flags.Int("restart-max", 0, "Consecutive conntrack failures before exiting (0 for unlimited)")
+	viper.BindPFlag("restart_max", flags.Lookup("restart-max"))
+
+	flags.Duration("restart-backoff-min", time.Second, "Minimum delay before restarting conntrack")
+	viper.BindPFlag("restart_backoff_min", flags.Lookup("restart-backoff-min"))
+
+	flags.Duration("restart-backoff-max", time.Minute, "Maximum delay before restarting conntrack")
+	viper.BindPFlag("restart_backoff_max", flags.Lookup("restart-backoff-max"))
+
+	flags.Int("active-timeout", 0, "Publish INTERIM events for connections older than this many seconds (0 to disable)")
+	viper.BindPFlag("active_timeout", flags.Lookup("active-timeout"))
+
+	flags.String("conntrack-format", conntrack.FormatText, "conntrack output parsed by the exec source (text|xml)")
+	viper.BindPFlag("conntrack_format", flags.Lookup("conntrack-format"))
+
+	flags.StringSlice("event-type", []string{"NEW", "DESTROY"}, "Event types to collect (NEW,UPDATE,DESTROY)")
+	viper.BindPFlag("event_type", flags.Lookup("event-type"))
+
+	flags.StringP("family", "f", "", "Collect only this address family (ipv4|ipv6)")
+	viper.BindPFlag("family", flags.Lookup("family"))
+
+	flags.StringP("protocol", "p", "", "Collect only this layer 4 protocol, name or number")
+	viper.BindPFlag("protocol", flags.Lookup("protocol"))
+
+	flags.String("zone", "", "Collect only this conntrack zone")
+	viper.BindPFlag("zone", flags.Lookup("zone"))
+
+	flags.String("mark", "", "Collect only connections matching mark[/mask]")
+	viper.BindPFlag("mark", flags.Lookup("mark"))
+
+	flags.StringSlice("orig-src", nil, "Collect only connections from these networks (CIDR) in the original direction")
+	viper.BindPFlag("orig_src", flags.Lookup("orig-src"))
+
+	flags.StringSlice("orig-dst", nil, "Collect only connections to these networks (CIDR) in the original direction")
+	viper.BindPFlag("orig_dst", flags.Lookup("orig-dst"))
+
+	flags.String("source", "exec", fmt.Sprintf("Event source (%s)", strings.Join(conntrack.Sources(), "|")))
+	viper.BindPFlag("source", flags.Lookup("source"))
+
+	flags.StringSlice("netns", nil, "Network namespaces to watch, names from /var/run/netns or paths (default the current one)")
+	viper.BindPFlag("netns", flags.Lookup("netns"))
+
+	flags.Duration("poll-interval", 10*time.Second, "Delay between two reads of the table by the proc source")
+	viper.BindPFlag("poll_interval", flags.Lookup("poll-interval"))
+
+	flags.String("ulogd-input", "/var/log/ulogd.json", "ulogd JSON file, or unix:path socket, read by the ulogd source")
+	viper.BindPFlag("ulogd_input", flags.Lookup("ulogd-input"))
+
+	flags.String("replay-file", "", "File of recorded or captured events read by the replay source")
+	viper.BindPFlag("replay_file", flags.Lookup("replay-file"))
+
+	flags.Float64("replay-speed", 1, "Replay speed, 1 for the original timing, 0 for as fast as possible")
+	viper.BindPFlag("replay_speed", flags.Lookup("replay-speed"))
+
+	flags.String("pcap-file", "", "pcap or pcapng capture read by the pcap source, paced by --replay-speed")
+	viper.BindPFlag("pcap_file", flags.Lookup("pcap-file"))
+
+	flags.Int("workers", 0, "Goroutines parsing and encoding the events, sharded by connection (0 for one per CPU)")
+	viper.BindPFlag("workers", flags.Lookup("workers"))
+
+	flags.Int("queue-size", 128, "Flows buffered before the publisher")
+	viper.BindPFlag("queue_size", flags.Lookup("queue-size"))
+
+	flags.String("queue-policy", conntrack.QueueBlock, "Policy of a full queue (block|drop-newest|drop-oldest|prefer-destroy)")
+	viper.BindPFlag("queue_policy", flags.Lookup("queue-policy"))
+
+	flags.Int("batch-size", 0, "Flows published in a single message (0 or 1 for a message per flow)")
+	viper.BindPFlag("batch_size", flags.Lookup("batch-size"))
+
+	flags.Duration("batch-delay", 100*time.Millisecond, "Maximum delay before publishing an incomplete batch")
+	viper.BindPFlag("batch_delay", flags.Lookup("batch-delay"))
+
+	flags.String("batch-format", batchJSON, "Body of a batch (json|ndjson)")
+	viper.BindPFlag("batch_format", flags.Lookup("batch-format"))
+
+	flags.String("batch-compression", "none", "Compression of a batch (none|gzip|snappy)")
+	viper.BindPFlag("batch_compression", flags.Lookup("batch-compression"))
+
+	flags.Bool("preflight", true, "Check the setup on start and exit on failure")
+	viper.BindPFlag("preflight", flags.Lookup("preflight"))
+
+	flags.Bool("enable-sysctl", false, "Enable nf_conntrack_acct and nf_conntrack_timestamp when they are off")
+	viper.BindPFlag("enable_sysctl", flags.Lookup("enable-sysctl"))
+
+	flags.Duration("stats-interval", 0, "Delay between two table stats (0 to disable)")
+	viper.BindPFlag("stats_interval", flags.Lookup("stats-interval"))
+
+	flags.Float64("stats-watermark", 90, "Table usage percent raising a HIGH_WATERMARK alert (0 to disable)")
+	viper.BindPFlag("stats_watermark", flags.Lookup("stats-watermark"))
+
 	flags.String("amqp-host", "localhost", "RabbitMQ Host")
 	viper.BindPFlag("amqp_host", flags.Lookup("amqp-host"))
 
@@ -63,6 +199,12 @@ func init() {
 	flags.String("amqp-exchange", "conntrack", "RabbitMQ Exchange")
 	viper.BindPFlag("amqp_exchange", flags.Lookup("amqp-exchange"))
 
+	flags.String("amqp-expect-routing-key", "expect", "RabbitMQ routing key of expectation events")
+	viper.BindPFlag("amqp_expect_routing_key", flags.Lookup("amqp-expect-routing-key"))
+
+	flags.String("amqp-stats-routing-key", "stats", "RabbitMQ routing key of table stats")
+	viper.BindPFlag("amqp_stats_routing_key", flags.Lookup("amqp-stats-routing-key"))
+
 	flags.String("vault-addr", "http://127.0.0.1:8200", "Vault address")
 	viper.BindPFlag("vault_addr", flags.Lookup("vault-addr"))
 
@@ -80,30 +222,244 @@ func main() {
 	cli.Execute()
 }
 
-var flowMessages = make(chan conntrack.Flow, 128)
+// The flows are buffered by flowQueue, flowMessages is its unbuffered input
+var flowMessages = make(chan conntrack.Flow)
+var flowQueue *conntrack.FlowQueue
+var expectationMessages = make(chan conntrack.Expectation, 128)
+var statsMessages = make(chan conntrack.TableStats, 16)
 
-func publishFlow(flowChan <-chan conntrack.Flow) {
+// publishFlow is the single writer of the AMQP channel, closed inputs are disabled.
+// The flows are grouped in batches when batch isn't nil
+func publishFlow(messageChan <-chan message, batch *batcher, expectationChan <-chan conntrack.Expectation, statsChan <-chan conntrack.TableStats) {
 	routerId := config.GetId()
-	for flow := range flowChan {
-		if flow.Type != "" {
-			body, err := json.Marshal(flow)
-			if err != nil {
-				log.Errorln(err)
+	var flushTimer *time.Timer
+	var flush <-chan time.Time
+	publishBatch := func() {
+		if flushTimer != nil && !flushTimer.Stop() {
+			// Drain a tick not received yet, it would flush the next batch early
+			select {
+			case <-flushTimer.C:
+			default:
+			}
+		}
+		flush = nil
+		if batch.empty() {
+			return
+		}
+		defer atomic.AddInt64(&pendingFlows, -int64(batch.count))
+		body, err := batch.take()
+		if err != nil {
+			log.Errorln(err)
+			return
+		}
+		publishBody(routerId, "", body, batch.contentType(), batch.compression)
+	}
+	for messageChan != nil || expectationChan != nil || statsChan != nil {
+		select {
+		case message, ok := <-messageChan:
+			if !ok {
+				messageChan = nil
+				if batch != nil {
+					publishBatch()
+				}
+				continue
+			}
+			if batch == nil {
+				publish(routerId, "", message.buffer.B)
+				message.buffer.Release()
+				atomic.AddInt64(&pendingFlows, -1)
 				continue
 			}
-			err = amqpClient.Publish(amqpClient.Config.Exchange, "", body, "", amqp.Table{
-				"router_id": routerId,
-			})
-			if err != nil {
-				log.Errorln(err)
-				amqpClient.WaitConnection()
+			if batch.empty() {
+				// The delay starts with the first flow of the batch
+				if flushTimer == nil {
+					flushTimer = time.NewTimer(batch.delay)
+				} else {
+					flushTimer.Reset(batch.delay)
+				}
+				flush = flushTimer.C
+			}
+			full := batch.add(message.buffer.B)
+			message.buffer.Release()
+			if full {
+				publishBatch()
+			}
+		case <-flush:
+			flush = nil
+			publishBatch()
+		case expectation, ok := <-expectationChan:
+			if !ok {
+				expectationChan = nil
 				continue
 			}
+			publishJSON(routerId, config.Config.ExpectRoutingKey, expectation)
+		case stats, ok := <-statsChan:
+			if !ok {
+				statsChan = nil
+				continue
+			}
+			publishJSON(routerId, config.Config.StatsRoutingKey, stats)
 		}
 	}
 }
 
-func runConntrackMonitor() {
+func publishJSON(routerId string, routingKey string, event interface{}) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Errorln(err)
+		return
+	}
+	publish(routerId, routingKey, body)
+}
+
+func publish(routerId string, routingKey string, body []byte) {
+	publishBody(routerId, routingKey, body, "application/json", "")
+}
+
+// publishBody publishes a message, the tests replace it
+var publishBody = amqpPublish
+
+// amqpPublish publishes like amqpClient.Publish, with the content type and encoding of the body
+func amqpPublish(routerId string, routingKey string, body []byte, contentType string, contentEncoding string) {
+	if !amqpClient.Config.NoWait {
+		confirms.watch(amqpClient.Channel)
+	}
+	err := amqpClient.Channel.Publish(amqpClient.Config.Exchange, routingKey, false, false, amqp.Publishing{
+		Timestamp:       time.Now(),
+		DeliveryMode:    amqp.Persistent,
+		ContentType:     contentType,
+		ContentEncoding: contentEncoding,
+		Body:            body,
+		Headers: amqp.Table{
+			"router_id": routerId,
+		},
+	})
+	if err != nil {
+		log.Errorf("[amqp] exchange publish: %s", err)
+		amqpClient.WaitConnection()
+		return
+	}
+	if !amqpClient.Config.NoWait {
+		confirms.publish()
+	}
+}
+
+// stopper is a running source
+type stopper interface {
+	Stop() error
+}
+
+// shutdown stops the sources, then publishes the queued flows and waits for their confirms until the timeout
+func shutdown(sources []stopper, publishDone <-chan struct{}) {
+	deadline := time.Now().Add(config.Config.ShutdownTimeout)
+	for i := len(sources) - 1; i >= 0; i-- {
+		if err := sources[i].Stop(); err != nil {
+			log.Errorln(err)
+		}
+	}
+
+	close(flowMessages)
+	close(expectationMessages)
+	close(statsMessages)
+	published := true
+	select {
+	case <-publishDone:
+	case <-time.After(time.Until(deadline)):
+		published = false
+		log.Warnf("shutdown timeout, %d events not published", flowQueue.Stats().Length+int(atomic.LoadInt64(&pendingFlows))+len(expectationMessages)+len(statsMessages))
+	}
+	if pending := confirms.wait(deadline); pending > 0 {
+		log.Warnf("shutdown timeout, %d events not confirmed", pending)
+	}
+
+	// publishFlow may still be publishing on the channel, closing the connection closes it too
+	if published {
+		if err := amqpClient.Channel.Close(); err != nil {
+			log.Errorln(err)
+		}
+	}
+	if err := amqpClient.Connection.Close(); err != nil {
+		log.Errorln(err)
+	}
+}
+
+func hasEventType(eventType []string, event string) bool {
+	for _, e := range eventType {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// waitFinished returns a channel closed when every source has an end and reached it, nil otherwise
+func waitFinished(sources []stopper) <-chan struct{} {
+	var finishers []conntrack.Finisher
+	for _, source := range sources {
+		if finisher, ok := source.(conntrack.Finisher); ok {
+			finishers = append(finishers, finisher)
+		}
+	}
+	if len(finishers) == 0 {
+		return nil
+	}
+	finished := make(chan struct{})
+	go func() {
+		for _, finisher := range finishers {
+			<-finisher.Finished()
+		}
+		close(finished)
+	}()
+	return finished
+}
+
+// startSources starts the event source of a namespace and its expectation source, interim and stats reporters if enabled.
+// The stats of the shared flow queue are only added by the reporter given queue, so that its drops are counted once
+func startSources(sourceOptions conntrack.SourceOptions, queue *conntrack.FlowQueue, errChan chan<- error) []stopper {
+	source, err := conntrack.NewSource(config.Config.Source, sourceOptions)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := source.Start(flowMessages, errChan); err != nil {
+		log.Fatalln(err)
+	}
+	sources := []stopper{source}
+
+	if config.Config.Expect {
+		expectationSource, err := conntrack.NewExpectationSource(config.Config.Source, sourceOptions)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := expectationSource.Start(expectationMessages, errChan); err != nil {
+			log.Fatalln(err)
+		}
+		sources = append(sources, expectationSource)
+	}
+
+	if config.Config.ActiveTimeout > 0 {
+		dumper, ok := source.(conntrack.Dumper)
+		if !ok {
+			log.Fatalf("source %s can't list connections for interim records", config.Config.Source)
+		}
+		reporter := conntrack.NewInterimReporter(dumper, time.Duration(config.Config.ActiveTimeout)*time.Second)
+		if err := reporter.Start(flowMessages, errChan); err != nil {
+			log.Fatalln(err)
+		}
+		sources = append(sources, reporter)
+	}
+
+	if config.Config.StatsInterval > 0 {
+		reporter := conntrack.NewStatsReporter(config.Config.Source, sourceOptions, config.Config.StatsInterval, config.Config.StatsWatermark, queue)
+		if err := reporter.Start(statsMessages, errChan); err != nil {
+			log.Fatalln(err)
+		}
+		sources = append(sources, reporter)
+	}
+	return sources
+}
+
+// loadConfig reads the configuration file, the environment and the flags
+func loadConfig() {
 	viper.SetConfigName("conntrack-event-collector") // name of config file (without extension)
 	viper.AddConfigPath("/etc/owp")                  // path to look for the config file in
 	viper.AddConfigPath("/etc/config/owp")           // path to look for the config file in
@@ -147,14 +503,230 @@ func runConntrackMonitor() {
 			VaultPathCreds:  viper.GetString("vault_path_creds"),
 			VaultPathConfig: viper.GetString("vault_path_config"),
 		},
-		NatOnly: viper.GetBool("nat_only"),
+		NatOnly:          viper.GetBool("nat_only"),
+		Source:           viper.GetString("source"),
+		TrackState:       viper.GetBool("track_state"),
+		Snapshot:         viper.GetBool("snapshot"),
+		ActiveTimeout:    viper.GetInt("active_timeout"),
+		Resync:           viper.GetBool("resync"),
+		MaxRestarts:      viper.GetInt("restart_max"),
+		MinBackoff:       viper.GetDuration("restart_backoff_min"),
+		MaxBackoff:       viper.GetDuration("restart_backoff_max"),
+		ShutdownTimeout:  viper.GetDuration("shutdown_timeout"),
+		Expect:           viper.GetBool("expect"),
+		ExpectRoutingKey: viper.GetString("amqp_expect_routing_key"),
+		Netns:            viper.GetStringSlice("netns"),
+		EventType:        viper.GetStringSlice("event_type"),
+		Format:           viper.GetString("conntrack_format"),
+		PollInterval:     viper.GetDuration("poll_interval"),
+		UlogdInput:       viper.GetString("ulogd_input"),
+		ReplayFile:       viper.GetString("replay_file"),
+		ReplaySpeed:      viper.GetFloat64("replay_speed"),
+		PcapFile:         viper.GetString("pcap_file"),
+		Workers:          viper.GetInt("workers"),
+		QueueSize:        viper.GetInt("queue_size"),
+		QueuePolicy:      viper.GetString("queue_policy"),
+		BatchSize:        viper.GetInt("batch_size"),
+		BatchDelay:       viper.GetDuration("batch_delay"),
+		BatchFormat:      viper.GetString("batch_format"),
+		BatchCompression: viper.GetString("batch_compression"),
+		StatsInterval:    viper.GetDuration("stats_interval"),
+		StatsWatermark:   viper.GetFloat64("stats_watermark"),
+		StatsRoutingKey:  viper.GetString("amqp_stats_routing_key"),
+		Preflight:        viper.GetBool("preflight"),
+		EnableSysctl:     viper.GetBool("enable_sysctl"),
+		Filter: conntrack.Filter{
+			Family:   viper.GetString("family"),
+			Protocol: viper.GetString("protocol"),
+			Zone:     viper.GetString("zone"),
+			Mark:     viper.GetString("mark"),
+			OrigSrc:  viper.GetStringSlice("orig_src"),
+			OrigDst:  viper.GetStringSlice("orig_dst"),
+		},
+	}
+	if config.Config.Workers <= 0 {
+		config.Config.Workers = runtime.NumCPU()
+	}
+	if len(config.Config.Netns) == 0 {
+		// The namespace of the collector
+		config.Config.Netns = []string{""}
 	}
 
 	log.Debugf("config: %+v", config.Config)
+}
+
+// sourceOptions are the options of the sources watching netns
+func sourceOptions(netns string) conntrack.SourceOptions {
+	eventType := config.Config.EventType
+	if config.Config.TrackState && !hasEventType(eventType, "UPDATE") {
+		// State transitions are found in UPDATE events
+		eventType = append(eventType, "UPDATE")
+	}
+	return conntrack.SourceOptions{
+		EventType:    eventType,
+		NatOnly:      config.Config.NatOnly,
+		Format:       config.Config.Format,
+		Filter:       config.Config.Filter,
+		Snapshot:     config.Config.Snapshot,
+		Resync:       config.Config.Resync,
+		MaxRestarts:  config.Config.MaxRestarts,
+		MinBackoff:   config.Config.MinBackoff,
+		MaxBackoff:   config.Config.MaxBackoff,
+		Netns:        netns,
+		PollInterval: config.Config.PollInterval,
+		UlogdInput:   config.Config.UlogdInput,
+		ReplayFile:   config.Config.ReplayFile,
+		ReplaySpeed:  config.Config.ReplaySpeed,
+		PcapFile:     config.Config.PcapFile,
+		Workers:      config.Config.Workers,
+	}
+}
 
+// preflight logs the problems of the setup of every namespace and tells if the sources can run
+func preflight() bool {
+	ok := true
+	for _, netns := range config.Config.Netns {
+		for _, check := range conntrack.Preflight(config.Config.Source, sourceOptions(netns), config.Config.EnableSysctl) {
+			name := check.Name
+			if netns != "" {
+				name = fmt.Sprintf("%s in %s", check.Name, netns)
+			}
+			switch check.Status {
+			case conntrack.CheckFail:
+				log.Errorf("preflight %s: %s", name, check.Detail)
+				ok = false
+			case conntrack.CheckWarn:
+				log.Warnf("preflight %s: %s", name, check.Detail)
+			default:
+				log.Debugf("preflight %s: %s", name, check.Detail)
+			}
+		}
+	}
+	return ok
+}
+
+func runConntrackMonitor() {
+	loadConfig()
+	if config.Config.Preflight && !preflight() {
+		log.Fatalln("preflight failed, run the doctor command or disable --preflight")
+	}
+
+	var err error
+	flowQueue, err = conntrack.NewFlowQueue(config.Config.QueuePolicy, config.Config.QueueSize)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	var batch *batcher
+	if config.Config.BatchSize > 1 {
+		batch, err = newBatcher(config.Config.BatchSize, config.Config.BatchDelay, config.Config.BatchFormat, config.Config.BatchCompression)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
 	amqpClient, err = amqp_tools.New(&config.Config.ClientAMQPConfig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	publishDone := make(chan struct{})
+	go func() {
+		flows := flowQueue.Run(flowMessages)
+		publishFlow(encodeFlows(flows, config.Config.Workers), batch, expectationMessages, statsMessages)
+		close(publishDone)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	errChan := make(chan error)
+	var sources []stopper
+	for i, netns := range config.Config.Netns {
+		queue := flowQueue
+		if i > 0 {
+			queue = nil
+		}
+		sources = append(sources, startSources(sourceOptions(netns), queue, errChan)...)
+	}
+	finished := waitFinished(sources)
+
+	exitCode := 0
+loop:
+	for {
+		select {
+		case err := <-errChan:
+			log.Errorln(err)
+			if _, ok := err.(*conntrack.RestartError); ok {
+				exitCode = 1
+				break loop
+			}
+		case sig := <-signals:
+			log.Infof("received %s, shutting down...", sig)
+			break loop
+		case <-finished:
+			log.Infoln("sources finished, shutting down...")
+			break loop
+		}
+	}
+	shutdown(sources, publishDone)
+	os.Exit(exitCode)
+}
+
+// runRecord writes the conntrack events to the output until SIGTERM or SIGINT
+func runRecord() {
+	loadConfig()
+	if len(config.Config.Netns) > 1 {
+		log.Fatalln("record watches a single namespace")
+	}
+
+	output := os.Stdout
+	if path := viper.GetString("record_output"); path != "-" {
+		file, err := os.Create(path)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer file.Close()
+		output = file
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Infof("received %s, stopping the record...", sig)
+		cancel()
+	}()
 
-	go publishFlow(flowMessages)
+	count, err := conntrack.Record(ctx, sourceOptions(config.Config.Netns[0]), output)
+	log.Infof("%d events recorded", count)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// runDoctor prints the preflight checks of every namespace and exits with 1 if one isn't OK
+func runDoctor() {
+	loadConfig()
+	exitCode := 0
+	for _, netns := range config.Config.Netns {
+		if netns != "" {
+			fmt.Printf("netns %s:\n", netns)
+		}
+		checks := conntrack.Preflight(config.Config.Source, sourceOptions(netns), config.Config.EnableSysctl)
+		if len(checks) == 0 {
+			fmt.Printf("[  OK  ] source %s doesn't need any setup\n", config.Config.Source)
+		}
+		for _, check := range checks {
+			fmt.Printf("[%s] %s: %s\n", centered(check.Status, 6), check.Name, check.Detail)
+			if check.Status != conntrack.CheckOk {
+				exitCode = 1
+			}
+		}
+	}
+	os.Exit(exitCode)
+}
 
-	conntrack.Watch(flowMessages, []string{"NEW", "DESTROY"}, config.Config.NatOnly)
+func centered(s string, width int) string {
+	left := (width - len(s)) / 2
+	return strings.Repeat(" ", left) + s + strings.Repeat(" ", width-len(s)-left)
 }
@@ -3,178 +3,248 @@ package conntrack
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"fmt"
 	log "gitlab.com/OpenWifiPortal/go-libs/logger"
-	"net"
+	"io"
+	"io/ioutil"
 	"os/exec"
-	"regexp"
 	"strconv"
 	"strings"
 )
 
 const ConntrackBufferSize = 15000000
-const conntrackFlowRegex = `\[(?P<timestamp>\d+\.\d+)(?:\s+)?\]\s+\[(?P<type>\w+)\]\s+(?P<protoname3>\w+)\s+(?P<protonum3>\d+)\s+(?P<protoname4>\w+)\s+`
-const conntrackOriginalRegex = `(?:.+)src=(?P<originalSrc>\S+)\s+dst=(?P<originalDst>\S+)\s+(?:sport=(?P<originalSport>\d+)\s+dport=(?P<originalDport>\d+)\s+)?(?:packets=(?P<originalPackets>\d+)\s+bytes=(?P<originalBytes>\d+))?`
-const conntrackReplyRegex = `(?:.+)src=(?P<replySrc>\S+)\s+dst=(?P<replyDst>\S+)\s+(?:sport=(?P<replySport>\d+)\s+dport=(?P<replyDport>\d+)\s+)?(?:packets=(?P<replyPackets>\d+)\s+bytes=(?P<replyBytes>\d+))?`
 
-var conntrackRegexCompiled *regexp.Regexp
+func init() {
+	RegisterSource("exec", newExecSource)
+}
 
-func Watch(flowChan chan Flow, eventType []string, natOnly bool, otherArgs ...string) {
-	regexBuffer := bytes.Buffer{}
-	regexBuffer.WriteString(conntrackFlowRegex)
-	regexBuffer.WriteString(conntrackOriginalRegex)
-	regexBuffer.WriteString(conntrackReplyRegex)
-	conntrackRegexCompiled = regexp.MustCompile(regexBuffer.String())
+// execSource runs the conntrack binary and parses its output
+type execSource struct {
+	options SourceOptions
+	filter  *filter
+	args    []string
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
 
-	for {
-		runConntrack(flowChan, eventType, natOnly, otherArgs...)
+func newExecSource(options SourceOptions) (Source, error) {
+	if err := checkEventTypes(options.EventType); err != nil {
+		return nil, err
+	}
+	switch options.Format {
+	case "", FormatText, FormatXML:
+	default:
+		return nil, fmt.Errorf("conntrack: unknown output format %q", options.Format)
+	}
+	filter, err := options.Filter.compile()
+	if err != nil {
+		return nil, err
+	}
+	args, err := filter.args()
+	if err != nil {
+		return nil, err
 	}
+	if err := filter.checkConntrack(conntrackVersion); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &execSource{
+		options: options,
+		filter:  filter,
+		args:    args,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// conntrackVersion returns the version of the installed conntrack, like 1.4.6
+func conntrackVersion() (string, error) {
+	output, err := exec.Command("conntrack", "--version").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("conntrack --version: %s", err)
+	}
+	// conntrack v1.4.6 (conntrack-tools)
+	for _, field := range strings.Fields(string(output)) {
+		if len(field) > 1 && field[0] == 'v' && field[1] >= '0' && field[1] <= '9' {
+			return field[1:], nil
+		}
+	}
+	return "", fmt.Errorf("conntrack --version: unknown output %q", strings.TrimSpace(string(output)))
+}
+
+func (s *execSource) Start(flowChan chan<- Flow, errChan chan<- error) error {
+	go func() {
+		defer close(s.done)
+		newSupervisor("conntrack", s.options).run(s.ctx, errChan, func(ctx context.Context) error {
+			return s.runConntrack(ctx, flowChan)
+		})
+	}()
+	return nil
 }
 
-func runConntrack(flowChan chan Flow, eventType []string, natOnly bool, otherArgs ...string) {
+func (s *execSource) Stop() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+// eventArgs are the conntrack options listening to the events
+func (s *execSource) eventArgs() []string {
 	args := []string{
 		"--buffer-size", strconv.Itoa(ConntrackBufferSize),
 		"-E",
 		"-o", "timestamp,extended,id",
 	}
-	if eventType != nil {
+	if s.options.Format == FormatXML {
+		args[len(args)-1] = "xml,timestamp,id"
+	}
+	if s.options.EventType != nil {
 		args = append(args, "-e")
-		args = append(args, strings.Join(eventType, ","))
+		args = append(args, strings.Join(s.options.EventType, ","))
 	}
-	if natOnly {
+	if s.options.NatOnly {
 		args = append(args, "-n")
 	}
-	if otherArgs != nil {
-		args = append(args, otherArgs...)
+	args = append(args, s.args...)
+	if s.options.OtherArgs != nil {
+		args = append(args, s.options.OtherArgs...)
 	}
-	cmd := exec.Command("conntrack", args...)
+	return args
+}
+
+func (s *execSource) runConntrack(ctx context.Context, flowChan chan<- Flow) error {
+	// The process is killed when the context is cancelled
+	cmd := exec.CommandContext(ctx, "conntrack", s.eventArgs()...)
 	stderrPipe, err := cmd.StderrPipe()
 	if err != nil {
-		log.Errorln("error conntrack: ", err)
+		return fmt.Errorf("error conntrack: %s", err)
 	}
+	stdoutPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("error conntrack: %s", err)
+	}
+	stdout := bufio.NewReader(stdoutPipe)
 
+	log.Infoln("starting conntrack...")
+	if err := inNetns(s.options.Netns, cmd.Start); err != nil {
+		return fmt.Errorf("error conntrack start: %s", err)
+	}
+
+	reporter := &overflowReporter{
+		dumper: s,
+		netns:  s.options.Netns,
+		resync: s.options.Resync,
+		drops: func() (uint64, error) {
+			// The port id of a socket isn't always the pid, the socket is found by its inode
+			inodes, err := processSockets(cmd.Process.Pid)
+			if err != nil {
+				return 0, err
+			}
+			return netlinkDrops(s.options.Netns, inodes...)
+		},
+	}
+	var lastStderr string
+	stderrDone := make(chan struct{})
 	go func() {
+		defer close(stderrDone)
 		stderr := bufio.NewReader(stderrPipe)
 		for {
 			line, _, err := stderr.ReadLine()
 			if err != nil {
-				log.Errorln("error stderr readline: ", err)
 				break
 			}
-			log.Warnln(string(line))
+			lastStderr = string(line)
+			log.Warnln(lastStderr)
+			if bytes.Contains(line, []byte("ENOBUFS")) {
+				if err := reporter.overflow(flowChan, ctx.Done()); err != nil {
+					log.Errorln(err)
+				}
+			}
 		}
 	}()
 
-	stdoutPipe, err := cmd.StdoutPipe()
+	err = s.readEvents(ctx, stdout, flowChan)
 	if err != nil {
-		log.Errorln("error conntrack: ", err)
+		// Unblock the process, Wait needs the pipes to be drained
+		cmd.Process.Kill()
+		ioutil.ReadAll(stdout)
 	}
-	stdout := bufio.NewReader(stdoutPipe)
-	log.Infoln("starting conntrack...")
-	cmd.Start()
+	<-stderrDone
+	waitErr := cmd.Wait()
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if waitErr == nil {
+		return fmt.Errorf("conntrack exited: %s", lastStderr)
+	}
+	return fmt.Errorf("conntrack exited: %s: %s", waitErr, lastStderr)
+}
 
+// readEvents parses conntrack output until it ends, a nil error means the process closed its output
+func (s *execSource) readEvents(ctx context.Context, stdout *bufio.Reader, flowChan chan<- Flow) error {
+	// Events are queued by conntrack while the table is dumped
+	if s.options.Snapshot {
+		if err := snapshot(s, s.options.Netns, flowChan, ctx.Done()); err != nil {
+			return err
+		}
+	}
+	if s.options.Format == FormatXML {
+		return s.readXMLEvents(ctx, stdout, flowChan)
+	}
+
+	var workers *parseWorkers
+	if s.options.Workers > 1 {
+		workers = newParseWorkers(ctx, s, flowChan)
+		defer workers.close()
+	}
+	var parser Parser
 	var buffer bytes.Buffer
 	for {
 		frag, isPrefix, err := stdout.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
-			log.Errorln("error stdout readline: ", err)
-			break
+			return fmt.Errorf("error stdout readline: %s", err)
 		}
 		buffer.Write(frag)
 		if !isPrefix {
-			line := buffer.String()
-			// blocking to prevent memory leak
-			flow := flowParse(line)
-			flowChan <- flow
+			var ok bool
+			if workers != nil {
+				ok = workers.dispatch(ctx, buffer.Bytes())
+			} else {
+				ok = s.parseEvent(ctx, &parser, buffer.Bytes(), flowChan)
+			}
 			buffer.Reset()
+			if !ok {
+				return nil
+			}
 		}
 
 	}
 }
 
-func flowParse(str string) Flow {
-	var flow = Flow{}
-	flow.Original = Meta{}
-	flow.Original.Layer3 = Layer3{}
-	flow.Original.Layer4 = Layer4{}
-	flow.Original.Counter = Counter{}
-	flow.Reply = Meta{}
-	flow.Reply.Layer3 = Layer3{}
-	flow.Reply.Layer4 = Layer4{}
-	flow.Reply.Counter = Counter{}
-
-	result := conntrackRegexCompiled.FindStringSubmatch(str)
-	names := conntrackRegexCompiled.SubexpNames()
-	for i, match := range result {
-		if i != 0 {
-			switch names[i] {
-			case "timestamp":
-				// Timestamp in second with float
-				timestamp, _ := strconv.ParseFloat(match, 64)
-				// Timestamp in milliseconds
-				flow.Timestamp = int64(timestamp * 1000)
-				break
-			case "type":
-				flow.Type = match
-				break
-			case "protoname3":
-				flow.Original.Layer3.Protoname = match
-				flow.Reply.Layer3.Protoname = match
-				break
-			case "protonum3":
-				flow.Original.Layer3.Protonum, _ = strconv.Atoi(match)
-				flow.Reply.Layer3.Protonum, _ = strconv.Atoi(match)
-				break
-			case "protoname4":
-				flow.Original.Layer4.Protoname = match
-				flow.Reply.Layer4.Protoname = match
-				break
-			case "protonum4":
-				flow.Original.Layer4.Protonum, _ = strconv.Atoi(match)
-				flow.Reply.Layer4.Protonum, _ = strconv.Atoi(match)
-				break
-			case "originalSrc":
-				flow.Original.Layer3.Src = net.ParseIP(match)
-				break
-			case "originalDst":
-				flow.Original.Layer3.Dst = net.ParseIP(match)
-				break
-			case "originalSport":
-				flow.Original.Layer4.Sport, _ = strconv.Atoi(match)
-				break
-			case "originalDport":
-				flow.Original.Layer4.Dport, _ = strconv.Atoi(match)
-				break
-			case "originalPackets":
-				flow.Original.Counter.Packets, _ = strconv.Atoi(match)
-				break
-			case "originalBytes":
-				flow.Original.Counter.Bytes, _ = strconv.Atoi(match)
-				break
-			case "replySrc":
-				flow.Reply.Layer3.Src = net.ParseIP(match)
-				break
-			case "replyDst":
-				flow.Reply.Layer3.Dst = net.ParseIP(match)
-				break
-			case "replySport":
-				flow.Reply.Layer4.Sport, _ = strconv.Atoi(match)
-				break
-			case "replyDport":
-				flow.Reply.Layer4.Dport, _ = strconv.Atoi(match)
-				break
-			case "replyPackets":
-				flow.Reply.Counter.Packets, _ = strconv.Atoi(match)
-				break
-			case "replyBytes":
-				flow.Reply.Counter.Bytes, _ = strconv.Atoi(match)
-				break
-			}
-
-		}
+// parseEvent sends the flow of a line if it matches the filter, it returns false when ctx is done
+func (s *execSource) parseEvent(ctx context.Context, parser *Parser, line []byte, flowChan chan<- Flow) bool {
+	flow, err := parser.Parse(line)
+	if err != nil {
+		log.Errorln(err)
+		return true
 	}
-	if len(result) == 0 {
-		log.Errorln("parse error of: ", str)
+	if !s.filter.match(&flow) {
+		return true
+	}
+	flow.Netns = s.options.Netns
+	select {
+	case flowChan <- flow:
+		return true
+	case <-ctx.Done():
+		return false
 	}
-
-	return flow
 }
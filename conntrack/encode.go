@@ -0,0 +1,286 @@
+package conntrack
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// errInvalidIP is returned for an address of a wrong length, which json.Marshal fails to encode too
+var errInvalidIP = errors.New("encode: invalid IP address")
+
+// Buffer holds an encoded flow, Release returns it to the pool once published
+type Buffer struct {
+	B []byte
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return &Buffer{B: make([]byte, 0, 1024)}
+	},
+}
+
+// EncodeFlow encodes the flow into a pooled buffer, the bytes are the ones of json.Marshal
+func EncodeFlow(flow *Flow) (*Buffer, error) {
+	buffer := bufferPool.Get().(*Buffer)
+	var err error
+	buffer.B, err = flow.AppendJSON(buffer.B[:0])
+	if err != nil {
+		buffer.Release()
+		return nil, err
+	}
+	return buffer, nil
+}
+
+func (b *Buffer) Release() {
+	// Keep a burst of large flows from holding memory
+	if cap(b.B) > 64*1024 {
+		return
+	}
+	bufferPool.Put(b)
+}
+
+// AppendJSON appends the JSON encoding of the flow to b without reflection, fields are in the order of json.Marshal
+func (f *Flow) AppendJSON(b []byte) ([]byte, error) {
+	var err error
+	b = append(b, `{"timestamp":`...)
+	b = strconv.AppendInt(b, f.Timestamp, 10)
+	b = append(b, `,"type":`...)
+	b = appendString(b, f.Type)
+	b = append(b, `,"id":`...)
+	b = strconv.AppendUint(b, uint64(f.Id), 10)
+	b = append(b, `,"original":`...)
+	if b, err = f.Original.appendJSON(b); err != nil {
+		return b, err
+	}
+	b = append(b, `,"reply":`...)
+	if b, err = f.Reply.appendJSON(b); err != nil {
+		return b, err
+	}
+	b = append(b, `,"UNREPLIED":`...)
+	b = strconv.AppendBool(b, f.UNREPLIED)
+	b = append(b, `,"ASSURED":`...)
+	b = strconv.AppendBool(b, f.ASSURED)
+	b = append(b, `,"timeout":`...)
+	b = strconv.AppendInt(b, int64(f.Timeout), 10)
+	b = append(b, `,"state":`...)
+	b = appendString(b, f.State)
+	b = append(b, `,"mark":`...)
+	b = strconv.AppendUint(b, uint64(f.Mark), 10)
+	b = append(b, `,"zone":`...)
+	b = strconv.AppendInt(b, int64(f.Zone), 10)
+	b = append(b, `,"use":`...)
+	b = strconv.AppendInt(b, int64(f.Use), 10)
+	b = append(b, `,"secctx":`...)
+	b = appendString(b, f.Secctx)
+	b = append(b, `,"labels":`...)
+	if f.Labels == nil {
+		b = append(b, "null"...)
+	} else {
+		b = append(b, '[')
+		for i, label := range f.Labels {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = appendString(b, label)
+		}
+		b = append(b, ']')
+	}
+	if t := f.Transition; t != nil {
+		b = append(b, `,"transition":{"from":`...)
+		b = appendString(b, t.From)
+		b = append(b, `,"to":`...)
+		b = appendString(b, t.To)
+		b = append(b, `,"duration":`...)
+		b = strconv.AppendInt(b, t.Duration, 10)
+		b = append(b, '}')
+	}
+	if f.Count != 0 {
+		b = append(b, `,"count":`...)
+		b = strconv.AppendInt(b, int64(f.Count), 10)
+	}
+	if d := f.Delta; d != nil {
+		b = append(b, `,"delta":{"original":`...)
+		b = d.Original.appendJSON(b)
+		b = append(b, `,"reply":`...)
+		b = d.Reply.appendJSON(b)
+		b = append(b, '}')
+	}
+	if f.Deltatime != 0 {
+		b = append(b, `,"deltatime":`...)
+		b = strconv.AppendInt(b, f.Deltatime, 10)
+	}
+	if f.Netns != "" {
+		b = append(b, `,"netns":`...)
+		b = appendString(b, f.Netns)
+	}
+	return append(b, '}'), nil
+}
+
+func (m *Meta) appendJSON(b []byte) ([]byte, error) {
+	var err error
+	b = append(b, `{"layer3":{"protonum":`...)
+	b = strconv.AppendInt(b, int64(m.Layer3.Protonum), 10)
+	b = append(b, `,"protoname":`...)
+	b = appendString(b, m.Layer3.Protoname)
+	b = append(b, `,"src":`...)
+	if b, err = appendIP(b, m.Layer3.Src); err != nil {
+		return b, err
+	}
+	b = append(b, `,"dst":`...)
+	if b, err = appendIP(b, m.Layer3.Dst); err != nil {
+		return b, err
+	}
+	b = append(b, `},"layer4":{"protonum":`...)
+	b = strconv.AppendInt(b, int64(m.Layer4.Protonum), 10)
+	b = append(b, `,"protoname":`...)
+	b = appendString(b, m.Layer4.Protoname)
+	b = append(b, `,"sport":`...)
+	b = strconv.AppendInt(b, int64(m.Layer4.Sport), 10)
+	b = append(b, `,"dport":`...)
+	b = strconv.AppendInt(b, int64(m.Layer4.Dport), 10)
+	if icmp := m.Layer4.Icmp; icmp != nil {
+		b = append(b, `,"icmp":{"type":`...)
+		b = strconv.AppendInt(b, int64(icmp.Type), 10)
+		b = append(b, `,"code":`...)
+		b = strconv.AppendInt(b, int64(icmp.Code), 10)
+		b = append(b, `,"id":`...)
+		b = strconv.AppendInt(b, int64(icmp.Id), 10)
+		b = append(b, '}')
+	}
+	if gre := m.Layer4.Gre; gre != nil {
+		b = append(b, `,"gre":{"srckey":`...)
+		b = strconv.AppendUint(b, uint64(gre.SrcKey), 10)
+		b = append(b, `,"dstkey":`...)
+		b = strconv.AppendUint(b, uint64(gre.DstKey), 10)
+		b = append(b, '}')
+	}
+	b = append(b, `},"counter":`...)
+	b = m.Counter.appendJSON(b)
+	return append(b, '}'), nil
+}
+
+func (c *Counter) appendJSON(b []byte) []byte {
+	b = append(b, `{"packets":`...)
+	b = strconv.AppendUint(b, c.Packets, 10)
+	b = append(b, `,"bytes":`...)
+	b = strconv.AppendUint(b, c.Bytes, 10)
+	return append(b, '}')
+}
+
+// appendIP writes the address like net.IP.String, an empty address is an empty string like net.IP.MarshalText
+func appendIP(b []byte, ip net.IP) ([]byte, error) {
+	b = append(b, '"')
+	if ip4 := ip.To4(); ip4 != nil {
+		for i, octet := range ip4 {
+			if i > 0 {
+				b = append(b, '.')
+			}
+			b = strconv.AppendUint(b, uint64(octet), 10)
+		}
+		return append(b, '"'), nil
+	}
+	switch len(ip) {
+	case 0:
+		return append(b, '"'), nil
+	case net.IPv6len:
+	default:
+		return b, errInvalidIP
+	}
+
+	// The longest run of at least two zero groups is shortened to ::, the first one on a tie
+	start, end := -1, -1
+	for i := 0; i < net.IPv6len; i += 2 {
+		j := i
+		for j < net.IPv6len && ip[j] == 0 && ip[j+1] == 0 {
+			j += 2
+		}
+		if j > i && j-i > end-start {
+			start, end = i, j
+			i = j
+		}
+	}
+	if end-start <= 2 {
+		start, end = -1, -1
+	}
+	for i := 0; i < net.IPv6len; i += 2 {
+		if i == start {
+			b = append(b, ':', ':')
+			i = end
+			if i >= net.IPv6len {
+				break
+			}
+		} else if i > 0 {
+			b = append(b, ':')
+		}
+		b = strconv.AppendUint(b, uint64(ip[i])<<8|uint64(ip[i+1]), 16)
+	}
+	return append(b, '"'), nil
+}
+
+const lowerHex = "0123456789abcdef"
+
+// The escapes of the control characters and the replacement of the invalid bytes depend on the Go release,
+// they are taken from encoding/json
+var (
+	controlEscapes = func() (escapes [0x20]string) {
+		for c := range escapes {
+			escapes[c] = unquoted(string(rune(c)))
+		}
+		return escapes
+	}()
+	invalidUTF8 = unquoted("\xff")
+)
+
+func unquoted(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted[1 : len(quoted)-1])
+}
+
+// appendString quotes s like encoding/json with its default HTML escaping
+func appendString(b []byte, s string) []byte {
+	b = append(b, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+			b = append(b, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				b = append(b, '\\', c)
+			case '<', '>', '&':
+				b = append(b, '\\', 'u', '0', '0', lowerHex[c>>4], lowerHex[c&0xf])
+			default:
+				b = append(b, controlEscapes[c]...)
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, s[start:i]...)
+			b = append(b, invalidUTF8...)
+			i += size
+			start = i
+			continue
+		}
+		// Line and paragraph separators break JSONP
+		if r == '\u2028' || r == '\u2029' {
+			b = append(b, s[start:i]...)
+			b = append(b, '\\', 'u', '2', '0', '2', lowerHex[r&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	b = append(b, s[start:]...)
+	return append(b, '"')
+}
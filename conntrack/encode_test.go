@@ -0,0 +1,147 @@
+package conntrack
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+func TestEncodeFlow(t *testing.T) {
+	tests := []struct {
+		name string
+		flow Flow
+	}{
+		{"empty", Flow{}},
+		{"ipv4 4 bytes", Flow{
+			Type:     "NEW",
+			Original: Meta{Layer3: Layer3{Protonum: 2, Protoname: "ipv4", Src: net.IP{192, 168, 1, 10}, Dst: net.IP{1, 2, 3, 4}}},
+		}},
+		{"ipv4 16 bytes", Flow{
+			Original: Meta{Layer3: Layer3{Src: net.ParseIP("10.0.0.1"), Dst: net.IPv4(255, 255, 255, 255)}},
+			Reply:    Meta{Layer3: Layer3{Src: net.IPv4zero, Dst: net.ParseIP("0.0.0.1")}},
+		}},
+		{"ipv6", Flow{
+			Original: Meta{Layer3: Layer3{Protonum: 10, Protoname: "ipv6", Src: net.ParseIP("2001:db8::10"), Dst: net.ParseIP("2a00:1450:4007:80e::200e")}},
+			Reply:    Meta{Layer3: Layer3{Src: net.ParseIP("::1"), Dst: net.ParseIP("::")}},
+		}},
+		{"ipv6 zero runs", Flow{
+			// The longest run is compressed, the first one on a tie, never a single group
+			Original: Meta{Layer3: Layer3{Src: net.ParseIP("2001:0:0:1:0:0:0:1"), Dst: net.ParseIP("2001:db8:0:0:1:0:0:1")}},
+			Reply:    Meta{Layer3: Layer3{Src: net.ParseIP("2001:db8:0:1:1:1:1:1"), Dst: net.ParseIP("fe80::")}},
+		}},
+		{"ipv4 mapped ipv6", Flow{
+			Original: Meta{Layer3: Layer3{Src: net.ParseIP("::ffff:1.2.3.4"), Dst: net.ParseIP("::1.2.3.4")}},
+		}},
+		{"nil ips", Flow{
+			Original: Meta{Layer3: Layer3{Src: nil, Dst: net.IP{}}},
+		}},
+		{"icmp", Flow{
+			Original: Meta{Layer4: Layer4{Protonum: 1, Protoname: "icmp", Icmp: &Icmp{Type: 8, Code: 0, Id: 4455}}},
+			Reply:    Meta{Layer4: Layer4{Protonum: 1, Protoname: "icmp", Icmp: &Icmp{Type: 0, Code: 0, Id: 4455}}},
+		}},
+		{"gre", Flow{
+			Original: Meta{Layer4: Layer4{Protonum: 47, Protoname: "gre", Gre: &Gre{SrcKey: 0xffffffff, DstKey: 0}}},
+		}},
+		{"counters", Flow{
+			Original: Meta{Counter: Counter{Packets: 2100000, Bytes: 3000000000}},
+			Reply:    Meta{Counter: Counter{Packets: 1<<64 - 1, Bytes: 1<<64 - 1}},
+		}},
+		{"destroy", Flow{
+			Timestamp: 1508566186345, Type: "DESTROY", Id: 4294967295, ASSURED: true, UNREPLIED: true,
+			Timeout: 120, State: "TIME_WAIT", Mark: 4294967295, Zone: 3, Use: 1, Secctx: "system_u:object_r:unlabeled_t:s0",
+			Labels: []string{"0", "127"}, Deltatime: 3600, Netns: "guest",
+		}},
+		{"labels empty", Flow{Labels: []string{}}},
+		{"negative numbers", Flow{Timestamp: -1, Timeout: -1, Zone: -1, Deltatime: -1, Count: -1}},
+		{"transition", Flow{
+			Type:       "UPDATE",
+			Transition: &Transition{From: "SYN_SENT", To: "ESTABLISHED", Duration: 12},
+		}},
+		{"transition destroyed", Flow{Transition: &Transition{From: "ESTABLISHED"}}},
+		{"interim", Flow{
+			Type:  "INTERIM",
+			Count: 2,
+			Delta: &Delta{Original: Counter{Packets: 10, Bytes: 1000}, Reply: Counter{Packets: 1<<64 - 1}},
+		}},
+		{"control characters", Flow{State: "\x00\x01\x1f\x7f\t\n\r\b\f", Secctx: "\"quoted\" \\back\\slash"}},
+		{"html", Flow{Secctx: "<script>&amp;</script>", Netns: "a>b<c&d"}},
+		{"line separators", Flow{Secctx: "a\u2028b\u2029c", Labels: []string{"\u2028"}}},
+		{"unicode", Flow{Secctx: "é😀\u00a0\u2027\u202a\ufffd"}},
+		{"invalid utf-8", Flow{Secctx: "\xff", Netns: "a\xe2\x80b\xc3", Labels: []string{"\xed\xa0\x80", "ok"}}},
+	}
+	for _, test := range tests {
+		want, err := json.Marshal(test.flow)
+		if err != nil {
+			t.Fatalf("%s: json.Marshal: %s", test.name, err)
+		}
+		buffer, err := EncodeFlow(&test.flow)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !bytes.Equal(buffer.B, want) {
+			t.Errorf("%s:\n got %s\nwant %s", test.name, buffer.B, want)
+		}
+		buffer.Release()
+	}
+}
+
+func TestEncodeFlowInvalidIP(t *testing.T) {
+	flow := Flow{Original: Meta{Layer3: Layer3{Src: net.IP{1, 2}}}}
+	if _, err := json.Marshal(flow); err == nil {
+		t.Fatal("json.Marshal accepted a 2 bytes address")
+	}
+	if _, err := EncodeFlow(&flow); err == nil {
+		t.Error("EncodeFlow accepted a 2 bytes address")
+	}
+}
+
+func TestEncodeFlowParsed(t *testing.T) {
+	for _, line := range sampleLines {
+		flow, err := Parse([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := json.Marshal(flow)
+		got, err := flow.AppendJSON(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s:\n got %s\nwant %s", line, got, want)
+		}
+	}
+}
+
+func benchmarkFlows(b *testing.B) []Flow {
+	var flows []Flow
+	for _, line := range sampleLines {
+		flow, err := Parse([]byte(line))
+		if err != nil {
+			b.Fatal(err)
+		}
+		flows = append(flows, flow)
+	}
+	return flows
+}
+
+func BenchmarkEncodeJSON(b *testing.B) {
+	flows := benchmarkFlows(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		json.Marshal(flows[i%len(flows)])
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	flows := benchmarkFlows(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if buffer, err := EncodeFlow(&flows[i%len(flows)]); err == nil {
+			buffer.Release()
+		}
+	}
+}
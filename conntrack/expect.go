@@ -0,0 +1,343 @@
+package conntrack
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	log "gitlab.com/OpenWifiPortal/go-libs/logger"
+	"golang.org/x/sys/unix"
+)
+
+// Expectation netlink constants, see linux/netfilter/nfnetlink_conntrack.h
+const (
+	nfnlSubsysCtnetlinkExp = 2
+
+	nfnlgrpConntrackExpNew     = 4
+	nfnlgrpConntrackExpDestroy = 6
+
+	ipctnlMsgExpNew    = 0
+	ipctnlMsgExpDelete = 2
+
+	ctaExpectMaster   = 1
+	ctaExpectTuple    = 2
+	ctaExpectTimeout  = 4
+	ctaExpectId       = 5
+	ctaExpectHelpName = 6
+	ctaExpectZone     = 7
+)
+
+// Expectation is a connection a helper (ftp, sip, tftp...) expects on behalf of a master connection
+type Expectation struct {
+	Timestamp int64  `json:"timestamp"`
+	Type      string `json:"type"`
+	Id        uint32 `json:"id"`
+	Master    Meta   `json:"master"`
+	Expected  Meta   `json:"expected"`
+	Helper    string `json:"helper"`
+	Timeout   int    `json:"timeout"`
+	Zone      int    `json:"zone"`
+	Netns     string `json:"netns,omitempty"`
+}
+
+// ExpectationSource emits expectation NEW and DESTROY events
+type ExpectationSource interface {
+	Start(expectationChan chan<- Expectation, errChan chan<- error) error
+	Stop() error
+}
+
+// NewExpectationSource builds the expectation source matching the event source name
+func NewExpectationSource(name string, options SourceOptions) (ExpectationSource, error) {
+	// Expectations carry no NAT status nor mark
+	if options.NatOnly {
+		return nil, fmt.Errorf("conntrack: expectations can't be selected by NAT")
+	}
+	if options.Filter.Mark != "" {
+		return nil, fmt.Errorf("conntrack: expectations can't be filtered by mark")
+	}
+	filter, err := options.Filter.compile()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	source := &expectationSource{
+		options: options,
+		filter:  filter,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	switch name {
+	case "exec":
+		source.run = source.runConntrack
+	case "netlink":
+		source.run = source.runNetlink
+	default:
+		cancel()
+		return nil, fmt.Errorf("conntrack: source %q doesn't support expectations", name)
+	}
+	return source, nil
+}
+
+type expectationSource struct {
+	options SourceOptions
+	filter  *filter
+	run     func(ctx context.Context, expectationChan chan<- Expectation) error
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func (s *expectationSource) Start(expectationChan chan<- Expectation, errChan chan<- error) error {
+	go func() {
+		defer close(s.done)
+		newSupervisor("expectations", s.options).run(s.ctx, errChan, func(ctx context.Context) error {
+			return s.run(ctx, expectationChan)
+		})
+	}()
+	return nil
+}
+
+func (s *expectationSource) Stop() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+func (s *expectationSource) runConntrack(ctx context.Context, expectationChan chan<- Expectation) error {
+	cmd := exec.CommandContext(ctx, "conntrack", "-E", "expect", "-e", "NEW,DESTROY")
+	stderrPipe, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("error conntrack expect: %s", err)
+	}
+	stdoutPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("error conntrack expect: %s", err)
+	}
+	log.Infoln("starting conntrack expect...")
+	if err := inNetns(s.options.Netns, cmd.Start); err != nil {
+		return fmt.Errorf("error conntrack expect start: %s", err)
+	}
+
+	var lastStderr string
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		stderr := bufio.NewScanner(stderrPipe)
+		for stderr.Scan() {
+			lastStderr = stderr.Text()
+			log.Warnln(lastStderr)
+		}
+	}()
+
+	stdout := bufio.NewScanner(stdoutPipe)
+	for stdout.Scan() {
+		expectation, err := expectationParse(stdout.Text())
+		if err != nil {
+			log.Errorln(err)
+			continue
+		}
+		if !s.match(&expectation) {
+			continue
+		}
+		expectation.Netns = s.options.Netns
+		select {
+		case expectationChan <- expectation:
+		case <-ctx.Done():
+			// The process is killed with the context
+			<-stderrDone
+			cmd.Wait()
+			return nil
+		}
+	}
+	<-stderrDone
+	waitErr := cmd.Wait()
+	if ctx.Err() != nil {
+		return nil
+	}
+	return fmt.Errorf("conntrack expect exited: %v: %s", waitErr, lastStderr)
+}
+
+// match applies the filter to the master connection of the expectation
+func (s *expectationSource) match(expectation *Expectation) bool {
+	return s.filter.match(&Flow{Original: expectation.Master, Zone: expectation.Zone})
+}
+
+// expectationParse reads a conntrack -E expect line, the timestamp is optional
+func expectationParse(line string) (Expectation, error) {
+	expectation := Expectation{
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	// The timestamp may be padded: "[1508566165.785132 ]"
+	for strings.Contains(line, " ]") {
+		line = strings.Replace(line, " ]", "]", -1)
+	}
+
+	var meta *Meta
+	protonum := 0
+	afterType := false
+	for _, field := range strings.Fields(line) {
+		if strings.HasPrefix(field, "[") && strings.HasSuffix(field, "]") {
+			value := strings.Trim(field, "[]")
+			if timestamp, err := strconv.ParseFloat(value, 64); err == nil {
+				expectation.Timestamp = int64(timestamp * 1000)
+			} else if expectation.Type == "" {
+				expectation.Type = value
+				afterType = true
+			}
+			continue
+		}
+		if afterType {
+			afterType = false
+			if timeout, err := strconv.Atoi(field); err == nil {
+				expectation.Timeout = timeout
+				continue
+			}
+		}
+		i := strings.IndexByte(field, '=')
+		if i < 1 {
+			continue
+		}
+		key, value := field[:i], field[i+1:]
+		switch key {
+		case "proto":
+			protonum, _ = strconv.Atoi(value)
+		case "src":
+			meta = &expectation.Expected
+			meta.Layer3.Src = net.ParseIP(value)
+		case "master-src":
+			meta = &expectation.Master
+			meta.Layer3.Src = net.ParseIP(value)
+		case "mask-src":
+			meta = nil
+		case "dst", "master-dst":
+			if meta != nil {
+				meta.Layer3.Dst = net.ParseIP(value)
+			}
+		case "sport":
+			if meta != nil {
+				meta.Layer4.Sport, _ = strconv.Atoi(value)
+			}
+		case "dport":
+			if meta != nil {
+				meta.Layer4.Dport, _ = strconv.Atoi(value)
+			}
+		case "helper":
+			expectation.Helper = value
+		case "zone":
+			expectation.Zone, _ = strconv.Atoi(value)
+		case "id":
+			id, _ := strconv.ParseUint(value, 10, 32)
+			expectation.Id = uint32(id)
+		}
+	}
+	if expectation.Type == "" || expectation.Expected.Layer3.Src == nil {
+		return expectation, fmt.Errorf("expectation parse error of: %s", line)
+	}
+	for _, meta := range []*Meta{&expectation.Master, &expectation.Expected} {
+		if meta.Layer3.Src.To4() != nil {
+			meta.Layer3.Protonum = unix.AF_INET
+			meta.Layer3.Protoname = "ipv4"
+		} else {
+			meta.Layer3.Protonum = unix.AF_INET6
+			meta.Layer3.Protoname = "ipv6"
+		}
+		meta.Layer4.Protonum = protonum
+		if name, ok := layer4Protonames[protonum]; ok {
+			meta.Layer4.Protoname = name
+		} else {
+			meta.Layer4.Protoname = "unknown"
+		}
+	}
+	return expectation, nil
+}
+
+func (s *expectationSource) runNetlink(ctx context.Context, expectationChan chan<- Expectation) error {
+	conn, err := dialNetlink(s.options.Netns, 1<<(nfnlgrpConntrackExpNew-1)|1<<(nfnlgrpConntrackExpDestroy-1))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.Infoln("starting netlink expect...")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		messages, err := conn.Receive()
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err == unix.ENOBUFS {
+			log.Warnln("netlink expect: receive buffer overflow, expectations lost")
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("netlink expect receive: %s", err)
+		}
+		for _, message := range messages {
+			expectation, ok := netlinkParseExpectation(message)
+			if !ok || !s.match(&expectation) {
+				continue
+			}
+			expectation.Netns = s.options.Netns
+			select {
+			case expectationChan <- expectation:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+func netlinkParseExpectation(message netlinkMessage) (Expectation, bool) {
+	var expectation = Expectation{}
+	if message.Type>>8 != nfnlSubsysCtnetlinkExp || len(message.Data) < nfgenmsgLen {
+		return expectation, false
+	}
+	switch message.Type & 0xff {
+	case ipctnlMsgExpNew:
+		expectation.Type = "NEW"
+	case ipctnlMsgExpDelete:
+		expectation.Type = "DESTROY"
+	default:
+		return expectation, false
+	}
+	expectation.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+
+	family := int(message.Data[0])
+	layer3 := Layer3{Protonum: family, Protoname: "unknown"}
+	switch family {
+	case unix.AF_INET:
+		layer3.Protoname = "ipv4"
+	case unix.AF_INET6:
+		layer3.Protoname = "ipv6"
+	}
+	expectation.Master.Layer3 = layer3
+	expectation.Expected.Layer3 = layer3
+
+	for _, attribute := range parseNetlinkAttributes(message.Data[nfgenmsgLen:]) {
+		switch attribute.Type {
+		case ctaExpectMaster:
+			netlinkParseTuple(attribute.Data, &expectation.Master)
+		case ctaExpectTuple:
+			netlinkParseTuple(attribute.Data, &expectation.Expected)
+		case ctaExpectTimeout:
+			expectation.Timeout = int(attribute.Uint32())
+		case ctaExpectId:
+			expectation.Id = attribute.Uint32()
+		case ctaExpectHelpName:
+			expectation.Helper = attribute.String()
+		case ctaExpectZone:
+			expectation.Zone = int(attribute.Uint16())
+		}
+	}
+	return expectation, true
+}
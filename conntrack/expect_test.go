@@ -0,0 +1,139 @@
+package conntrack
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestExpectationParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		line  string
+		check func(expectation Expectation) bool
+	}{
+		{
+			name: "ftp",
+			line: "[1508566165.785132 ]\t    [NEW] 300 proto=6 src=192.168.1.2 dst=192.168.1.3 sport=0 dport=41739 mask-src=255.255.255.255 mask-dst=255.255.255.255 sport=0 dport=65535 master-src=192.168.1.2 master-dst=192.168.1.3 sport=36390 dport=21 class=0 helper=ftp",
+			check: func(expectation Expectation) bool {
+				return expectation.Timestamp == 1508566165785 && expectation.Type == "NEW" && expectation.Timeout == 300 &&
+					expectation.Helper == "ftp" && expectation.Expected.Layer3.Src.Equal(net.IP{192, 168, 1, 2}) &&
+					expectation.Expected.Layer4.Protoname == "tcp" && expectation.Expected.Layer4.Sport == 0 && expectation.Expected.Layer4.Dport == 41739 &&
+					expectation.Master.Layer3.Dst.Equal(net.IP{192, 168, 1, 3}) && expectation.Master.Layer3.Protoname == "ipv4" &&
+					expectation.Master.Layer4.Sport == 36390 && expectation.Master.Layer4.Dport == 21
+			},
+		},
+		{
+			name: "sip permanent",
+			line: "    [NEW] 180 proto=17 src=10.0.0.2 dst=10.0.0.1 sport=0 dport=16384 mask-src=255.255.255.255 mask-dst=255.255.255.255 sport=0 dport=65535 master-src=10.0.0.1 master-dst=10.0.0.2 sport=5060 dport=5060 PERMANENT class=1 helper=sip zone=2",
+			check: func(expectation Expectation) bool {
+				return expectation.Type == "NEW" && expectation.Timeout == 180 && expectation.Helper == "sip" && expectation.Zone == 2 &&
+					expectation.Expected.Layer4.Protoname == "udp" && expectation.Expected.Layer4.Dport == 16384 &&
+					expectation.Master.Layer4.Protoname == "udp" && expectation.Master.Layer4.Sport == 5060
+			},
+		},
+		{
+			name: "ipv6 ftp destroy",
+			line: "[1508566186.345123]\t[DESTROY] proto=6 src=2001:db8::2 dst=2001:db8::3 sport=0 dport=41739 mask-src=ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff mask-dst=ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff sport=0 dport=65535 master-src=2001:db8::2 master-dst=2001:db8::3 sport=36390 dport=21 class=0 helper=ftp",
+			check: func(expectation Expectation) bool {
+				return expectation.Type == "DESTROY" && expectation.Timeout == 0 && expectation.Helper == "ftp" &&
+					expectation.Expected.Layer3.Protoname == "ipv6" && expectation.Expected.Layer3.Dst.Equal(net.ParseIP("2001:db8::3")) &&
+					expectation.Master.Layer3.Src.Equal(net.ParseIP("2001:db8::2")) && expectation.Master.Layer4.Dport == 21
+			},
+		},
+	}
+	for _, test := range tests {
+		expectation, err := expectationParse(test.line)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !test.check(expectation) {
+			t.Errorf("%s: got %+v", test.name, expectation)
+		}
+	}
+
+	if _, err := expectationParse("conntrack v1.4.6 (conntrack-tools): 2 expectation events have been shown."); err == nil {
+		t.Error("got no error on the conntrack summary")
+	}
+}
+
+// expMessage builds a ctnetlink expectation message
+func expMessage(msgType uint16, family uint8, attributes ...[]byte) []byte {
+	b := ctMessage(0, 0, family, attributes...)
+	nativeEndian.PutUint16(b[4:6], nfnlSubsysCtnetlinkExp<<8|msgType)
+	return b
+}
+
+func TestNetlinkParseExpectation(t *testing.T) {
+	message := expMessage(ipctnlMsgExpNew, unix.AF_INET,
+		ctTuple(ctaExpectMaster, "192.168.1.2", "192.168.1.3", ctPorts(unix.IPPROTO_TCP, 36390, 21)),
+		ctTuple(ctaExpectTuple, "192.168.1.2", "192.168.1.3", ctPorts(unix.IPPROTO_TCP, 0, 41739)),
+		nla(ctaExpectTimeout, be32(300)), nla(ctaExpectId, be32(42)), nla(ctaExpectHelpName, []byte("ftp\x00")), nla(ctaExpectZone, be16(2)))
+	messages, err := parseNetlinkMessages(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectation, ok := netlinkParseExpectation(messages[0])
+	if !ok {
+		t.Fatal("message not parsed")
+	}
+	// The same expectation printed by conntrack
+	want, err := expectationParse("[1508566165.785132]\t    [NEW] 300 proto=6 src=192.168.1.2 dst=192.168.1.3 sport=0 dport=41739 mask-src=255.255.255.255 mask-dst=255.255.255.255 sport=0 dport=65535 master-src=192.168.1.2 master-dst=192.168.1.3 sport=36390 dport=21 class=0 helper=ftp zone=2 id=42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectation.Timestamp = want.Timestamp
+	for _, meta := range []*Meta{&expectation.Master, &expectation.Expected, &want.Master, &want.Expected} {
+		meta.Layer3.Src, meta.Layer3.Dst = meta.Layer3.Src.To16(), meta.Layer3.Dst.To16()
+	}
+	if !reflect.DeepEqual(expectation, want) {
+		t.Errorf("got %+v, want %+v", expectation, want)
+	}
+
+	// Conntrack messages aren't expectations
+	messages, err = parseNetlinkMessages(ctMessage(ipctnlMsgCtNew, 0, unix.AF_INET))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := netlinkParseExpectation(messages[0]); ok {
+		t.Error("got a conntrack message parsed as an expectation")
+	}
+}
+
+func TestExpectationFilter(t *testing.T) {
+	ftp, err := expectationParse("    [NEW] 300 proto=6 src=192.168.1.2 dst=192.168.1.3 sport=0 dport=41739 master-src=192.168.1.2 master-dst=192.168.1.3 sport=36390 dport=21 helper=ftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		filter Filter
+		match  bool
+	}{
+		{Filter{}, true},
+		{Filter{Protocol: "tcp", OrigDst: []string{"192.168.1.0/24"}}, true},
+		{Filter{Protocol: "udp"}, false},
+		{Filter{Family: "ipv6"}, false},
+		{Filter{Zone: "1"}, false},
+	}
+	for _, test := range tests {
+		source, err := NewExpectationSource("netlink", SourceOptions{Filter: test.filter})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match := source.(*expectationSource).match(&ftp); match != test.match {
+			t.Errorf("%+v: got %v, want %v", test.filter, match, test.match)
+		}
+	}
+
+	for _, options := range []SourceOptions{{NatOnly: true}, {Filter: Filter{Mark: "1"}}} {
+		if _, err := NewExpectationSource("exec", options); err == nil {
+			t.Errorf("%+v: got no error", options)
+		}
+	}
+	if _, err := NewExpectationSource("proc", SourceOptions{}); err == nil {
+		t.Error("got no error for a source without expectations")
+	}
+}
@@ -0,0 +1,464 @@
+package conntrack
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// Filter selects the connections to collect, sources apply it in the kernel when they can
+type Filter struct {
+	// Family is ipv4 or ipv6, empty for both
+	Family string
+	// Protocol is a layer 4 protocol name or number, empty for every protocol
+	Protocol string
+	// Zone is a conntrack zone, empty for every zone
+	Zone string
+	// Mark is mark[/mask], empty for every mark
+	Mark string
+	// OrigSrc and OrigDst are CIDRs matching the original direction addresses, empty for every address
+	OrigSrc []string
+	OrigDst []string
+}
+
+// filter is a validated Filter, -1 and nil values match everything
+type filter struct {
+	family   int
+	protocol int
+	zone     int
+	mark     uint32
+	markMask uint32
+	origSrc  []*net.IPNet
+	origDst  []*net.IPNet
+}
+
+var eventTypes = map[string]bool{
+	"NEW":     true,
+	"UPDATE":  true,
+	"DESTROY": true,
+}
+
+// checkEventTypes validates the event types given to a source
+func checkEventTypes(eventType []string) error {
+	for _, event := range eventType {
+		if !eventTypes[event] {
+			return fmt.Errorf("conntrack: unknown event type %q", event)
+		}
+	}
+	return nil
+}
+
+func (f Filter) compile() (*filter, error) {
+	compiled := &filter{family: -1, protocol: -1, zone: -1}
+
+	switch f.Family {
+	case "":
+	case "ipv4":
+		compiled.family = unix.AF_INET
+	case "ipv6":
+		compiled.family = unix.AF_INET6
+	default:
+		return nil, fmt.Errorf("filter: unknown family %q", f.Family)
+	}
+
+	if f.Protocol != "" {
+		for protonum, protoname := range layer4Protonames {
+			if protoname == f.Protocol {
+				compiled.protocol = protonum
+			}
+		}
+		if compiled.protocol == -1 {
+			protonum, err := strconv.ParseUint(f.Protocol, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("filter: unknown protocol %q", f.Protocol)
+			}
+			compiled.protocol = int(protonum)
+		}
+	}
+
+	if f.Zone != "" {
+		zone, err := strconv.ParseUint(f.Zone, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("filter: invalid zone %q", f.Zone)
+		}
+		compiled.zone = int(zone)
+	}
+
+	if f.Mark != "" {
+		parts := strings.SplitN(f.Mark, "/", 2)
+		mark, err := strconv.ParseUint(parts[0], 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("filter: invalid mark %q", f.Mark)
+		}
+		mask := uint64(0xffffffff)
+		if len(parts) == 2 {
+			if mask, err = strconv.ParseUint(parts[1], 0, 32); err != nil {
+				return nil, fmt.Errorf("filter: invalid mark mask %q", f.Mark)
+			}
+		}
+		compiled.mark = uint32(mark & mask)
+		compiled.markMask = uint32(mask)
+	}
+
+	var err error
+	if compiled.origSrc, err = compiled.parseCIDRs(f.OrigSrc); err != nil {
+		return nil, err
+	}
+	if compiled.origDst, err = compiled.parseCIDRs(f.OrigDst); err != nil {
+		return nil, err
+	}
+	return compiled, nil
+}
+
+// parseCIDRs parses networks of the filter family, an address without prefix is a host
+func (f *filter) parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("filter: %s", err)
+		}
+		if f.family == unix.AF_INET && network.IP.To4() == nil || f.family == unix.AF_INET6 && network.IP.To4() != nil {
+			return nil, fmt.Errorf("filter: %s doesn't match the family", network)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// match checks a flow in userspace, for the sources or kernels unable to filter
+func (f *filter) match(flow *Flow) bool {
+	if f.family != -1 && flow.Original.Layer3.Protonum != f.family {
+		return false
+	}
+	if f.protocol != -1 && flow.Original.Layer4.Protonum != f.protocol {
+		return false
+	}
+	if f.zone != -1 && flow.Zone != f.zone {
+		return false
+	}
+	if flow.Mark&f.markMask != f.mark {
+		return false
+	}
+	return matchNetworks(f.origSrc, flow.Original.Layer3.Src) && matchNetworks(f.origDst, flow.Original.Layer3.Dst)
+}
+
+func matchNetworks(networks []*net.IPNet, ip net.IP) bool {
+	if len(networks) == 0 {
+		return true
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// args converts the filter to conntrack options
+func (f *filter) args() ([]string, error) {
+	var args []string
+	switch f.family {
+	case unix.AF_INET:
+		args = append(args, "-f", "ipv4")
+	case unix.AF_INET6:
+		args = append(args, "-f", "ipv6")
+	}
+	if f.protocol != -1 {
+		if protoname, ok := layer4Protonames[f.protocol]; ok {
+			args = append(args, "-p", protoname)
+		} else {
+			args = append(args, "-p", strconv.Itoa(f.protocol))
+		}
+	}
+	if f.zone != -1 {
+		args = append(args, "-w", strconv.Itoa(f.zone))
+	}
+	if f.markMask == 0xffffffff {
+		args = append(args, "-m", strconv.FormatUint(uint64(f.mark), 10))
+	} else if f.markMask != 0 {
+		args = append(args, "-m", fmt.Sprintf("%d/%d", f.mark, f.markMask))
+	}
+	// conntrack accepts a single address per direction
+	if len(f.origSrc) > 1 || len(f.origDst) > 1 {
+		return nil, fmt.Errorf("filter: conntrack accepts a single source and destination network")
+	}
+	for _, network := range f.origSrc {
+		args = append(args, "-s", networkArg(network))
+	}
+	for _, network := range f.origDst {
+		args = append(args, "-d", networkArg(network))
+	}
+	return args, nil
+}
+
+// networkArg writes a host without prefix, which conntrack accepts before CIDRs
+func networkArg(network *net.IPNet) string {
+	if isHost(network) {
+		return network.IP.String()
+	}
+	return network.String()
+}
+
+func isHost(network *net.IPNet) bool {
+	ones, bits := network.Mask.Size()
+	return ones == bits
+}
+
+// filterMinConntrack is the first conntrack filtering the events by zone and by network
+const filterMinConntrack = "1.4.6"
+
+// checkConntrack rejects the filters the installed conntrack can't apply to the events,
+// version is only called when the filter needs a recent conntrack
+func (f *filter) checkConntrack(version func() (string, error)) error {
+	var needs string
+	if f.zone != -1 {
+		needs = "zone"
+	}
+	for _, networks := range [][]*net.IPNet{f.origSrc, f.origDst} {
+		for _, network := range networks {
+			if !isHost(network) {
+				needs = "network"
+			}
+		}
+	}
+	if needs == "" {
+		return nil
+	}
+	installed, err := version()
+	if err != nil {
+		return fmt.Errorf("filter: %s", err)
+	}
+	if versionBefore(installed, filterMinConntrack) {
+		return fmt.Errorf("filter: conntrack %s can't filter the events by %s, %s is needed", installed, needs, filterMinConntrack)
+	}
+	return nil
+}
+
+// versionBefore compares dotted versions like 1.4.10, a suffix of a part is ignored
+func versionBefore(version, other string) bool {
+	parts, otherParts := strings.Split(version, "."), strings.Split(other, ".")
+	for i := 0; i < len(parts) || i < len(otherParts); i++ {
+		var a, b int
+		if i < len(parts) {
+			a = leadingInt(parts[i])
+		}
+		if i < len(otherParts) {
+			b = leadingInt(otherParts[i])
+		}
+		if a != b {
+			return a < b
+		}
+	}
+	return false
+}
+
+func leadingInt(s string) int {
+	n := 0
+	for i := 0; i < len(s) && s[i] >= '0' && s[i] <= '9'; i++ {
+		n = n*10 + int(s[i]-'0')
+	}
+	return n
+}
+
+// bpfProgram assembles a socket filter with forward jumps to labels
+type bpfProgram struct {
+	instructions []bpf.Instruction
+	labels       map[string]int
+	jumps        map[int][2]string
+	nextLabel    int
+}
+
+func (p *bpfProgram) add(instructions ...bpf.Instruction) {
+	p.instructions = append(p.instructions, instructions...)
+}
+
+// jumpIf branches to the labels, an empty label continues with the next instruction
+func (p *bpfProgram) jumpIf(cond bpf.JumpTest, val uint32, ifTrue, ifFalse string) {
+	p.jumps[len(p.instructions)] = [2]string{ifTrue, ifFalse}
+	p.add(bpf.JumpIf{Cond: cond, Val: val})
+}
+
+// jump branches unconditionally to the label
+func (p *bpfProgram) jump(label string) {
+	p.jumps[len(p.instructions)] = [2]string{label}
+	p.add(bpf.Jump{})
+}
+
+func (p *bpfProgram) newLabel() string {
+	p.nextLabel++
+	return strconv.Itoa(p.nextLabel)
+}
+
+func (p *bpfProgram) label(name string) {
+	p.labels[name] = len(p.instructions)
+}
+
+// findAttribute loads in A the offset of the attribute at path, 0 when it is missing
+func (p *bpfProgram) findAttribute(path ...uint32) {
+	p.add(bpf.LoadConstant{Dst: bpf.RegA, Val: nlmsgHeaderLen + nfgenmsgLen})
+	missing := p.newLabel()
+	for i, attribute := range path {
+		p.add(bpf.LoadConstant{Dst: bpf.RegX, Val: attribute})
+		if i == 0 {
+			p.add(bpf.LoadExtension{Num: bpf.ExtNetlinkAttr})
+		} else {
+			p.add(bpf.LoadExtension{Num: bpf.ExtNetlinkAttrNested})
+		}
+		if i < len(path)-1 {
+			p.jumpIf(bpf.JumpEqual, 0, missing, "")
+		}
+	}
+	p.label(missing)
+}
+
+func (p *bpfProgram) assemble() ([]bpf.RawInstruction, error) {
+	for i, labels := range p.jumps {
+		var skips [2]int
+		for j, label := range labels {
+			if label == "" {
+				continue
+			}
+			target, ok := p.labels[label]
+			if !ok {
+				return nil, fmt.Errorf("bpf: undefined label %s", label)
+			}
+			skips[j] = target - i - 1
+			if skips[j] < 0 || skips[j] > 255 {
+				return nil, fmt.Errorf("bpf: jump to %s out of range", label)
+			}
+		}
+		switch jump := p.instructions[i].(type) {
+		case bpf.Jump:
+			jump.Skip = uint32(skips[0])
+			p.instructions[i] = jump
+		case bpf.JumpIf:
+			jump.SkipTrue, jump.SkipFalse = uint8(skips[0]), uint8(skips[1])
+			p.instructions[i] = jump
+		}
+	}
+	return bpf.Assemble(p.instructions)
+}
+
+// program builds a socket filter dropping the ctnetlink events the filter rejects
+func (f *filter) program(natOnly bool) ([]bpf.RawInstruction, error) {
+	p := &bpfProgram{labels: make(map[string]int), jumps: make(map[int][2]string)}
+	reject := "reject"
+
+	if f.family != -1 {
+		p.add(bpf.LoadAbsolute{Off: nlmsgHeaderLen, Size: 1})
+		p.jumpIf(bpf.JumpEqual, uint32(f.family), "", reject)
+	}
+
+	if natOnly {
+		p.findAttribute(ctaStatus)
+		p.jumpIf(bpf.JumpEqual, 0, reject, "")
+		p.add(bpf.TAX{}, bpf.LoadIndirect{Off: nlaHeaderLen, Size: 4})
+		p.jumpIf(bpf.JumpBitsSet, ipsSrcNat|ipsDstNat, "", reject)
+	}
+
+	if f.protocol != -1 {
+		p.findAttribute(ctaTupleOrig, ctaTupleProto, ctaProtoNum)
+		p.jumpIf(bpf.JumpEqual, 0, reject, "")
+		p.add(bpf.TAX{}, bpf.LoadIndirect{Off: nlaHeaderLen, Size: 1})
+		p.jumpIf(bpf.JumpEqual, uint32(f.protocol), "", reject)
+	}
+
+	// The zone and the mark are omitted when they are 0
+	if f.zone != -1 {
+		missing, matched := p.newLabel(), p.newLabel()
+		p.findAttribute(ctaZone)
+		p.jumpIf(bpf.JumpEqual, 0, missing, "")
+		p.add(bpf.TAX{}, bpf.LoadIndirect{Off: nlaHeaderLen, Size: 2})
+		p.jumpIf(bpf.JumpEqual, uint32(f.zone), matched, reject)
+		p.label(missing)
+		if f.zone != 0 {
+			p.jump(reject)
+		}
+		p.label(matched)
+	}
+
+	if f.markMask != 0 {
+		missing, matched := p.newLabel(), p.newLabel()
+		p.findAttribute(ctaMark)
+		p.jumpIf(bpf.JumpEqual, 0, missing, "")
+		p.add(bpf.TAX{}, bpf.LoadIndirect{Off: nlaHeaderLen, Size: 4})
+		p.add(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: f.markMask})
+		p.jumpIf(bpf.JumpEqual, f.mark, matched, reject)
+		p.label(missing)
+		if f.mark != 0 {
+			p.jump(reject)
+		}
+		p.label(matched)
+	}
+
+	p.matchNetworks(f.origSrc, ctaIpV4Src, ctaIpV6Src, reject)
+	p.matchNetworks(f.origDst, ctaIpV4Dst, ctaIpV6Dst, reject)
+
+	p.add(bpf.RetConstant{Val: 0xffffffff})
+	p.label(reject)
+	p.add(bpf.RetConstant{Val: 0})
+	return p.assemble()
+}
+
+// matchNetworks continues when the original address attribute is in one of the networks
+func (p *bpfProgram) matchNetworks(networks []*net.IPNet, v4Attribute, v6Attribute uint32, reject string) {
+	if len(networks) == 0 {
+		return
+	}
+	matched := p.newLabel()
+	for _, network := range networks {
+		next := p.newLabel()
+		ip, mask := network.IP.To4(), net.IP(network.Mask).To4()
+		attribute := v4Attribute
+		if ip == nil || len(network.Mask) != net.IPv4len {
+			ip, mask = network.IP.To16(), net.IP(network.Mask).To16()
+			attribute = v6Attribute
+		}
+		p.findAttribute(ctaTupleOrig, ctaTupleIp, attribute)
+		p.jumpIf(bpf.JumpEqual, 0, next, "")
+		p.add(bpf.TAX{})
+		for i := 0; i < len(ip); i += 4 {
+			wordMask := uint32(mask[i])<<24 | uint32(mask[i+1])<<16 | uint32(mask[i+2])<<8 | uint32(mask[i+3])
+			if wordMask == 0 {
+				continue
+			}
+			word := uint32(ip[i])<<24 | uint32(ip[i+1])<<16 | uint32(ip[i+2])<<8 | uint32(ip[i+3])
+			p.add(bpf.LoadIndirect{Off: nlaHeaderLen + uint32(i), Size: 4})
+			if wordMask != 0xffffffff {
+				p.add(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: wordMask})
+			}
+			p.jumpIf(bpf.JumpEqual, word&wordMask, "", next)
+		}
+		p.jump(matched)
+		p.label(next)
+	}
+	p.jump(reject)
+	p.label(matched)
+}
+
+// attachFilter attaches the socket filter of the ctnetlink events to the connection
+func (c *netlinkConn) attachFilter(program []bpf.RawInstruction) error {
+	filter := make([]syscall.SockFilter, len(program))
+	for i, instruction := range program {
+		filter[i] = syscall.SockFilter{
+			Code: instruction.Op,
+			Jt:   instruction.Jt,
+			Jf:   instruction.Jf,
+			K:    instruction.K,
+		}
+	}
+	return syscall.AttachLsf(c.fd, filter)
+}
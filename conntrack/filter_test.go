@@ -0,0 +1,324 @@
+package conntrack
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// runFilter runs a socket filter on a netlink message like the kernel, bpf.NewVM only implements
+// the length extension and not the netlink attribute lookups the filters rely on
+func runFilter(program []bpf.RawInstruction, packet []byte) (uint32, error) {
+	instructions, ok := bpf.Disassemble(program)
+	if !ok {
+		return 0, errors.New("unknown instruction")
+	}
+	var a, x uint32
+	for pc := 0; pc < len(instructions); pc++ {
+		switch ins := instructions[pc].(type) {
+		case bpf.LoadConstant:
+			if ins.Dst == bpf.RegA {
+				a = ins.Val
+			} else {
+				x = ins.Val
+			}
+		case bpf.LoadAbsolute:
+			value, ok := loadPacket(packet, ins.Off, ins.Size)
+			if !ok {
+				return 0, nil
+			}
+			a = value
+		case bpf.LoadIndirect:
+			value, ok := loadPacket(packet, x+ins.Off, ins.Size)
+			if !ok {
+				return 0, nil
+			}
+			a = value
+		case bpf.LoadExtension:
+			switch ins.Num {
+			case bpf.ExtNetlinkAttr:
+				a = findAttribute(packet, a, len(packet), x)
+			case bpf.ExtNetlinkAttrNested:
+				a = findNestedAttribute(packet, a, x)
+			default:
+				return 0, fmt.Errorf("extension %d not implemented", ins.Num)
+			}
+		case bpf.TAX:
+			x = a
+		case bpf.TXA:
+			a = x
+		case bpf.ALUOpConstant:
+			if ins.Op != bpf.ALUOpAnd {
+				return 0, fmt.Errorf("alu operation %d not implemented", ins.Op)
+			}
+			a &= ins.Val
+		case bpf.Jump:
+			pc += int(ins.Skip)
+		case bpf.JumpIf:
+			var taken bool
+			switch ins.Cond {
+			case bpf.JumpEqual:
+				taken = a == ins.Val
+			case bpf.JumpNotEqual:
+				taken = a != ins.Val
+			case bpf.JumpBitsSet:
+				taken = a&ins.Val != 0
+			case bpf.JumpBitsNotSet:
+				taken = a&ins.Val == 0
+			default:
+				return 0, fmt.Errorf("jump condition %d not implemented", ins.Cond)
+			}
+			if taken {
+				pc += int(ins.SkipTrue)
+			} else {
+				pc += int(ins.SkipFalse)
+			}
+		case bpf.RetConstant:
+			return ins.Val, nil
+		default:
+			return 0, fmt.Errorf("instruction %#v not implemented", ins)
+		}
+	}
+	return 0, errors.New("no return")
+}
+
+// loadPacket loads in network order, out of bounds loads drop the packet
+func loadPacket(packet []byte, offset uint32, size int) (uint32, bool) {
+	if int(offset)+size > len(packet) {
+		return 0, false
+	}
+	var value uint32
+	for _, b := range packet[offset : int(offset)+size] {
+		value = value<<8 | uint32(b)
+	}
+	return value, true
+}
+
+// findAttribute is nla_find on the attributes from offset to end, it returns the offset of the attribute or 0
+func findAttribute(packet []byte, offset uint32, end int, attributeType uint32) uint32 {
+	if int(offset) > len(packet)-nlaHeaderLen {
+		return 0
+	}
+	for pos := int(offset); end-pos >= nlaHeaderLen; {
+		length := int(nativeEndian.Uint16(packet[pos:]))
+		if length < nlaHeaderLen || length > end-pos {
+			return 0
+		}
+		if uint32(nativeEndian.Uint16(packet[pos+2:])&nlaTypeMask) == attributeType {
+			return uint32(pos)
+		}
+		pos += netlinkAlign(length)
+	}
+	return 0
+}
+
+// findNestedAttribute is nla_find_nested on the attribute at offset
+func findNestedAttribute(packet []byte, offset uint32, attributeType uint32) uint32 {
+	if int(offset) > len(packet)-nlaHeaderLen {
+		return 0
+	}
+	length := int(nativeEndian.Uint16(packet[offset:]))
+	if length > len(packet)-int(offset) {
+		return 0
+	}
+	return findAttribute(packet, offset+nlaHeaderLen, int(offset)+length, attributeType)
+}
+
+// filterMessages are ctnetlink events of both families, with and without NAT, zone and mark
+func filterMessages() map[string][]byte {
+	return map[string][]byte{
+		"ipv4 tcp snat zone mark": ctMessage(ipctnlMsgCtNew, unix.NLM_F_CREATE|unix.NLM_F_EXCL, unix.AF_INET,
+			ctTuple(ctaTupleOrig, "192.168.1.10", "1.2.3.4", ctPorts(unix.IPPROTO_TCP, 42216, 80)),
+			ctTuple(ctaTupleReply, "1.2.3.4", "203.0.113.5", ctPorts(unix.IPPROTO_TCP, 80, 42216)),
+			nla(ctaStatus, be32(ipsSrcNat)),
+			nla(ctaTimeout, be32(120)),
+			nla(ctaMark, be32(0x123)),
+			ctTcpState(1),
+			nla(ctaId, be32(1)),
+			nla(ctaZone, be16(3)),
+		),
+		"ipv4 udp destroy": ctMessage(ipctnlMsgCtDelete, 0, unix.AF_INET,
+			ctTuple(ctaTupleOrig, "10.0.0.1", "8.8.8.8", ctPorts(unix.IPPROTO_UDP, 5353, 53)),
+			ctTuple(ctaTupleReply, "8.8.8.8", "10.0.0.1", ctPorts(unix.IPPROTO_UDP, 53, 5353)),
+			ctCounters(ctaCountersOrig, 4, 305),
+			ctCounters(ctaCountersReply, 3, 291),
+			nla(ctaStatus, be32(ipsSeenReply)),
+			nla(ctaId, be32(2)),
+		),
+		"ipv4 icmp mark": ctMessage(ipctnlMsgCtNew, unix.NLM_F_CREATE|unix.NLM_F_EXCL, unix.AF_INET,
+			ctTuple(ctaTupleOrig, "10.1.2.3", "192.168.1.1", ctIcmp(8, 0, 4455)),
+			ctTuple(ctaTupleReply, "192.168.1.1", "10.1.2.3", ctIcmp(0, 0, 4455)),
+			nla(ctaStatus, be32(0)),
+			nla(ctaMark, be32(0x150)),
+			nla(ctaId, be32(3)),
+		),
+		"ipv6 tcp dnat mark": ctMessage(ipctnlMsgCtNew, unix.NLM_F_CREATE|unix.NLM_F_EXCL, unix.AF_INET6,
+			ctTuple(ctaTupleOrig, "2001:db8::10", "2a00:1450::1", ctPorts(unix.IPPROTO_TCP, 51234, 443)),
+			ctTuple(ctaTupleReply, "fd00::1", "2001:db8::10", ctPorts(unix.IPPROTO_TCP, 443, 51234)),
+			nla(ctaStatus, be32(ipsDstNat|ipsSeenReply|ipsAssured)),
+			nla(ctaMark, be32(0x100)),
+			ctTcpState(3),
+			nla(ctaId, be32(4)),
+		),
+		"ipv6 udp destroy": ctMessage(ipctnlMsgCtDelete, 0, unix.AF_INET6,
+			ctTuple(ctaTupleOrig, "fe80::1", "ff02::1", ctPorts(unix.IPPROTO_UDP, 546, 547)),
+			ctTuple(ctaTupleReply, "ff02::1", "fe80::1", ctPorts(unix.IPPROTO_UDP, 547, 546)),
+			nla(ctaStatus, be32(0)),
+			nla(ctaId, be32(5)),
+		),
+	}
+}
+
+func TestFilterProgram(t *testing.T) {
+	all := []string{"ipv4 tcp snat zone mark", "ipv4 udp destroy", "ipv4 icmp mark", "ipv6 tcp dnat mark", "ipv6 udp destroy"}
+	tests := []struct {
+		name    string
+		filter  Filter
+		natOnly bool
+		want    []string
+	}{
+		{"none", Filter{}, false, all},
+		{"ipv4", Filter{Family: "ipv4"}, false, all[:3]},
+		{"ipv6", Filter{Family: "ipv6"}, false, all[3:]},
+		{"tcp", Filter{Protocol: "tcp"}, false, []string{"ipv4 tcp snat zone mark", "ipv6 tcp dnat mark"}},
+		{"udp number", Filter{Protocol: "17"}, false, []string{"ipv4 udp destroy", "ipv6 udp destroy"}},
+		{"icmp", Filter{Protocol: "icmp"}, false, []string{"ipv4 icmp mark"}},
+		{"zone", Filter{Zone: "3"}, false, []string{"ipv4 tcp snat zone mark"}},
+		{"zone omitted", Filter{Zone: "0"}, false, all[1:]},
+		{"mark", Filter{Mark: "0x123"}, false, []string{"ipv4 tcp snat zone mark"}},
+		{"mark mask", Filter{Mark: "0x100/0xf00"}, false, []string{"ipv4 tcp snat zone mark", "ipv4 icmp mark", "ipv6 tcp dnat mark"}},
+		{"mark omitted", Filter{Mark: "0"}, false, []string{"ipv4 udp destroy", "ipv6 udp destroy"}},
+		{"ipv4 source network", Filter{OrigSrc: []string{"192.168.1.0/24"}}, false, []string{"ipv4 tcp snat zone mark"}},
+		{"ipv4 source networks", Filter{OrigSrc: []string{"172.16.0.0/12", "10.0.0.0/8"}}, false, []string{"ipv4 udp destroy", "ipv4 icmp mark"}},
+		{"ipv4 source host", Filter{OrigSrc: []string{"10.0.0.1"}}, false, []string{"ipv4 udp destroy"}},
+		{"ipv4 source odd prefix", Filter{OrigSrc: []string{"10.0.0.0/31"}}, false, []string{"ipv4 udp destroy"}},
+		{"ipv4 destination", Filter{OrigDst: []string{"8.8.8.8", "1.2.3.0/24"}}, false, []string{"ipv4 tcp snat zone mark", "ipv4 udp destroy"}},
+		{"ipv6 source network", Filter{OrigSrc: []string{"2001:db8::/32"}}, false, []string{"ipv6 tcp dnat mark"}},
+		{"ipv6 source odd prefix", Filter{OrigSrc: []string{"2001:db8::/65"}}, false, []string{"ipv6 tcp dnat mark"}},
+		{"ipv6 destination", Filter{OrigDst: []string{"ff00::/8"}}, false, []string{"ipv6 udp destroy"}},
+		{"both families", Filter{OrigSrc: []string{"192.168.0.0/16", "2001:db8::/32"}}, false, []string{"ipv4 tcp snat zone mark", "ipv6 tcp dnat mark"}},
+		{"nat", Filter{}, true, []string{"ipv4 tcp snat zone mark", "ipv6 tcp dnat mark"}},
+		{"nat ipv6", Filter{Family: "ipv6"}, true, []string{"ipv6 tcp dnat mark"}},
+		{"combined", Filter{Family: "ipv4", Protocol: "udp", OrigDst: []string{"8.8.8.0/24"}}, false, []string{"ipv4 udp destroy"}},
+		{"combined nothing", Filter{Family: "ipv4", Protocol: "tcp", Zone: "3", Mark: "0x123", OrigSrc: []string{"10.0.0.0/8"}}, false, nil},
+	}
+	messages := filterMessages()
+	for _, test := range tests {
+		compiled, err := test.filter.compile()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		program, err := compiled.program(test.natOnly)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		var accepted []string
+		for _, name := range all {
+			packet := messages[name]
+			ret, err := runFilter(program, packet)
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			if ret != 0 {
+				accepted = append(accepted, name)
+			}
+
+			// The kernel and userspace agree
+			parsed, err := parseNetlinkMessages(packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			flow, _ := netlinkParse(parsed[0])
+			matched := compiled.match(&flow.Flow) && (!test.natOnly || flow.status&(ipsSrcNat|ipsDstNat) != 0)
+			if matched != (ret != 0) {
+				t.Errorf("%s: %s: socket filter %v, userspace %v", test.name, name, ret != 0, matched)
+			}
+		}
+		if !reflect.DeepEqual(accepted, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, accepted, test.want)
+		}
+	}
+}
+
+func TestFilterArgs(t *testing.T) {
+	tests := []struct {
+		filter Filter
+		want   []string
+	}{
+		{Filter{}, nil},
+		{Filter{Family: "ipv4", Protocol: "tcp"}, []string{"-f", "ipv4", "-p", "tcp"}},
+		{Filter{Family: "ipv6", Protocol: "200"}, []string{"-f", "ipv6", "-p", "200"}},
+		{Filter{Zone: "3"}, []string{"-w", "3"}},
+		{Filter{Mark: "0x10"}, []string{"-m", "16"}},
+		{Filter{Mark: "0x100/0xf00"}, []string{"-m", "256/3840"}},
+		{Filter{Mark: "0x110/0xf00"}, []string{"-m", "256/3840"}},
+		{Filter{OrigSrc: []string{"10.0.0.1"}, OrigDst: []string{"2001:db8::/32"}}, []string{"-s", "10.0.0.1", "-d", "2001:db8::/32"}},
+		{Filter{OrigSrc: []string{"192.168.1.7/24"}, OrigDst: []string{"::1/128"}}, []string{"-s", "192.168.1.0/24", "-d", "::1"}},
+	}
+	for _, test := range tests {
+		compiled, err := test.filter.compile()
+		if err != nil {
+			t.Fatalf("%+v: %s", test.filter, err)
+		}
+		args, err := compiled.args()
+		if err != nil {
+			t.Errorf("%+v: %s", test.filter, err)
+			continue
+		}
+		if !reflect.DeepEqual(args, test.want) {
+			t.Errorf("%+v: got %q, want %q", test.filter, args, test.want)
+		}
+	}
+
+	compiled, err := Filter{OrigSrc: []string{"10.0.0.0/8", "172.16.0.0/12"}}.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := compiled.args(); err == nil {
+		t.Error("several source networks accepted")
+	}
+}
+
+func TestFilterCheckConntrack(t *testing.T) {
+	tests := []struct {
+		filter  Filter
+		version string
+		err     string
+	}{
+		{Filter{Family: "ipv4", Protocol: "tcp", Mark: "1"}, "", ""},
+		{Filter{OrigSrc: []string{"10.0.0.1"}, OrigDst: []string{"::1"}}, "", ""},
+		{Filter{Zone: "3"}, "1.4.4", "can't filter the events by zone"},
+		{Filter{Zone: "3"}, "1.4.6", ""},
+		{Filter{OrigSrc: []string{"10.0.0.0/8"}}, "1.4.5", "can't filter the events by network"},
+		{Filter{OrigDst: []string{"2001:db8::/32"}}, "1.4.10", ""},
+		{Filter{OrigDst: []string{"10.0.0.0/8"}}, "1.5.0", ""},
+		{Filter{OrigDst: []string{"10.0.0.0/8"}}, "1.4.6-rc1", ""},
+	}
+	for _, test := range tests {
+		compiled, err := test.filter.compile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		called := false
+		err = compiled.checkConntrack(func() (string, error) {
+			called = true
+			return test.version, nil
+		})
+		if test.version == "" && called {
+			t.Errorf("%+v: version needlessly called", test.filter)
+		}
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%+v with %s: got %v, want %q", test.filter, test.version, err, test.err)
+		}
+	}
+
+	compiled, _ := Filter{Zone: "1"}.compile()
+	if err := compiled.checkConntrack(func() (string, error) { return "", errors.New("not found") }); err == nil {
+		t.Error("unknown version accepted")
+	}
+}
@@ -1,17 +1,48 @@
 package conntrack
 
 import (
+	"encoding/binary"
+	"hash/fnv"
 	"net"
 )
 
 type Flow struct {
 	Timestamp int64  `json:"timestamp"`
 	Type      string `json:"type"`
-	Id        int    `json:"id"`
+	Id        uint32 `json:"id"`
 	Original  Meta   `json:"original"`
 	Reply     Meta   `json:"reply"`
 	UNREPLIED bool
 	ASSURED   bool
+	Timeout   int      `json:"timeout"`
+	State     string   `json:"state"`
+	Mark      uint32   `json:"mark"`
+	Zone      int      `json:"zone"`
+	Use       int      `json:"use"`
+	Secctx    string   `json:"secctx"`
+	Labels    []string `json:"labels"`
+
+	Transition *Transition `json:"transition,omitempty"`
+	// Count is the number of events covered by a marker event
+	Count int `json:"count,omitempty"`
+	// Delta holds the counters increase since the previous INTERIM event
+	Delta *Delta `json:"delta,omitempty"`
+	// Deltatime is the lifetime in seconds of a destroyed connection, with nf_conntrack_timestamp enabled
+	Deltatime int64 `json:"deltatime,omitempty"`
+	// Netns is the network namespace of the connection, empty for the collector one
+	Netns string `json:"netns,omitempty"`
+}
+
+type Delta struct {
+	Original Counter `json:"original"`
+	Reply    Counter `json:"reply"`
+}
+
+// Transition describes a state change, To is empty when the connection is destroyed
+type Transition struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Duration int64  `json:"duration"` // milliseconds spent in From
 }
 
 type Meta struct {
@@ -32,9 +63,71 @@ type Layer4 struct {
 	Protoname string `json:"protoname"`
 	Sport     int    `json:"sport"`
 	Dport     int    `json:"dport"`
+	Icmp      *Icmp  `json:"icmp,omitempty"`
+	Gre       *Gre   `json:"gre,omitempty"`
+}
+
+// Icmp is set for icmp and icmpv6 flows
+type Icmp struct {
+	Type int `json:"type"`
+	Code int `json:"code"`
+	Id   int `json:"id"`
+}
+
+// Gre is set for gre flows, ports are not used
+type Gre struct {
+	SrcKey uint32 `json:"srckey"`
+	DstKey uint32 `json:"dstkey"`
 }
 
+// Counter holds the 64-bit counters of the kernel, with nf_conntrack_acct enabled
 type Counter struct {
-	Packets int `json:"packets"`
-	Bytes   int `json:"bytes"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+func (l *Layer4) icmp() *Icmp {
+	if l.Icmp == nil {
+		l.Icmp = &Icmp{}
+	}
+	return l.Icmp
+}
+
+func (l *Layer4) gre() *Gre {
+	if l.Gre == nil {
+		l.Gre = &Gre{}
+	}
+	return l.Gre
+}
+
+// TupleHash identifies a connection by its original tuple, zone and namespace
+func (f *Flow) TupleHash() uint64 {
+	var ports [8]byte
+	hash := fnv.New64a()
+	hash.Write([]byte(f.Netns))
+	hash.Write([]byte(f.Original.Layer4.Protoname))
+	hash.Write(f.Original.Layer3.Src.To16())
+	hash.Write(f.Original.Layer3.Dst.To16())
+	binary.BigEndian.PutUint16(ports[0:2], uint16(f.Original.Layer4.Sport))
+	binary.BigEndian.PutUint16(ports[2:4], uint16(f.Original.Layer4.Dport))
+	binary.BigEndian.PutUint32(ports[4:8], uint32(f.Zone))
+	hash.Write(ports[:])
+	// ICMP and GRE connections are told apart by their id and keys
+	if icmp := f.Original.Layer4.Icmp; icmp != nil {
+		binary.BigEndian.PutUint16(ports[0:2], uint16(icmp.Id))
+		ports[2], ports[3] = byte(icmp.Type), byte(icmp.Code)
+		hash.Write(ports[:4])
+	}
+	if gre := f.Original.Layer4.Gre; gre != nil {
+		binary.BigEndian.PutUint32(ports[0:4], gre.SrcKey)
+		binary.BigEndian.PutUint32(ports[4:8], gre.DstKey)
+		hash.Write(ports[:])
+	}
+	return hash.Sum64()
+}
+
+// nat tells if the reply tuple isn't the inverse of the original one
+func (f *Flow) nat() bool {
+	return !f.Original.Layer3.Src.Equal(f.Reply.Layer3.Dst) || !f.Original.Layer3.Dst.Equal(f.Reply.Layer3.Src) ||
+		f.Original.Layer4.Sport != f.Reply.Layer4.Dport || f.Original.Layer4.Dport != f.Reply.Layer4.Sport
 }
@@ -0,0 +1,127 @@
+package conntrack
+
+import (
+	"time"
+)
+
+// interimJitter is the margin left to the dumps for the ticker lateness
+const interimJitter = 100 * time.Millisecond
+
+// InterimReporter periodically dumps the table and publishes INTERIM events for long-lived connections
+type InterimReporter struct {
+	dumper        Dumper
+	activeTimeout time.Duration
+	connections   map[interimKey]*interimState
+	generation    uint64
+	stop          chan struct{}
+	done          chan struct{}
+}
+
+// interimKey tells apart the connections which reuse a tuple by their conntrack id
+type interimKey struct {
+	tuple uint64
+	id    uint32
+}
+
+type interimState struct {
+	// lastReport is the dump which first saw the connection or last reported it
+	lastReport time.Time
+	original   Counter
+	reply      Counter
+	generation uint64
+}
+
+// NewInterimReporter reports every connection older than activeTimeout, once per activeTimeout
+func NewInterimReporter(dumper Dumper, activeTimeout time.Duration) *InterimReporter {
+	return &InterimReporter{
+		dumper:        dumper,
+		activeTimeout: activeTimeout,
+		connections:   make(map[interimKey]*interimState),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+func (r *InterimReporter) Start(flowChan chan<- Flow, errChan chan<- error) error {
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(r.activeTimeout)
+		defer ticker.Stop()
+		for {
+			var now time.Time
+			select {
+			case <-r.stop:
+				return
+			case now = <-ticker.C:
+			}
+			if err := r.report(flowChan, now); err != nil {
+				select {
+				case errChan <- err:
+				case <-r.stop:
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (r *InterimReporter) Stop() error {
+	close(r.stop)
+	<-r.done
+	return nil
+}
+
+// report dumps the table at the given time, the dumps are compared by the time they were due
+func (r *InterimReporter) report(flowChan chan<- Flow, now time.Time) error {
+	r.generation++
+	err := r.dumper.Dump(func(flow Flow) bool {
+		key := interimKey{tuple: flow.TupleHash(), id: flow.Id}
+		state, known := r.connections[key]
+		// Counters going backwards are a new connection on the tuple of a source without ids
+		if !known || flow.Original.Counter.Packets < state.original.Packets || flow.Reply.Counter.Packets < state.reply.Packets {
+			r.connections[key] = &interimState{
+				lastReport: now,
+				original:   flow.Original.Counter,
+				reply:      flow.Reply.Counter,
+				generation: r.generation,
+			}
+			return true
+		}
+		state.generation = r.generation
+		// A dump a little early doesn't make the connection wait for the next one
+		if now.Sub(state.lastReport) < r.activeTimeout-interimJitter {
+			return true
+		}
+		state.lastReport = now
+		flow.Type = "INTERIM"
+		flow.Delta = &Delta{
+			Original: Counter{
+				Packets: flow.Original.Counter.Packets - state.original.Packets,
+				Bytes:   flow.Original.Counter.Bytes - state.original.Bytes,
+			},
+			Reply: Counter{
+				Packets: flow.Reply.Counter.Packets - state.reply.Packets,
+				Bytes:   flow.Reply.Counter.Bytes - state.reply.Bytes,
+			},
+		}
+		state.original = flow.Original.Counter
+		state.reply = flow.Reply.Counter
+		select {
+		case flowChan <- flow:
+			return true
+		case <-r.stop:
+			return false
+		}
+	})
+	if err != nil {
+		return err
+	}
+	// Forget the connections which are gone
+	for key, state := range r.connections {
+		if state.generation != r.generation {
+			delete(r.connections, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package conntrack
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type fakeDumper []Flow
+
+func (d *fakeDumper) Dump(fn func(flow Flow) bool) error {
+	for _, flow := range *d {
+		if !fn(flow) {
+			break
+		}
+	}
+	return nil
+}
+
+func interimFlow(id uint32, packets uint64) Flow {
+	return Flow{
+		Type: "DUMP",
+		Id:   id,
+		Original: Meta{
+			Layer3:  Layer3{Src: net.IP{10, 0, 0, 1}, Dst: net.IP{10, 0, 0, 2}},
+			Layer4:  Layer4{Protoname: "tcp", Sport: 1234, Dport: 80},
+			Counter: Counter{Packets: packets, Bytes: packets * 100},
+		},
+	}
+}
+
+func reportInterim(t *testing.T, r *InterimReporter, at time.Time) []Flow {
+	flowChan := make(chan Flow, 16)
+	if err := r.report(flowChan, at); err != nil {
+		t.Fatal(err)
+	}
+	close(flowChan)
+	var flows []Flow
+	for flow := range flowChan {
+		flows = append(flows, flow)
+	}
+	return flows
+}
+
+func TestInterimReportEarlyDump(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	dumper := &fakeDumper{interimFlow(1, 10)}
+	r := NewInterimReporter(dumper, 10*time.Second)
+	if flows := reportInterim(t, r, start); len(flows) != 0 {
+		t.Fatalf("first dump: got %d flows, want none", len(flows))
+	}
+
+	// The next tick comes a little early
+	at := start.Add(10*time.Second - interimJitter/2)
+	*dumper = fakeDumper{interimFlow(1, 25)}
+	flows := reportInterim(t, r, at)
+	if len(flows) != 1 {
+		t.Fatalf("second dump: got %d flows, want 1", len(flows))
+	}
+	if flows[0].Type != "INTERIM" || flows[0].Delta.Original != (Counter{Packets: 15, Bytes: 1500}) {
+		t.Errorf("second dump: got %s %+v", flows[0].Type, flows[0].Delta)
+	}
+
+	// A dump right after the report is too early
+	if flows := reportInterim(t, r, at.Add(time.Second)); len(flows) != 0 {
+		t.Errorf("third dump: got %d flows, want none", len(flows))
+	}
+}
+
+func TestInterimReportBoundary(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	dumper := &fakeDumper{interimFlow(1, 10)}
+	r := NewInterimReporter(dumper, 10*time.Second)
+	reportInterim(t, r, start)
+
+	due := start.Add(10*time.Second - interimJitter)
+	if flows := reportInterim(t, r, due.Add(-time.Nanosecond)); len(flows) != 0 {
+		t.Errorf("got %d flows before the margin, want none", len(flows))
+	}
+	if flows := reportInterim(t, r, due); len(flows) != 1 {
+		t.Errorf("got %d flows within the margin, want 1", len(flows))
+	}
+	// The next report counts from this one, not from when it was due
+	if flows := reportInterim(t, r, due.Add(10*time.Second-interimJitter-time.Nanosecond)); len(flows) != 0 {
+		t.Errorf("got %d flows before the next report is due, want none", len(flows))
+	}
+	// A half period isn't enough anymore
+	r = NewInterimReporter(dumper, 10*time.Second)
+	reportInterim(t, r, start)
+	if flows := reportInterim(t, r, start.Add(5*time.Second)); len(flows) != 0 {
+		t.Errorf("got %d flows after half the timeout, want none", len(flows))
+	}
+}
+
+func TestInterimReportReusedTuple(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	dumper := &fakeDumper{interimFlow(1, 1000)}
+	r := NewInterimReporter(dumper, 10*time.Second)
+	reportInterim(t, r, start)
+
+	// The connection is replaced by a new one on the same tuple between the dumps
+	*dumper = fakeDumper{interimFlow(2, 5)}
+	if flows := reportInterim(t, r, start.Add(10*time.Second)); len(flows) != 0 {
+		t.Fatalf("got %+v, want no report of the new connection", flows)
+	}
+	if len(r.connections) != 1 {
+		t.Errorf("got %d connections, want the old one forgotten", len(r.connections))
+	}
+
+	*dumper = fakeDumper{interimFlow(2, 8)}
+	flows := reportInterim(t, r, start.Add(20*time.Second))
+	if len(flows) != 1 || flows[0].Delta.Original != (Counter{Packets: 3, Bytes: 300}) {
+		t.Errorf("got %+v, want a delta of 3 packets", flows)
+	}
+}
+
+func TestInterimReportCountersReset(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	// Sources without ids report 0
+	dumper := &fakeDumper{interimFlow(0, 1000)}
+	r := NewInterimReporter(dumper, 10*time.Second)
+	reportInterim(t, r, start)
+
+	*dumper = fakeDumper{interimFlow(0, 5)}
+	if flows := reportInterim(t, r, start.Add(10*time.Second)); len(flows) != 0 {
+		t.Errorf("got %+v, want no report with wrapped counters", flows)
+	}
+}
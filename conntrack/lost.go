@@ -0,0 +1,143 @@
+package conntrack
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	log "gitlab.com/OpenWifiPortal/go-libs/logger"
+	"golang.org/x/sys/unix"
+)
+
+// procNetNetlink lists the netlink sockets of the namespace of the calling thread
+const procNetNetlink = "/proc/thread-self/net/netlink"
+
+var (
+	overflowCount  uint64
+	lostEventCount uint64
+)
+
+// LostEvents returns the number of receive buffer overflows and the number of events they dropped, when known
+func LostEvents() (overflows uint64, events uint64) {
+	return atomic.LoadUint64(&overflowCount), atomic.LoadUint64(&lostEventCount)
+}
+
+// overflowReporter publishes LOST events when the netlink receive buffer overflows
+type overflowReporter struct {
+	dumper    Dumper
+	netns     string
+	resync    bool
+	drops     func() (uint64, error)
+	lastDrops uint64
+}
+
+// overflow publishes a LOST event with the number of dropped events, -1 if unknown, then resyncs if asked
+func (r *overflowReporter) overflow(flowChan chan<- Flow, stop <-chan struct{}) error {
+	lost := -1
+	drops, err := r.drops()
+	if err != nil {
+		log.Debugln("netlink drops: ", err)
+	} else {
+		lost = int(drops - r.lastDrops)
+		r.lastDrops = drops
+		atomic.AddUint64(&lostEventCount, uint64(lost))
+	}
+	atomic.AddUint64(&overflowCount, 1)
+	switch {
+	case lost < 0 && r.netns != "":
+		log.Warnf("receive buffer overflow in %s, unknown number of events lost", r.netns)
+	case lost < 0:
+		log.Warnln("receive buffer overflow, unknown number of events lost")
+	case r.netns != "":
+		log.Warnf("receive buffer overflow in %s, %d events lost", r.netns, lost)
+	default:
+		log.Warnf("receive buffer overflow, %d events lost", lost)
+	}
+
+	select {
+	case flowChan <- newMarker("LOST", r.netns, lost):
+	case <-stop:
+		return nil
+	}
+	if r.resync {
+		return snapshot(r.dumper, r.netns, flowChan, stop)
+	}
+	return nil
+}
+
+// netlinkDrops reads the drop counter of the NETLINK_NETFILTER socket of the namespace matching one of the inodes
+func netlinkDrops(netns string, inodes ...uint64) (drops uint64, err error) {
+	err = inNetns(netns, func() error {
+		file, err := os.Open(procNetNetlink)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		drops, err = readNetlinkDrops(file, inodes)
+		return err
+	})
+	return drops, err
+}
+
+func readNetlinkDrops(r io.Reader, inodes []uint64) (uint64, error) {
+	scanner := bufio.NewScanner(r)
+	columns := make(map[string]int)
+	if scanner.Scan() {
+		for i, name := range strings.Fields(scanner.Text()) {
+			columns[name] = i
+		}
+	}
+	for _, name := range []string{"Eth", "Drops", "Inode"} {
+		if _, ok := columns[name]; !ok {
+			return 0, fmt.Errorf("%s: missing column %s", procNetNetlink, name)
+		}
+	}
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < len(columns) || fields[columns["Eth"]] != strconv.Itoa(unix.NETLINK_NETFILTER) {
+			continue
+		}
+		for _, inode := range inodes {
+			if fields[columns["Inode"]] == strconv.FormatUint(inode, 10) {
+				return strconv.ParseUint(fields[columns["Drops"]], 10, 64)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("%s: %s", procNetNetlink, err)
+	}
+	return 0, fmt.Errorf("%s: socket not found", procNetNetlink)
+}
+
+// processSockets lists the inodes of the sockets a process has open
+func processSockets(pid int) ([]uint64, error) {
+	dir := fmt.Sprintf("/proc/%d/fd", pid)
+	file, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	fds, err := file.Readdirnames(-1)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	var inodes []uint64
+	for _, fd := range fds {
+		target, err := os.Readlink(filepath.Join(dir, fd))
+		if err != nil {
+			// The descriptor was closed meanwhile
+			continue
+		}
+		if strings.HasPrefix(target, "socket:[") && strings.HasSuffix(target, "]") {
+			if inode, err := strconv.ParseUint(target[len("socket:["):len(target)-1], 10, 64); err == nil {
+				inodes = append(inodes, inode)
+			}
+		}
+	}
+	return inodes, nil
+}
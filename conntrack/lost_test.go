@@ -0,0 +1,70 @@
+package conntrack
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// procNetNetlinkFixture is /proc/net/netlink with a conntrack -E socket whose port id isn't its pid
+const procNetNetlinkFixture = `sk               Eth Pid        Groups   Rmem     Wmem     Dump  Locks    Drops    Inode
+ffff8f0e4b7c4000 0   0          00000000 0        0        0     2        0        9
+ffff8f0e4a1b2800 12  4235       00000007 0        0        0     2        17       48311
+ffff8f0e4a1b3000 12  -1998612   00000007 212992   0        0     2        1234     48902
+ffff8f0e49d6e000 15  1          00000001 0        0        0     2        0        48903
+`
+
+func TestReadNetlinkDrops(t *testing.T) {
+	tests := []struct {
+		inodes []uint64
+		drops  uint64
+		found  bool
+	}{
+		{[]uint64{48311}, 17, true},
+		{[]uint64{3, 7, 48902}, 1234, true},
+		// Sockets of other families are skipped
+		{[]uint64{48903}, 0, false},
+		{nil, 0, false},
+	}
+	for _, test := range tests {
+		drops, err := readNetlinkDrops(strings.NewReader(procNetNetlinkFixture), test.inodes)
+		if (err == nil) != test.found || drops != test.drops {
+			t.Errorf("%v: got %d, %v, want %d", test.inodes, drops, err, test.drops)
+		}
+	}
+
+	if _, err := readNetlinkDrops(strings.NewReader("sk Eth Pid\n"), []uint64{48311}); err == nil {
+		t.Error("got no error without the drops column")
+	}
+}
+
+func TestProcessSockets(t *testing.T) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer unix.Close(fd)
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err != nil {
+		t.Fatal(err)
+	}
+	// Unrelated sockets are listed too
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err == nil {
+		defer listener.Close()
+	}
+
+	inodes, err := processSockets(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, inode := range inodes {
+		if inode == uint64(stat.Ino) {
+			return
+		}
+	}
+	t.Errorf("got %v, want the inode %d", inodes, stat.Ino)
+}
@@ -0,0 +1,636 @@
+package conntrack
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+
+	log "gitlab.com/OpenWifiPortal/go-libs/logger"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// Netlink and nfnetlink constants, see linux/netfilter/nfnetlink*.h
+const (
+	nlmsgHeaderLen = 16
+	nfgenmsgLen    = 4
+	nlaHeaderLen   = 4
+	nlaTypeMask    = 0x3fff
+
+	nfnlSubsysCtnetlink = 1
+
+	nfnlgrpConntrackNew     = 1
+	nfnlgrpConntrackUpdate  = 2
+	nfnlgrpConntrackDestroy = 3
+
+	ipctnlMsgCtNew    = 0
+	ipctnlMsgCtGet    = 1
+	ipctnlMsgCtDelete = 2
+)
+
+// Conntrack attributes, see linux/netfilter/nfnetlink_conntrack.h
+const (
+	ctaTupleOrig     = 1
+	ctaTupleReply    = 2
+	ctaStatus        = 3
+	ctaProtoinfo     = 4
+	ctaTimeout       = 7
+	ctaMark          = 8
+	ctaMarkMask      = 21
+	ctaCountersOrig  = 9
+	ctaCountersReply = 10
+	ctaUse           = 11
+	ctaId            = 12
+	ctaZone          = 18
+	ctaSecctx        = 19
+	ctaLabels        = 22
+
+	ctaTupleIp    = 1
+	ctaTupleProto = 2
+
+	ctaIpV4Src = 1
+	ctaIpV4Dst = 2
+	ctaIpV6Src = 3
+	ctaIpV6Dst = 4
+
+	ctaProtoNum        = 1
+	ctaProtoSrcPort    = 2
+	ctaProtoDstPort    = 3
+	ctaProtoIcmpId     = 4
+	ctaProtoIcmpType   = 5
+	ctaProtoIcmpCode   = 6
+	ctaProtoIcmpv6Id   = 7
+	ctaProtoIcmpv6Type = 8
+	ctaProtoIcmpv6Code = 9
+
+	ctaProtoinfoTcp      = 1
+	ctaProtoinfoTcpState = 1
+
+	ctaSecctxName = 1
+
+	ctaCountersPackets   = 1
+	ctaCountersBytes     = 2
+	ctaCounters32Packets = 3
+	ctaCounters32Bytes   = 4
+)
+
+// Conntrack status bits, see linux/netfilter/nf_conntrack_common.h
+const (
+	ipsSeenReply = 1 << 1
+	ipsAssured   = 1 << 2
+	ipsSrcNat    = 1 << 4
+	ipsDstNat    = 1 << 5
+)
+
+var layer4Protonames = map[int]string{
+	unix.IPPROTO_ICMP:    "icmp",
+	unix.IPPROTO_TCP:     "tcp",
+	unix.IPPROTO_UDP:     "udp",
+	unix.IPPROTO_DCCP:    "dccp",
+	unix.IPPROTO_GRE:     "gre",
+	unix.IPPROTO_ICMPV6:  "icmpv6",
+	unix.IPPROTO_SCTP:    "sctp",
+	unix.IPPROTO_UDPLITE: "udplite",
+}
+
+// TCP states as printed by conntrack-tools, indexed by the kernel TCP_CONNTRACK_* values. 9 is SYN_SENT2,
+// the simultaneous open, which libnetfilter_conntrack prints under that name
+var tcpStates = []string{
+	"NONE",
+	"SYN_SENT",
+	"SYN_RECV",
+	"ESTABLISHED",
+	"FIN_WAIT",
+	"CLOSE_WAIT",
+	"LAST_ACK",
+	"TIME_WAIT",
+	"CLOSE",
+	"SYN_SENT2",
+}
+
+var nativeEndian binary.ByteOrder
+
+func init() {
+	i := uint16(1)
+	if *(*byte)(unsafe.Pointer(&i)) == 1 {
+		nativeEndian = binary.LittleEndian
+	} else {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+type netlinkMessage struct {
+	Type  uint16
+	Flags uint16
+	Seq   uint32
+	Data  []byte
+}
+
+type netlinkAttribute struct {
+	Type uint16
+	Data []byte
+}
+
+type netlinkConn struct {
+	fd     int
+	buffer []byte
+}
+
+func netlinkAlign(length int) int {
+	return (length + 3) &^ 3
+}
+
+// dialNetlink opens a NETLINK_NETFILTER socket in netns subscribed to the given multicast groups
+func dialNetlink(netns string, groups uint32) (*netlinkConn, error) {
+	var fd int
+	err := inNetns(netns, func() (err error) {
+		fd, err = unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("netlink socket: %s", err)
+	}
+	// SO_RCVBUFFORCE needs CAP_NET_ADMIN, fallback on SO_RCVBUF capped by rmem_max
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, ConntrackBufferSize); err != nil {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, ConntrackBufferSize); err != nil {
+			log.Warnln("netlink receive buffer: ", err)
+		}
+	}
+	// Wake up regularly to allow the reader to be stopped
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 1}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("netlink receive timeout: %s", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: groups}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("netlink bind: %s", err)
+	}
+	return &netlinkConn{
+		fd:     fd,
+		buffer: make([]byte, os.Getpagesize()*16),
+	}, nil
+}
+
+// Drops returns the number of messages the kernel dropped for this socket, opened in netns
+func (c *netlinkConn) Drops(netns string) (uint64, error) {
+	var stat unix.Stat_t
+	if err := unix.Fstat(c.fd, &stat); err != nil {
+		return 0, err
+	}
+	return netlinkDrops(netns, uint64(stat.Ino))
+}
+
+func (c *netlinkConn) Close() error {
+	return unix.Close(c.fd)
+}
+
+// Receive reads one datagram, returned messages are only valid until the next call
+func (c *netlinkConn) Receive() ([]netlinkMessage, error) {
+	n, _, err := unix.Recvfrom(c.fd, c.buffer, 0)
+	if err != nil {
+		return nil, err
+	}
+	return parseNetlinkMessages(c.buffer[:n])
+}
+
+// Request sends a nfnetlink message to the kernel
+func (c *netlinkConn) Request(msgType uint16, flags uint16, family uint8, seq uint32, attributes ...netlinkAttribute) error {
+	b := make([]byte, nlmsgHeaderLen+nfgenmsgLen)
+	for _, attribute := range attributes {
+		header := make([]byte, nlaHeaderLen)
+		nativeEndian.PutUint16(header[0:2], uint16(nlaHeaderLen+len(attribute.Data)))
+		nativeEndian.PutUint16(header[2:4], attribute.Type)
+		b = append(b, header...)
+		b = append(b, attribute.Data...)
+		b = append(b, make([]byte, netlinkAlign(len(attribute.Data))-len(attribute.Data))...)
+	}
+	nativeEndian.PutUint32(b[0:4], uint32(len(b)))
+	nativeEndian.PutUint16(b[4:6], msgType)
+	nativeEndian.PutUint16(b[6:8], flags)
+	nativeEndian.PutUint32(b[8:12], seq)
+	b[nlmsgHeaderLen] = family
+	return unix.Sendto(c.fd, b, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+}
+
+// uint32Attribute builds an attribute holding a big endian value, as ctnetlink expects
+func uint32Attribute(attributeType uint16, value uint32) netlinkAttribute {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, value)
+	return netlinkAttribute{Type: attributeType, Data: data}
+}
+
+// netlinkError returns the error carried by a NLMSG_ERROR message, nil for an acknowledgment
+func netlinkError(message netlinkMessage) error {
+	if len(message.Data) < 4 {
+		return fmt.Errorf("netlink error: truncated message")
+	}
+	errno := int32(nativeEndian.Uint32(message.Data[0:4]))
+	if errno == 0 {
+		return nil
+	}
+	return syscall.Errno(-errno)
+}
+
+func parseNetlinkMessages(b []byte) ([]netlinkMessage, error) {
+	var messages []netlinkMessage
+	for len(b) >= nlmsgHeaderLen {
+		length := int(nativeEndian.Uint32(b[0:4]))
+		if length < nlmsgHeaderLen || length > len(b) {
+			return messages, fmt.Errorf("netlink message: invalid length %d", length)
+		}
+		messages = append(messages, netlinkMessage{
+			Type:  nativeEndian.Uint16(b[4:6]),
+			Flags: nativeEndian.Uint16(b[6:8]),
+			Seq:   nativeEndian.Uint32(b[8:12]),
+			Data:  b[nlmsgHeaderLen:length],
+		})
+		if netlinkAlign(length) >= len(b) {
+			break
+		}
+		b = b[netlinkAlign(length):]
+	}
+	return messages, nil
+}
+
+func parseNetlinkAttributes(b []byte) []netlinkAttribute {
+	var attributes []netlinkAttribute
+	for len(b) >= nlaHeaderLen {
+		length := int(nativeEndian.Uint16(b[0:2]))
+		if length < nlaHeaderLen || length > len(b) {
+			break
+		}
+		attributes = append(attributes, netlinkAttribute{
+			Type: nativeEndian.Uint16(b[2:4]) & nlaTypeMask,
+			Data: b[nlaHeaderLen:length],
+		})
+		if netlinkAlign(length) >= len(b) {
+			break
+		}
+		b = b[netlinkAlign(length):]
+	}
+	return attributes
+}
+
+func (a netlinkAttribute) Uint8() uint8 {
+	if len(a.Data) < 1 {
+		return 0
+	}
+	return a.Data[0]
+}
+
+func (a netlinkAttribute) Uint16() uint16 {
+	if len(a.Data) < 2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(a.Data)
+}
+
+func (a netlinkAttribute) Uint32() uint32 {
+	if len(a.Data) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(a.Data)
+}
+
+func (a netlinkAttribute) Uint64() uint64 {
+	if len(a.Data) < 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(a.Data)
+}
+
+func (a netlinkAttribute) String() string {
+	if i := bytes.IndexByte(a.Data, 0); i >= 0 {
+		return string(a.Data[:i])
+	}
+	return string(a.Data)
+}
+
+func (a netlinkAttribute) IP() net.IP {
+	ip := make(net.IP, len(a.Data))
+	copy(ip, a.Data)
+	return ip
+}
+
+// netlinkGroups converts conntrack event names to the multicast group bitmask
+func netlinkGroups(eventType []string) uint32 {
+	groups := map[string]uint32{
+		"NEW":     nfnlgrpConntrackNew,
+		"UPDATE":  nfnlgrpConntrackUpdate,
+		"DESTROY": nfnlgrpConntrackDestroy,
+	}
+	if eventType == nil {
+		eventType = []string{"NEW", "UPDATE", "DESTROY"}
+	}
+	var mask uint32
+	for _, event := range eventType {
+		if group, ok := groups[event]; ok {
+			mask |= 1 << (group - 1)
+		}
+	}
+	return mask
+}
+
+func init() {
+	RegisterSource("netlink", newNetlinkSource)
+}
+
+// netlinkSource subscribes to ctnetlink multicast events without the conntrack binary
+type netlinkSource struct {
+	options SourceOptions
+	filter  *filter
+	program []bpf.RawInstruction
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func newNetlinkSource(options SourceOptions) (Source, error) {
+	if len(options.OtherArgs) > 0 {
+		return nil, fmt.Errorf("netlink source doesn't support conntrack arguments: %v", options.OtherArgs)
+	}
+	if err := checkEventTypes(options.EventType); err != nil {
+		return nil, err
+	}
+	filter, err := options.Filter.compile()
+	if err != nil {
+		return nil, err
+	}
+	program, err := filter.program(options.NatOnly)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &netlinkSource{
+		options: options,
+		filter:  filter,
+		program: program,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+func (s *netlinkSource) Start(flowChan chan<- Flow, errChan chan<- error) error {
+	go func() {
+		defer close(s.done)
+		newSupervisor("netlink", s.options).run(s.ctx, errChan, func(ctx context.Context) error {
+			return s.runNetlink(ctx, flowChan)
+		})
+	}()
+	return nil
+}
+
+func (s *netlinkSource) Stop() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+func (s *netlinkSource) runNetlink(ctx context.Context, flowChan chan<- Flow) error {
+	conn, err := dialNetlink(s.options.Netns, netlinkGroups(s.options.EventType))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// Rejected events are dropped by the kernel before being queued in the socket buffer
+	if err := conn.attachFilter(s.program); err != nil {
+		log.Warnln("netlink filter: ", err)
+	}
+	log.Infoln("starting netlink...")
+
+	reporter := &overflowReporter{
+		dumper: s,
+		netns:  s.options.Netns,
+		resync: s.options.Resync,
+		drops: func() (uint64, error) {
+			return conn.Drops(s.options.Netns)
+		},
+	}
+
+	// Events are queued in the socket buffer while the table is dumped
+	if s.options.Snapshot {
+		if err := snapshot(s, s.options.Netns, flowChan, ctx.Done()); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		messages, err := conn.Receive()
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err == unix.ENOBUFS {
+			if err := reporter.overflow(flowChan, ctx.Done()); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("netlink receive: %s", err)
+		}
+		for _, message := range messages {
+			flow, ok := netlinkParse(message)
+			if !ok {
+				continue
+			}
+			if s.options.NatOnly && flow.status&(ipsSrcNat|ipsDstNat) == 0 || !s.filter.match(&flow.Flow) {
+				continue
+			}
+			flow.Netns = s.options.Netns
+			select {
+			case flowChan <- flow.Flow:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+type netlinkFlow struct {
+	Flow
+	status uint32
+}
+
+func netlinkParse(message netlinkMessage) (netlinkFlow, bool) {
+	var flow = netlinkFlow{}
+	if message.Type>>8 != nfnlSubsysCtnetlink || len(message.Data) < nfgenmsgLen {
+		return flow, false
+	}
+	switch message.Type & 0xff {
+	case ipctnlMsgCtNew:
+		if message.Flags&(unix.NLM_F_CREATE|unix.NLM_F_EXCL) != 0 {
+			flow.Type = "NEW"
+		} else {
+			flow.Type = "UPDATE"
+		}
+	case ipctnlMsgCtDelete:
+		flow.Type = "DESTROY"
+	default:
+		return flow, false
+	}
+	flow.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+
+	family := int(message.Data[0])
+	layer3 := Layer3{Protonum: family}
+	switch family {
+	case unix.AF_INET:
+		layer3.Protoname = "ipv4"
+	case unix.AF_INET6:
+		layer3.Protoname = "ipv6"
+	default:
+		layer3.Protoname = "unknown"
+	}
+	flow.Original.Layer3 = layer3
+	flow.Reply.Layer3 = layer3
+
+	for _, attribute := range parseNetlinkAttributes(message.Data[nfgenmsgLen:]) {
+		switch attribute.Type {
+		case ctaTupleOrig:
+			netlinkParseTuple(attribute.Data, &flow.Original)
+		case ctaTupleReply:
+			netlinkParseTuple(attribute.Data, &flow.Reply)
+		case ctaCountersOrig:
+			netlinkParseCounters(attribute.Data, &flow.Original.Counter)
+		case ctaCountersReply:
+			netlinkParseCounters(attribute.Data, &flow.Reply.Counter)
+		case ctaStatus:
+			flow.status = attribute.Uint32()
+			flow.ASSURED = flow.status&ipsAssured != 0
+			flow.UNREPLIED = flow.status&ipsSeenReply == 0
+		case ctaId:
+			flow.Id = attribute.Uint32()
+		case ctaTimeout:
+			flow.Timeout = int(attribute.Uint32())
+		case ctaMark:
+			flow.Mark = attribute.Uint32()
+		case ctaUse:
+			flow.Use = int(attribute.Uint32())
+		case ctaZone:
+			flow.Zone = int(attribute.Uint16())
+		case ctaProtoinfo:
+			netlinkParseProtoinfo(attribute.Data, &flow.Flow)
+		case ctaSecctx:
+			for _, secctx := range parseNetlinkAttributes(attribute.Data) {
+				if secctx.Type == ctaSecctxName {
+					flow.Secctx = secctx.String()
+				}
+			}
+		case ctaLabels:
+			flow.Labels = netlinkLabels(attribute.Data)
+		}
+	}
+	return flow, true
+}
+
+// netlinkLabels lists the bits set in the label bitmap, an array of unsigned longs of the kernel in host order
+func netlinkLabels(b []byte) []string {
+	var labels []string
+	wordSize := int(unsafe.Sizeof(uintptr(0)))
+	for i := 0; i+wordSize <= len(b); i += wordSize {
+		var word uint64
+		if wordSize == 8 {
+			word = nativeEndian.Uint64(b[i:])
+		} else {
+			word = uint64(nativeEndian.Uint32(b[i:]))
+		}
+		for bit := 0; word != 0; bit++ {
+			if word&1 != 0 {
+				labels = append(labels, strconv.Itoa(i*8+bit))
+			}
+			word >>= 1
+		}
+	}
+	return labels
+}
+
+func netlinkParseTuple(b []byte, meta *Meta) {
+	for _, attribute := range parseNetlinkAttributes(b) {
+		switch attribute.Type {
+		case ctaTupleIp:
+			for _, ip := range parseNetlinkAttributes(attribute.Data) {
+				switch ip.Type {
+				case ctaIpV4Src, ctaIpV6Src:
+					meta.Layer3.Src = ip.IP()
+				case ctaIpV4Dst, ctaIpV6Dst:
+					meta.Layer3.Dst = ip.IP()
+				}
+			}
+		case ctaTupleProto:
+			protos := parseNetlinkAttributes(attribute.Data)
+			for _, proto := range protos {
+				if proto.Type == ctaProtoNum {
+					meta.Layer4.Protonum = int(proto.Uint8())
+					if name, ok := layer4Protonames[meta.Layer4.Protonum]; ok {
+						meta.Layer4.Protoname = name
+					} else {
+						meta.Layer4.Protoname = "unknown"
+					}
+				}
+			}
+			for _, proto := range protos {
+				switch proto.Type {
+				case ctaProtoSrcPort:
+					// GRE keys are carried in the port attributes
+					if meta.Layer4.Protonum == unix.IPPROTO_GRE {
+						meta.Layer4.gre().SrcKey = uint32(proto.Uint16())
+					} else {
+						meta.Layer4.Sport = int(proto.Uint16())
+					}
+				case ctaProtoDstPort:
+					if meta.Layer4.Protonum == unix.IPPROTO_GRE {
+						meta.Layer4.gre().DstKey = uint32(proto.Uint16())
+					} else {
+						meta.Layer4.Dport = int(proto.Uint16())
+					}
+				case ctaProtoIcmpId, ctaProtoIcmpv6Id:
+					meta.Layer4.icmp().Id = int(proto.Uint16())
+				case ctaProtoIcmpType, ctaProtoIcmpv6Type:
+					meta.Layer4.icmp().Type = int(proto.Uint8())
+				case ctaProtoIcmpCode, ctaProtoIcmpv6Code:
+					meta.Layer4.icmp().Code = int(proto.Uint8())
+				}
+			}
+		}
+	}
+}
+
+func netlinkParseProtoinfo(b []byte, flow *Flow) {
+	for _, attribute := range parseNetlinkAttributes(b) {
+		if attribute.Type != ctaProtoinfoTcp {
+			continue
+		}
+		for _, tcp := range parseNetlinkAttributes(attribute.Data) {
+			if tcp.Type == ctaProtoinfoTcpState && int(tcp.Uint8()) < len(tcpStates) {
+				flow.State = tcpStates[tcp.Uint8()]
+			}
+		}
+	}
+}
+
+func netlinkParseCounters(b []byte, counter *Counter) {
+	for _, attribute := range parseNetlinkAttributes(b) {
+		switch attribute.Type {
+		case ctaCountersPackets:
+			counter.Packets = attribute.Uint64()
+		case ctaCountersBytes:
+			counter.Bytes = attribute.Uint64()
+		case ctaCounters32Packets:
+			counter.Packets = uint64(attribute.Uint32())
+		case ctaCounters32Bytes:
+			counter.Bytes = uint64(attribute.Uint32())
+		}
+	}
+}
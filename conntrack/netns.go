@@ -0,0 +1,55 @@
+package conntrack
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Directory of the namespaces named by iproute2 (ip netns add)
+const netnsRunDir = "/var/run/netns"
+
+// netnsPath converts a namespace name to its path, a value containing a slash is already a path
+func netnsPath(netns string) string {
+	if strings.Contains(netns, "/") {
+		return netns
+	}
+	return filepath.Join(netnsRunDir, netns)
+}
+
+// inNetns runs fn on a thread moved to the network namespace, sockets and processes created by fn stay in it
+func inNetns(netns string, fn func() error) error {
+	if netns == "" {
+		return fn()
+	}
+	target, err := os.Open(netnsPath(netns))
+	if err != nil {
+		return fmt.Errorf("netns %s: %s", netns, err)
+	}
+	defer target.Close()
+
+	runtime.LockOSThread()
+	origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("netns %s: %s", netns, err)
+	}
+	defer origin.Close()
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("netns %s: %s", netns, err)
+	}
+
+	fnErr := fn()
+
+	if err := unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET); err != nil {
+		// Keep the thread locked, it is destroyed with the goroutine instead of being reused in the wrong namespace
+		return fmt.Errorf("netns %s: can't restore namespace: %s", netns, err)
+	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
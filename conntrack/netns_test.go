@@ -0,0 +1,51 @@
+package conntrack
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNetnsPath(t *testing.T) {
+	tests := []struct {
+		netns string
+		path  string
+	}{
+		{"blue", "/var/run/netns/blue"},
+		{"/proc/1/ns/net", "/proc/1/ns/net"},
+		{"./blue", "./blue"},
+	}
+	for _, test := range tests {
+		if path := netnsPath(test.netns); path != test.path {
+			t.Errorf("%s: got %s, want %s", test.netns, path, test.path)
+		}
+	}
+}
+
+func TestInNetns(t *testing.T) {
+	failure := errors.New("failure")
+	if err := inNetns("", func() error { return failure }); err != failure {
+		t.Errorf("got %v, want the error of fn", err)
+	}
+	called := false
+	if err := inNetns("conntrack-event-collector-missing", func() error { called = true; return nil }); err == nil || called {
+		t.Errorf("got %v and called %v, want an error without calling fn", err, called)
+	}
+
+	// Entering the current namespace needs CAP_SYS_ADMIN but nothing else
+	self := fmt.Sprintf("/proc/%d/ns/net", os.Getpid())
+	var tid int
+	err := inNetns(self, func() error {
+		tid = unix.Gettid()
+		return failure
+	})
+	if err != failure {
+		t.Skip(err)
+	}
+	if tid == 0 {
+		t.Error("fn wasn't called in the namespace")
+	}
+}
@@ -0,0 +1,576 @@
+package conntrack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Kinds of malformed lines, found in the Err field of a ParseError
+var (
+	ErrMissingHeader   = errors.New("missing timestamp or event type")
+	ErrMissingProtocol = errors.New("missing layer 3 or layer 4 protocol")
+	ErrMissingTuple    = errors.New("missing original or reply tuple")
+	ErrInvalidNumber   = errors.New("invalid number")
+	ErrInvalidAddress  = errors.New("invalid address")
+)
+
+// ParseError reports a malformed conntrack line, Offset is the position of the faulty field
+type ParseError struct {
+	Line   string
+	Offset int
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse error at %d: %s: %s", e.Offset, e.Err, e.Line)
+}
+
+// Addresses and protocol fields are carved from chunks shared by several flows
+const parserChunk = 64
+
+// Parser reads conntrack -E -o timestamp,extended,id lines, it reuses its memory and isn't safe for concurrent use
+type Parser struct {
+	addresses []byte
+	icmps     []Icmp
+	gres      []Gre
+}
+
+var parserPool = sync.Pool{
+	New: func() interface{} {
+		return new(Parser)
+	},
+}
+
+// Parse reads a conntrack event line, the flow doesn't reference line
+func Parse(line []byte) (Flow, error) {
+	parser := parserPool.Get().(*Parser)
+	flow, err := parser.Parse(line)
+	parserPool.Put(parser)
+	return flow, err
+}
+
+// Values printed by conntrack, interned to avoid allocating a string per event
+var parserStrings = func() map[string]string {
+	values := []string{
+		"NEW", "UPDATE", "DESTROY", "DUMP", "ipv4", "ipv6", "unknown",
+		// sctp and dccp states, tcp ones are in tcpStates
+		"CLOSED", "COOKIE_WAIT", "COOKIE_ECHOED", "SHUTDOWN_SENT", "SHUTDOWN_RECD", "SHUTDOWN_ACK_SENT",
+		"HEARTBEAT_SENT", "HEARTBEAT_ACKED", "REQUEST", "RESPOND", "PARTOPEN", "OPEN", "CLOSEREQ", "CLOSING",
+		"TIMEWAIT", "IGNORE", "INVALID",
+	}
+	values = append(values, tcpStates...)
+	for _, name := range layer4Protonames {
+		values = append(values, name)
+	}
+	interned := make(map[string]string)
+	for _, value := range values {
+		interned[value] = value
+	}
+	return interned
+}()
+
+func intern(b []byte) string {
+	if s, ok := parserStrings[string(b)]; ok {
+		return s
+	}
+	return string(b)
+}
+
+// Parse reads a conntrack event line, the flow doesn't reference line
+func (p *Parser) Parse(line []byte) (Flow, error) {
+	var flow = Flow{}
+	fail := func(offset int, err error) (Flow, error) {
+		return Flow{}, &ParseError{Line: string(bytes.TrimSpace(line)), Offset: offset, Err: err}
+	}
+
+	// [1508566165.785132]	    [NEW] ipv4     2 tcp      6 120 SYN_SENT
+	start, timestamp, pos, ok := bracketed(line, 0)
+	if !ok {
+		return fail(start, ErrMissingHeader)
+	}
+	if flow.Timestamp, ok = parseTimestamp(timestamp); !ok {
+		return fail(start, ErrInvalidNumber)
+	}
+	start, eventType, pos, ok := bracketed(line, pos)
+	if !ok || len(eventType) == 0 {
+		return fail(start, ErrMissingHeader)
+	}
+	flow.Type = intern(eventType)
+
+	// ipv4 2 tcp 6
+	var protocols [4][]byte
+	var starts [4]int
+	for i := range protocols {
+		starts[i], protocols[i], pos = token(line, pos)
+		if len(protocols[i]) == 0 || bytes.IndexByte(protocols[i], '=') >= 0 {
+			return fail(starts[i], ErrMissingProtocol)
+		}
+	}
+	flow.Original.Layer3.Protoname = intern(protocols[0])
+	flow.Original.Layer4.Protoname = intern(protocols[2])
+	if flow.Original.Layer3.Protonum, ok = parseInt(protocols[1]); !ok {
+		return fail(starts[1], ErrInvalidNumber)
+	}
+	if flow.Original.Layer4.Protonum, ok = parseInt(protocols[3]); !ok {
+		return fail(starts[3], ErrInvalidNumber)
+	}
+	flow.Reply.Layer3.Protoname = flow.Original.Layer3.Protoname
+	flow.Reply.Layer3.Protonum = flow.Original.Layer3.Protonum
+	flow.Reply.Layer4.Protoname = flow.Original.Layer4.Protoname
+	flow.Reply.Layer4.Protonum = flow.Original.Layer4.Protonum
+
+	// Optional timeout and state, then the tuples and the extended fields
+	var meta *Meta
+	tuples := 0
+	// seen holds the keys of the current tuple, an ICMP tuple has an id after its type and code
+	var seen tupleKeys
+	for {
+		start, field, next := token(line, pos)
+		if len(field) == 0 {
+			break
+		}
+		pos = next
+
+		switch {
+		case field[0] == '[':
+			switch string(field) {
+			case "[UNREPLIED]":
+				flow.UNREPLIED = true
+			case "[ASSURED]":
+				flow.ASSURED = true
+			}
+			meta = nil
+			continue
+		case tuples == 0 && isDigits(field):
+			if flow.Timeout, ok = parseInt(field); !ok {
+				return fail(start, ErrInvalidNumber)
+			}
+			continue
+		case tuples == 0 && isState(field):
+			flow.State = intern(field)
+			continue
+		}
+
+		i := bytes.IndexByte(field, '=')
+		if i < 1 {
+			continue
+		}
+		key, value := field[:i], field[i+1:]
+		valueOffset := start + i + 1
+
+		if string(key) == "src" {
+			tuples++
+			switch tuples {
+			case 1:
+				meta = &flow.Original
+			case 2:
+				meta = &flow.Reply
+			default:
+				meta = nil
+			}
+			seen = tupleKeys{}
+		}
+		if meta != nil {
+			if handled, err := p.tupleField(meta, &seen, key, value); err != nil {
+				return fail(valueOffset, err)
+			} else if handled {
+				continue
+			}
+		}
+		meta = nil
+
+		switch string(key) {
+		case "id":
+			id, ok := parseUint(value, 32)
+			if !ok {
+				return fail(valueOffset, ErrInvalidNumber)
+			}
+			flow.Id = uint32(id)
+		case "mark":
+			mark, ok := parseUint(value, 32)
+			if !ok {
+				return fail(valueOffset, ErrInvalidNumber)
+			}
+			flow.Mark = uint32(mark)
+		case "zone":
+			if flow.Zone, ok = parseInt(value); !ok {
+				return fail(valueOffset, ErrInvalidNumber)
+			}
+		case "use":
+			if flow.Use, ok = parseInt(value); !ok {
+				return fail(valueOffset, ErrInvalidNumber)
+			}
+		case "secctx":
+			flow.Secctx = string(value)
+		case "delta-time":
+			deltatime, ok := parseUint(value, 63)
+			if !ok {
+				return fail(valueOffset, ErrInvalidNumber)
+			}
+			flow.Deltatime = int64(deltatime)
+		case "labels":
+			flow.Labels = strings.Split(string(value), ",")
+		}
+	}
+	if tuples < 2 {
+		return fail(len(line), ErrMissingTuple)
+	}
+	return flow, nil
+}
+
+// tupleKeys are the keys already read in a tuple
+type tupleKeys struct {
+	dst, sport, dport, icmpType, code, id, srckey, dstkey, packets, bytes bool
+}
+
+// tupleField reads a field of the tuple of meta, it returns false when the field ends the tuple
+func (p *Parser) tupleField(meta *Meta, seen *tupleKeys, key []byte, value []byte) (bool, error) {
+	var ok bool
+	// A repeated key belongs to the extended fields
+	once := func(seen *bool) bool {
+		if *seen {
+			return false
+		}
+		*seen = true
+		return true
+	}
+	switch string(key) {
+	case "src":
+		if meta.Layer3.Src, ok = p.ip(value); !ok {
+			return true, ErrInvalidAddress
+		}
+	case "dst":
+		if !once(&seen.dst) {
+			return false, nil
+		}
+		if meta.Layer3.Dst, ok = p.ip(value); !ok {
+			return true, ErrInvalidAddress
+		}
+	case "sport":
+		if !once(&seen.sport) {
+			return false, nil
+		}
+		if meta.Layer4.Sport, ok = parseInt(value); !ok {
+			return true, ErrInvalidNumber
+		}
+	case "dport":
+		if !once(&seen.dport) {
+			return false, nil
+		}
+		if meta.Layer4.Dport, ok = parseInt(value); !ok {
+			return true, ErrInvalidNumber
+		}
+	case "type":
+		if !once(&seen.icmpType) {
+			return false, nil
+		}
+		if p.icmp(meta).Type, ok = parseInt(value); !ok {
+			return true, ErrInvalidNumber
+		}
+	case "code":
+		if !once(&seen.code) {
+			return false, nil
+		}
+		if p.icmp(meta).Code, ok = parseInt(value); !ok {
+			return true, ErrInvalidNumber
+		}
+	case "id":
+		if !seen.code || !once(&seen.id) {
+			return false, nil
+		}
+		if p.icmp(meta).Id, ok = parseInt(value); !ok {
+			return true, ErrInvalidNumber
+		}
+	case "srckey":
+		if !once(&seen.srckey) {
+			return false, nil
+		}
+		key, ok := parseUint(value, 32)
+		if !ok {
+			return true, ErrInvalidNumber
+		}
+		p.gre(meta).SrcKey = uint32(key)
+	case "dstkey":
+		if !once(&seen.dstkey) {
+			return false, nil
+		}
+		key, ok := parseUint(value, 32)
+		if !ok {
+			return true, ErrInvalidNumber
+		}
+		p.gre(meta).DstKey = uint32(key)
+	case "packets":
+		if !once(&seen.packets) {
+			return false, nil
+		}
+		if meta.Counter.Packets, ok = parseUint(value, 64); !ok {
+			return true, ErrInvalidNumber
+		}
+	case "bytes":
+		if !once(&seen.bytes) {
+			return false, nil
+		}
+		if meta.Counter.Bytes, ok = parseUint(value, 64); !ok {
+			return true, ErrInvalidNumber
+		}
+	case "key", "zone-orig", "zone-reply":
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// ip parses an address into the current chunk
+func (p *Parser) ip(b []byte) (net.IP, bool) {
+	if len(p.addresses) < net.IPv6len {
+		p.addresses = make([]byte, parserChunk*net.IPv6len)
+	}
+	ip := net.IP(p.addresses[:net.IPv6len:net.IPv6len])
+	if !parseIP(b, ip) {
+		return nil, false
+	}
+	p.addresses = p.addresses[net.IPv6len:]
+	return ip, true
+}
+
+func (p *Parser) icmp(meta *Meta) *Icmp {
+	if meta.Layer4.Icmp == nil {
+		if len(p.icmps) == 0 {
+			p.icmps = make([]Icmp, parserChunk)
+		}
+		meta.Layer4.Icmp = &p.icmps[0]
+		p.icmps = p.icmps[1:]
+	}
+	return meta.Layer4.Icmp
+}
+
+func (p *Parser) gre(meta *Meta) *Gre {
+	if meta.Layer4.Gre == nil {
+		if len(p.gres) == 0 {
+			p.gres = make([]Gre, parserChunk)
+		}
+		meta.Layer4.Gre = &p.gres[0]
+		p.gres = p.gres[1:]
+	}
+	return meta.Layer4.Gre
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// token returns the offset of the next field, the field and the position following it
+func token(line []byte, pos int) (int, []byte, int) {
+	for pos < len(line) && isSpace(line[pos]) {
+		pos++
+	}
+	start := pos
+	for pos < len(line) && !isSpace(line[pos]) {
+		pos++
+	}
+	return start, line[start:pos], pos
+}
+
+// bracketed reads a [value] field like token, the value may be padded with spaces
+func bracketed(line []byte, pos int) (int, []byte, int, bool) {
+	for pos < len(line) && isSpace(line[pos]) {
+		pos++
+	}
+	if pos >= len(line) || line[pos] != '[' {
+		return pos, nil, pos, false
+	}
+	end := bytes.IndexByte(line[pos:], ']')
+	if end < 0 {
+		return pos, nil, pos, false
+	}
+	return pos, bytes.TrimSpace(line[pos+1 : pos+end]), pos + end + 1, true
+}
+
+func isDigits(b []byte) bool {
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return len(b) > 0
+}
+
+// isState matches [A-Z][A-Z0-9_]*
+func isState(b []byte) bool {
+	if len(b) == 0 || b[0] < 'A' || b[0] > 'Z' {
+		return false
+	}
+	for _, c := range b[1:] {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseUint reads a decimal or 0x prefixed hexadecimal number of at most bits bits
+func parseUint(b []byte, bits uint) (uint64, bool) {
+	base := uint64(10)
+	if len(b) > 2 && b[0] == '0' && (b[1] == 'x' || b[1] == 'X') {
+		base = 16
+		b = b[2:]
+	}
+	if len(b) == 0 {
+		return 0, false
+	}
+	max := uint64(1)<<bits - 1
+	var n uint64
+	for _, c := range b {
+		digit, ok := hexDigit(c)
+		if !ok || uint64(digit) >= base {
+			return 0, false
+		}
+		if n > (max-uint64(digit))/base {
+			return 0, false
+		}
+		n = n*base + uint64(digit)
+	}
+	return n, true
+}
+
+func hexDigit(c byte) (int, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0'), true
+	case c >= 'a' && c <= 'f':
+		return int(c-'a') + 10, true
+	case c >= 'A' && c <= 'F':
+		return int(c-'A') + 10, true
+	}
+	return 0, false
+}
+
+func parseInt(b []byte) (int, bool) {
+	n, ok := parseUint(b, 31)
+	return int(n), ok
+}
+
+// parseTimestamp reads seconds.microseconds as milliseconds
+func parseTimestamp(b []byte) (int64, bool) {
+	dot := bytes.IndexByte(b, '.')
+	if dot < 1 || dot == len(b)-1 {
+		return 0, false
+	}
+	seconds, ok := parseUint(b[:dot], 40)
+	if !ok || !isDigits(b[dot+1:]) {
+		return 0, false
+	}
+	var milliseconds int64
+	for i := 0; i < 3; i++ {
+		milliseconds *= 10
+		if dot+1+i < len(b) {
+			milliseconds += int64(b[dot+1+i] - '0')
+		}
+	}
+	return int64(seconds)*1000 + milliseconds, true
+}
+
+// parseIP reads an IPv4 or IPv6 address into the 16 bytes of ip like net.ParseIP
+func parseIP(b []byte, ip net.IP) bool {
+	if bytes.IndexByte(b, ':') < 0 {
+		for i := 0; i < 10; i++ {
+			ip[i] = 0
+		}
+		ip[10], ip[11] = 0xff, 0xff
+		return parseIPv4(b, ip[12:16])
+	}
+
+	ellipsis := -1
+	i := 0
+	if len(b) >= 2 && b[0] == ':' && b[1] == ':' {
+		ellipsis = 0
+		b = b[2:]
+	}
+	for len(b) > 0 && i < net.IPv6len {
+		// An IPv4 address may end the address
+		if end := bytes.IndexByte(b, ':'); end < 0 && bytes.IndexByte(b, '.') >= 0 {
+			if i > net.IPv6len-4 || !parseIPv4(b, ip[i:i+4]) {
+				return false
+			}
+			i += 4
+			b = nil
+			break
+		}
+		var group, digits int
+		for digits < len(b) && digits < 5 {
+			digit, ok := hexDigit(b[digits])
+			if !ok {
+				break
+			}
+			group = group<<4 | digit
+			digits++
+		}
+		if digits == 0 || digits > 4 {
+			return false
+		}
+		ip[i], ip[i+1] = byte(group>>8), byte(group)
+		i += 2
+		b = b[digits:]
+		if len(b) == 0 {
+			break
+		}
+		if b[0] != ':' || len(b) == 1 {
+			return false
+		}
+		b = b[1:]
+		if b[0] == ':' {
+			if ellipsis >= 0 {
+				return false
+			}
+			ellipsis = i
+			b = b[1:]
+		}
+	}
+	if len(b) != 0 {
+		return false
+	}
+	if i < net.IPv6len {
+		if ellipsis < 0 {
+			return false
+		}
+		n := net.IPv6len - i
+		copy(ip[ellipsis+n:], ip[ellipsis:i])
+		for j := ellipsis; j < ellipsis+n; j++ {
+			ip[j] = 0
+		}
+	} else if ellipsis >= 0 {
+		// The ellipsis stands for one group at least
+		return false
+	}
+	return true
+}
+
+func parseIPv4(b []byte, ip []byte) bool {
+	for i := 0; i < net.IPv4len; i++ {
+		if i > 0 {
+			if len(b) == 0 || b[0] != '.' {
+				return false
+			}
+			b = b[1:]
+		}
+		var n, digits int
+		for digits < len(b) && b[digits] >= '0' && b[digits] <= '9' {
+			n = n*10 + int(b[digits]-'0')
+			digits++
+			if digits > 3 || n > 255 {
+				return false
+			}
+		}
+		// Leading zeros are ambiguous
+		if digits == 0 || digits > 1 && b[0] == '0' {
+			return false
+		}
+		ip[i] = byte(n)
+		b = b[digits:]
+	}
+	return len(b) == 0
+}
@@ -0,0 +1,474 @@
+package conntrack
+
+import (
+	"net"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// sampleLines are events of every kind of tuple and extended field
+var sampleLines = []string{
+	"[1508566165.785132]\t    [NEW] ipv4     2 tcp      6 120 SYN_SENT src=192.168.1.10 dst=1.2.3.4 sport=42216 dport=80 [UNREPLIED] src=1.2.3.4 dst=192.168.0.5 sport=80 dport=42216 mark=0 zone=3 use=1 id=3894123456",
+	"[1508566186.345123]\t[DESTROY] ipv4     2 tcp      6 src=192.168.1.10 dst=1.2.3.4 sport=34277 dport=80 packets=4 bytes=305 src=1.2.3.4 dst=192.168.0.5 sport=80 dport=34277 packets=3 bytes=291 [ASSURED] mark=16 secctx=system_u:object_r:unlabeled_t:s0 use=1 id=12",
+	"[1508566186.345123]\t [UPDATE] ipv4     2 udp      17 30 src=10.0.0.1 dst=8.8.8.8 sport=5353 dport=53 src=8.8.8.8 dst=10.0.0.1 sport=53 dport=5353 labels=foo,bar mark=0 use=1 id=78",
+	"[1508566186.345123]\t [UPDATE] ipv4     2 icmp     1 29 src=10.0.0.1 dst=8.8.8.8 type=8 code=0 id=4455 src=8.8.8.8 dst=10.0.0.1 type=0 code=0 id=4455 mark=0 use=1 id=77",
+	"[1508566186.345123]\t    [NEW] ipv6     10 tcp      6 120 SYN_SENT src=2001:db8::10 dst=2a00:1450:4007:80e::200e sport=51234 dport=443 [UNREPLIED] src=2a00:1450:4007:80e::200e dst=2001:db8::10 sport=443 dport=51234 mark=0 use=1 id=99",
+	"[1508566186.345123]\t    [NEW] ipv6     10 icmpv6   58 29 src=fe80::1 dst=ff02::1 type=128 code=0 id=17 [UNREPLIED] src=ff02::1 dst=fe80::1 type=129 code=0 id=17 id=99",
+	"[1508566186.345123]\t    [NEW] ipv4     2 gre      47 29 src=10.0.0.1 dst=10.0.0.2 srckey=0x0 dstkey=0x1f [UNREPLIED] src=10.0.0.2 dst=10.0.0.1 srckey=0x1f dstkey=0x0 id=100",
+	"[1508566186.345123]\t    [NEW] ipv4     2 sctp     132 10 CLOSED src=10.0.0.1 dst=10.0.0.2 sport=1 dport=2 [UNREPLIED] src=10.0.0.2 dst=10.0.0.1 sport=2 dport=1 zone=7 id=101",
+	"[1508566186.345123]\t[DESTROY] ipv4     2 tcp      6 src=192.168.1.10 dst=1.2.3.4 sport=34277 dport=80 packets=2100000 bytes=3000000000 src=1.2.3.4 dst=192.168.0.5 sport=80 dport=34277 packets=1000000 bytes=40000000 [ASSURED] mark=0 use=1 id=13",
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		line  string
+		check func(flow Flow) bool
+	}{
+		{
+			name: "tcp header",
+			line: sampleLines[0],
+			check: func(flow Flow) bool {
+				return flow.Timestamp == 1508566165785 && flow.Type == "NEW" && flow.Timeout == 120 && flow.State == "SYN_SENT" &&
+					flow.UNREPLIED && !flow.ASSURED && flow.Zone == 3 && flow.Use == 1 && flow.Id == 3894123456 &&
+					flow.Original.Layer3.Protoname == "ipv4" && flow.Original.Layer3.Protonum == 2 &&
+					flow.Reply.Layer4.Protoname == "tcp" && flow.Reply.Layer4.Protonum == 6
+			},
+		},
+		{
+			name: "tcp tuples",
+			line: sampleLines[1],
+			check: func(flow Flow) bool {
+				return flow.Original.Layer3.Src.Equal(net.IP{192, 168, 1, 10}) && flow.Original.Layer3.Dst.Equal(net.IP{1, 2, 3, 4}) &&
+					flow.Original.Layer4.Sport == 34277 && flow.Original.Layer4.Dport == 80 &&
+					flow.Original.Counter == Counter{Packets: 4, Bytes: 305} &&
+					flow.Reply.Layer3.Dst.Equal(net.IP{192, 168, 0, 5}) && flow.Reply.Counter == Counter{Packets: 3, Bytes: 291} &&
+					flow.ASSURED && flow.Mark == 16 && flow.Secctx == "system_u:object_r:unlabeled_t:s0" && flow.Timeout == 0
+			},
+		},
+		{
+			name: "labels",
+			line: sampleLines[2],
+			check: func(flow Flow) bool {
+				return reflect.DeepEqual(flow.Labels, []string{"foo", "bar"})
+			},
+		},
+		{
+			name: "icmp id is not the extended id",
+			line: sampleLines[3],
+			check: func(flow Flow) bool {
+				return flow.Original.Layer4.Icmp != nil && *flow.Original.Layer4.Icmp == Icmp{Type: 8, Code: 0, Id: 4455} &&
+					flow.Reply.Layer4.Icmp != nil && *flow.Reply.Layer4.Icmp == Icmp{Type: 0, Code: 0, Id: 4455} &&
+					flow.Id == 77 && flow.Original.Layer4.Gre == nil
+			},
+		},
+		{
+			name: "icmpv6 followed by the extended id",
+			line: sampleLines[5],
+			check: func(flow Flow) bool {
+				return flow.Original.Layer4.Icmp != nil && flow.Original.Layer4.Icmp.Id == 17 && flow.Reply.Layer4.Icmp.Type == 129 &&
+					flow.Id == 99 && flow.UNREPLIED
+			},
+		},
+		{
+			name: "gre keys",
+			line: sampleLines[6],
+			check: func(flow Flow) bool {
+				return flow.Original.Layer4.Gre != nil && *flow.Original.Layer4.Gre == Gre{SrcKey: 0, DstKey: 0x1f} &&
+					flow.Reply.Layer4.Gre != nil && *flow.Reply.Layer4.Gre == Gre{SrcKey: 0x1f, DstKey: 0} &&
+					flow.Original.Layer4.Icmp == nil && flow.Id == 100
+			},
+		},
+		{
+			name: "sctp state",
+			line: sampleLines[7],
+			check: func(flow Flow) bool {
+				return flow.State == "CLOSED" && flow.Timeout == 10 && flow.Zone == 7 && flow.Original.Layer4.Dport == 2
+			},
+		},
+		{
+			name: "ipv6 compressed",
+			line: sampleLines[4],
+			check: func(flow Flow) bool {
+				return flow.Original.Layer3.Src.Equal(net.ParseIP("2001:db8::10")) &&
+					flow.Original.Layer3.Dst.Equal(net.ParseIP("2a00:1450:4007:80e::200e")) && len(flow.Original.Layer3.Src) == net.IPv6len
+			},
+		},
+		{
+			name: "ipv6 forms",
+			line: "[1508566186.345123]\t    [NEW] ipv6     10 udp      17 30 src=2001:0db8:0000:0000:0000:0000:0000:0001 dst=:: sport=1 dport=2 src=::ffff:192.0.2.1 dst=fe80::a00:27ff:fe4e:66a1 sport=2 dport=1 id=1",
+			check: func(flow Flow) bool {
+				return flow.Original.Layer3.Src.Equal(net.ParseIP("2001:db8::1")) && flow.Original.Layer3.Dst.Equal(net.IPv6unspecified) &&
+					flow.Reply.Layer3.Src.Equal(net.IP{192, 0, 2, 1}) && flow.Reply.Layer3.Dst.Equal(net.ParseIP("fe80::a00:27ff:fe4e:66a1"))
+			},
+		},
+		{
+			name: "ipv6 loopback and trailing zeros",
+			line: "[1508566186.345123]\t    [NEW] ipv6     10 udp      17 30 src=::1 dst=ff02:: sport=1 dport=2 src=ff02:0:0:0:0:0:0:0 dst=0:0:0:0:0:0:0:1 sport=2 dport=1",
+			check: func(flow Flow) bool {
+				return flow.Original.Layer3.Src.Equal(net.IPv6loopback) && flow.Original.Layer3.Dst.Equal(net.ParseIP("ff02::")) &&
+					flow.Reply.Layer3.Src.Equal(net.ParseIP("ff02::")) && flow.Reply.Layer3.Dst.Equal(net.IPv6loopback)
+			},
+		},
+		{
+			name: "hexadecimal mark and delta-time",
+			line: "[1508566186.345123]\t[DESTROY] ipv4     2 udp      17 src=10.0.0.1 dst=10.0.0.2 sport=1 dport=2 src=10.0.0.2 dst=10.0.0.1 sport=2 dport=1 mark=0xff delta-time=3600 id=4294967295",
+			check: func(flow Flow) bool {
+				return flow.Mark == 255 && flow.Deltatime == 3600 && flow.Id == 4294967295
+			},
+		},
+	}
+	for _, test := range tests {
+		flow, err := Parse([]byte(test.line))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !test.check(flow) {
+			t.Errorf("%s: unexpected flow %+v", test.name, flow)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	const header = "[1508566186.345123]\t    [NEW] ipv4     2 tcp      6 120 SYN_SENT "
+	tests := []struct {
+		name string
+		line string
+		err  error
+		// at is the text at the offset of the error, the end of the line when empty
+		at string
+	}{
+		{"empty", "", ErrMissingHeader, ""},
+		{"garbage", "garbage", ErrMissingHeader, "garbage"},
+		{"unterminated timestamp", "[1508566186.345123", ErrMissingHeader, "[1508566186.345123"},
+		{"invalid timestamp", "[1508566186,345123] [NEW] ipv4 2 tcp 6", ErrInvalidNumber, "[1508566186,345123]"},
+		{"missing type", "[1508566186.345123] ipv4 2 tcp 6", ErrMissingHeader, "ipv4"},
+		{"empty type", "[1508566186.345123] [] ipv4 2 tcp 6", ErrMissingHeader, "[]"},
+		{"truncated protocols", "[1508566186.345123]\t    [NEW] ipv4     2 tcp", ErrMissingProtocol, ""},
+		{"tuple instead of protocol", "[1508566186.345123] [NEW] ipv4 2 src=10.0.0.1 dst=10.0.0.2", ErrMissingProtocol, "src=10.0.0.1"},
+		{"invalid protocol number", "[1508566186.345123] [NEW] ipv4 x tcp 6 src=10.0.0.1", ErrInvalidNumber, "x tcp"},
+		{"truncated after the header", header, ErrMissingTuple, ""},
+		{"truncated reply", header + "src=10.0.0.1 dst=10.0.0.2 sport=1 dport=2", ErrMissingTuple, ""},
+		{"invalid ipv4", header + "src=10.0.0 dst=10.0.0.2 sport=1 dport=2", ErrInvalidAddress, "10.0.0 "},
+		{"ipv4 octet overflow", header + "src=10.0.0.256 dst=10.0.0.2 sport=1 dport=2", ErrInvalidAddress, "10.0.0.256"},
+		{"invalid ipv6", header + "src=2001:db8:::1 dst=10.0.0.2 sport=1 dport=2", ErrInvalidAddress, "2001:db8:::1"},
+		{"ipv6 too long", header + "src=1:2:3:4:5:6:7:8:9 dst=10.0.0.2 sport=1 dport=2", ErrInvalidAddress, "1:2:3:4:5:6:7:8:9"},
+		{"invalid port", header + "src=10.0.0.1 dst=10.0.0.2 sport=x dport=2", ErrInvalidNumber, "x dport"},
+		{"negative port", header + "src=10.0.0.1 dst=10.0.0.2 sport=-1 dport=2", ErrInvalidNumber, "-1"},
+		{"invalid gre key", header + "src=10.0.0.1 dst=10.0.0.2 srckey=0xg dstkey=0x1", ErrInvalidNumber, "0xg"},
+		{"gre key overflow", header + "src=10.0.0.1 dst=10.0.0.2 srckey=0x100000000 dstkey=0x1", ErrInvalidNumber, "0x100000000"},
+		{"invalid counter", header + "src=10.0.0.1 dst=10.0.0.2 sport=1 dport=2 packets=1 bytes=1e3", ErrInvalidNumber, "1e3"},
+		{"invalid id", header + "src=10.0.0.1 dst=10.0.0.2 sport=1 dport=2 src=10.0.0.2 dst=10.0.0.1 sport=2 dport=1 id=4294967296", ErrInvalidNumber, "4294967296"},
+		{"invalid mark", header + "src=10.0.0.1 dst=10.0.0.2 sport=1 dport=2 src=10.0.0.2 dst=10.0.0.1 sport=2 dport=1 mark=x", ErrInvalidNumber, "x"},
+	}
+	for _, test := range tests {
+		flow, err := Parse([]byte(test.line))
+		parseError, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("%s: got %v %+v, want a *ParseError", test.name, err, flow)
+			continue
+		}
+		if parseError.Err != test.err {
+			t.Errorf("%s: got %q, want %q", test.name, parseError.Err, test.err)
+		}
+		offset := len(test.line)
+		if test.at != "" {
+			offset = strings.LastIndex(test.line, test.at)
+		}
+		if parseError.Offset != offset {
+			t.Errorf("%s: got offset %d, want %d", test.name, parseError.Offset, offset)
+		}
+		if parseError.Line != strings.TrimSpace(test.line) {
+			t.Errorf("%s: got line %q", test.name, parseError.Line)
+		}
+	}
+}
+
+// TestParseRegexParity compares Parse with the former regular expression parser
+func TestParseRegexParity(t *testing.T) {
+	for _, line := range sampleLines {
+		want := flowParseRegex(line)
+		got, err := Parse([]byte(line))
+		if err != nil {
+			t.Errorf("%s: %s", line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s:\n got %+v\nwant %+v", line, got, want)
+		}
+	}
+}
+
+func TestParseLargeCounter(t *testing.T) {
+	// The DESTROY of a 3 GB download
+	line := "[1508566186.345123]\t[DESTROY] ipv4     2 tcp      6 src=192.168.1.10 dst=1.2.3.4 sport=34277 dport=80 packets=2100000 bytes=3000000000 src=1.2.3.4 dst=192.168.0.5 sport=80 dport=34277 packets=18446744073709551615 bytes=18446744073709551615 [ASSURED] mark=0 use=1 id=12"
+	flow, err := Parse([]byte(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flow.Original.Counter != (Counter{Packets: 2100000, Bytes: 3000000000}) {
+		t.Errorf("original counter: got %+v", flow.Original.Counter)
+	}
+	if flow.Reply.Counter != (Counter{Packets: 1<<64 - 1, Bytes: 1<<64 - 1}) {
+		t.Errorf("reply counter: got %+v", flow.Reply.Counter)
+	}
+
+	_, err = Parse([]byte("[1508566186.345123]\t[DESTROY] ipv4     2 tcp      6 src=192.168.1.10 dst=1.2.3.4 sport=34277 dport=80 packets=1 bytes=18446744073709551616 src=1.2.3.4 dst=192.168.0.5 sport=80 dport=34277"))
+	if parseError, ok := err.(*ParseError); !ok || parseError.Err != ErrInvalidNumber {
+		t.Errorf("overflowing counter: got %v, want %v", err, ErrInvalidNumber)
+	}
+}
+
+func benchmarkLines() [][]byte {
+	var lines [][]byte
+	for _, line := range sampleLines {
+		lines = append(lines, []byte(line))
+	}
+	return lines
+}
+
+func BenchmarkParseRegex(b *testing.B) {
+	lines := sampleLines
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		flowParseRegex(lines[i%len(lines)])
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	lines := benchmarkLines()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Parse(lines[i%len(lines)])
+	}
+}
+
+// The former regular expression parser, the baseline of the parity test and of the benchmark
+const conntrackFlowRegex = `\[(?P<timestamp>\d+\.\d+)(?:\s+)?\]\s+\[(?P<type>\w+)\]\s+(?P<protoname3>\w+)\s+(?P<protonum3>\d+)\s+(?P<protoname4>\w+)\s+(?P<protonum4>\d+)\s+(?:(?P<timeout>\d+)\s+)?(?:(?P<state>[A-Z][A-Z0-9_]*)\s+)?`
+const conntrackOriginalRegex = `(?:.*?)src=(?P<originalSrc>\S+)\s+dst=(?P<originalDst>\S+)\s+(?:sport=(?P<originalSport>\d+)\s+dport=(?P<originalDport>\d+)\s+|type=(?P<originalIcmpType>\d+)\s+code=(?P<originalIcmpCode>\d+)\s+id=(?P<originalIcmpId>\d+)(?:\s+|$)|srckey=(?P<originalSrckey>0x[[:xdigit:]]+)\s+dstkey=(?P<originalDstkey>0x[[:xdigit:]]+)(?:\s+|$))?(?:packets=(?P<originalPackets>\d+)\s+bytes=(?P<originalBytes>\d+))?`
+const conntrackReplyRegex = `(?:.*?)src=(?P<replySrc>\S+)\s+dst=(?P<replyDst>\S+)\s+(?:sport=(?P<replySport>\d+)\s+dport=(?P<replyDport>\d+)\s+|type=(?P<replyIcmpType>\d+)\s+code=(?P<replyIcmpCode>\d+)\s+id=(?P<replyIcmpId>\d+)(?:\s+|$)|srckey=(?P<replySrckey>0x[[:xdigit:]]+)\s+dstkey=(?P<replyDstkey>0x[[:xdigit:]]+)(?:\s+|$))?(?:packets=(?P<replyPackets>\d+)\s+bytes=(?P<replyBytes>\d+))?`
+
+var conntrackRegexCompiled = regexp.MustCompile(conntrackFlowRegex + conntrackOriginalRegex + conntrackReplyRegex)
+
+// Keys that can appear inside an original or reply tuple
+var conntrackTupleKeys = map[string]bool{
+	"src":        true,
+	"dst":        true,
+	"sport":      true,
+	"dport":      true,
+	"type":       true,
+	"code":       true,
+	"id":         true,
+	"srckey":     true,
+	"dstkey":     true,
+	"key":        true,
+	"packets":    true,
+	"bytes":      true,
+	"zone-orig":  true,
+	"zone-reply": true,
+}
+
+func flowParseRegex(str string) Flow {
+	var flow = Flow{}
+	flow.Original = Meta{}
+	flow.Original.Layer3 = Layer3{}
+	flow.Original.Layer4 = Layer4{}
+	flow.Original.Counter = Counter{}
+	flow.Reply = Meta{}
+	flow.Reply.Layer3 = Layer3{}
+	flow.Reply.Layer4 = Layer4{}
+	flow.Reply.Counter = Counter{}
+
+	result := conntrackRegexCompiled.FindStringSubmatch(str)
+	names := conntrackRegexCompiled.SubexpNames()
+	for i, match := range result {
+		if i != 0 {
+			switch names[i] {
+			case "timestamp":
+				// Timestamp in second with float
+				timestamp, _ := strconv.ParseFloat(match, 64)
+				// Timestamp in milliseconds
+				flow.Timestamp = int64(timestamp * 1000)
+				break
+			case "type":
+				flow.Type = match
+				break
+			case "timeout":
+				flow.Timeout, _ = strconv.Atoi(match)
+				break
+			case "state":
+				flow.State = match
+				break
+			case "protoname3":
+				flow.Original.Layer3.Protoname = match
+				flow.Reply.Layer3.Protoname = match
+				break
+			case "protonum3":
+				flow.Original.Layer3.Protonum, _ = strconv.Atoi(match)
+				flow.Reply.Layer3.Protonum, _ = strconv.Atoi(match)
+				break
+			case "protoname4":
+				flow.Original.Layer4.Protoname = match
+				flow.Reply.Layer4.Protoname = match
+				break
+			case "protonum4":
+				flow.Original.Layer4.Protonum, _ = strconv.Atoi(match)
+				flow.Reply.Layer4.Protonum, _ = strconv.Atoi(match)
+				break
+			case "originalSrc":
+				flow.Original.Layer3.Src = net.ParseIP(match)
+				break
+			case "originalDst":
+				flow.Original.Layer3.Dst = net.ParseIP(match)
+				break
+			case "originalSport":
+				flow.Original.Layer4.Sport, _ = strconv.Atoi(match)
+				break
+			case "originalDport":
+				flow.Original.Layer4.Dport, _ = strconv.Atoi(match)
+				break
+			case "originalIcmpType":
+				if match != "" {
+					flow.Original.Layer4.icmp().Type, _ = strconv.Atoi(match)
+				}
+				break
+			case "originalIcmpCode":
+				if match != "" {
+					flow.Original.Layer4.icmp().Code, _ = strconv.Atoi(match)
+				}
+				break
+			case "originalIcmpId":
+				if match != "" {
+					flow.Original.Layer4.icmp().Id, _ = strconv.Atoi(match)
+				}
+				break
+			case "originalSrckey":
+				if match != "" {
+					key, _ := strconv.ParseUint(match, 0, 32)
+					flow.Original.Layer4.gre().SrcKey = uint32(key)
+				}
+				break
+			case "originalDstkey":
+				if match != "" {
+					key, _ := strconv.ParseUint(match, 0, 32)
+					flow.Original.Layer4.gre().DstKey = uint32(key)
+				}
+				break
+			case "originalPackets":
+				flow.Original.Counter.Packets, _ = strconv.ParseUint(match, 10, 64)
+				break
+			case "originalBytes":
+				flow.Original.Counter.Bytes, _ = strconv.ParseUint(match, 10, 64)
+				break
+			case "replySrc":
+				flow.Reply.Layer3.Src = net.ParseIP(match)
+				break
+			case "replyDst":
+				flow.Reply.Layer3.Dst = net.ParseIP(match)
+				break
+			case "replySport":
+				flow.Reply.Layer4.Sport, _ = strconv.Atoi(match)
+				break
+			case "replyDport":
+				flow.Reply.Layer4.Dport, _ = strconv.Atoi(match)
+				break
+			case "replyIcmpType":
+				if match != "" {
+					flow.Reply.Layer4.icmp().Type, _ = strconv.Atoi(match)
+				}
+				break
+			case "replyIcmpCode":
+				if match != "" {
+					flow.Reply.Layer4.icmp().Code, _ = strconv.Atoi(match)
+				}
+				break
+			case "replyIcmpId":
+				if match != "" {
+					flow.Reply.Layer4.icmp().Id, _ = strconv.Atoi(match)
+				}
+				break
+			case "replySrckey":
+				if match != "" {
+					key, _ := strconv.ParseUint(match, 0, 32)
+					flow.Reply.Layer4.gre().SrcKey = uint32(key)
+				}
+				break
+			case "replyDstkey":
+				if match != "" {
+					key, _ := strconv.ParseUint(match, 0, 32)
+					flow.Reply.Layer4.gre().DstKey = uint32(key)
+				}
+				break
+			case "replyPackets":
+				flow.Reply.Counter.Packets, _ = strconv.ParseUint(match, 10, 64)
+				break
+			case "replyBytes":
+				flow.Reply.Counter.Bytes, _ = strconv.ParseUint(match, 10, 64)
+				break
+			}
+
+		}
+	}
+	if len(result) != 0 {
+		flowParseExtended(str, &flow)
+	}
+
+	return flow
+}
+
+// flowParseExtended reads flags and the fields following the tuples
+func flowParseExtended(str string, flow *Flow) {
+	inTuple := false
+	tupleKeys := make(map[string]bool)
+	for _, field := range strings.Fields(str) {
+		switch field {
+		case "[UNREPLIED]":
+			flow.UNREPLIED = true
+			inTuple = false
+			continue
+		case "[ASSURED]":
+			flow.ASSURED = true
+			inTuple = false
+			continue
+		}
+		i := strings.IndexByte(field, '=')
+		if i < 0 {
+			continue
+		}
+		key, value := field[:i], field[i+1:]
+		if key == "src" {
+			inTuple = true
+			tupleKeys = make(map[string]bool)
+		}
+		// ICMP tuples have an id too, after their type and code
+		isTupleKey := conntrackTupleKeys[key] && (key != "id" || tupleKeys["code"])
+		if inTuple && isTupleKey && !tupleKeys[key] {
+			tupleKeys[key] = true
+			continue
+		}
+		inTuple = false
+		switch key {
+		case "id":
+			id, _ := strconv.ParseUint(value, 10, 32)
+			flow.Id = uint32(id)
+		case "mark":
+			mark, _ := strconv.ParseUint(value, 0, 32)
+			flow.Mark = uint32(mark)
+		case "zone":
+			flow.Zone, _ = strconv.Atoi(value)
+		case "use":
+			flow.Use, _ = strconv.Atoi(value)
+		case "secctx":
+			flow.Secctx = value
+		case "delta-time":
+			flow.Deltatime, _ = strconv.ParseInt(value, 10, 64)
+		case "labels":
+			flow.Labels = strings.Split(value, ",")
+		}
+	}
+}
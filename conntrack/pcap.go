@@ -0,0 +1,486 @@
+package conntrack
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/sys/unix"
+)
+
+// File magics, see https://www.tcpdump.org/manpages/pcap-savefile.5.html and the pcapng draft
+const (
+	pcapMagicMicro       = 0xa1b2c3d4
+	pcapMagicNano        = 0xa1b23c4d
+	pcapngSectionHeader  = 0x0a0d0d0a
+	pcapngByteOrderMagic = 0x1a2b3c4d
+
+	pcapngInterfaceDescription = 1
+	pcapngPacket               = 2
+	pcapngSimplePacket         = 3
+	pcapngEnhancedPacket       = 6
+
+	pcapngOptionEnd      = 0
+	pcapngOptionTsresol  = 9
+	pcapngOptionTsoffset = 14
+
+	// pcapMaxRecord bounds the memory a corrupted length can allocate
+	pcapMaxRecord = 16 << 20
+)
+
+// Link types, see https://www.tcpdump.org/linktypes.html
+const (
+	linktypeNull      = 0
+	linktypeEthernet  = 1
+	linktypeRaw       = 101
+	linktypeLoop      = 108
+	linktypeLinuxSLL  = 113
+	linktypeIPv4      = 228
+	linktypeIPv6      = 229
+	linktypeLinuxSLL2 = 276
+)
+
+// pcapRecord is a captured packet, data is only valid until the next read
+type pcapRecord struct {
+	timestamp int64 // microseconds
+	linktype  int
+	data      []byte
+}
+
+// pcapReader reads the packets of a pcap or a pcapng file, io.EOF ends the capture
+type pcapReader interface {
+	next() (pcapRecord, error)
+}
+
+// newPcapReader detects the file format from its first block
+func newPcapReader(r io.Reader) (pcapReader, error) {
+	reader := bufio.NewReaderSize(r, 1<<16)
+	magic, err := reader.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("pcap: %s", err)
+	}
+	if binary.BigEndian.Uint32(magic) == pcapngSectionHeader {
+		return &pcapngReader{reader: reader}, nil
+	}
+
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("pcap: %s", err)
+	}
+	pcap := &pcapFileReader{reader: reader}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(header[0:4]) {
+		case pcapMagicMicro:
+			pcap.order = order
+		case pcapMagicNano:
+			pcap.order = order
+			pcap.nano = true
+		}
+	}
+	if pcap.order == nil {
+		return nil, fmt.Errorf("pcap: unknown file format")
+	}
+	// The FCS length may be stored in the upper bits
+	pcap.linktype = int(pcap.order.Uint32(header[20:24]) & 0x0fffffff)
+	return pcap, nil
+}
+
+// pcapFileReader reads the classic libpcap format
+type pcapFileReader struct {
+	reader   *bufio.Reader
+	order    binary.ByteOrder
+	nano     bool
+	linktype int
+	header   [16]byte
+	buffer   []byte
+}
+
+func (r *pcapFileReader) next() (pcapRecord, error) {
+	if _, err := io.ReadFull(r.reader, r.header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			// The capture was cut while writing
+			return pcapRecord{}, io.EOF
+		}
+		return pcapRecord{}, err
+	}
+	length := r.order.Uint32(r.header[8:12])
+	if length > pcapMaxRecord {
+		return pcapRecord{}, fmt.Errorf("pcap: invalid record length %d", length)
+	}
+	r.buffer = grow(r.buffer, int(length))
+	if _, err := io.ReadFull(r.reader, r.buffer); err != nil {
+		return pcapRecord{}, io.EOF
+	}
+	fraction := int64(r.order.Uint32(r.header[4:8]))
+	if r.nano {
+		fraction /= 1000
+	}
+	return pcapRecord{
+		timestamp: int64(r.order.Uint32(r.header[0:4]))*1000000 + fraction,
+		linktype:  r.linktype,
+		data:      r.buffer,
+	}, nil
+}
+
+// pcapngInterface holds the interface description needed to read its packets
+type pcapngInterface struct {
+	linktype int
+	snaplen  int
+	// units is the number of timestamp units per second
+	units  uint64
+	offset int64
+}
+
+// pcapngReader reads the pcapng format, other blocks than packets and interfaces are skipped
+type pcapngReader struct {
+	reader     *bufio.Reader
+	order      binary.ByteOrder
+	interfaces []pcapngInterface
+	last       int64
+	header     [8]byte
+	buffer     []byte
+}
+
+func (r *pcapngReader) next() (pcapRecord, error) {
+	for {
+		if _, err := io.ReadFull(r.reader, r.header[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return pcapRecord{}, io.EOF
+			}
+			return pcapRecord{}, err
+		}
+		// Each section sets its byte order
+		blockType := binary.BigEndian.Uint32(r.header[0:4])
+		if blockType == pcapngSectionHeader {
+			magic, err := r.reader.Peek(4)
+			if err != nil {
+				return pcapRecord{}, io.EOF
+			}
+			switch {
+			case binary.LittleEndian.Uint32(magic) == pcapngByteOrderMagic:
+				r.order = binary.LittleEndian
+			case binary.BigEndian.Uint32(magic) == pcapngByteOrderMagic:
+				r.order = binary.BigEndian
+			default:
+				return pcapRecord{}, fmt.Errorf("pcapng: invalid byte order magic")
+			}
+			r.interfaces = r.interfaces[:0]
+		} else if r.order == nil {
+			return pcapRecord{}, fmt.Errorf("pcapng: missing section header")
+		} else {
+			blockType = r.order.Uint32(r.header[0:4])
+		}
+
+		length := r.order.Uint32(r.header[4:8])
+		if length < 12 || length%4 != 0 || length > pcapMaxRecord {
+			return pcapRecord{}, fmt.Errorf("pcapng: invalid block length %d", length)
+		}
+		r.buffer = grow(r.buffer, int(length)-8)
+		if _, err := io.ReadFull(r.reader, r.buffer); err != nil {
+			return pcapRecord{}, io.EOF
+		}
+		// The body is followed by the repeated block length
+		body := r.buffer[:len(r.buffer)-4]
+
+		switch blockType {
+		case pcapngInterfaceDescription:
+			if len(body) < 8 {
+				return pcapRecord{}, fmt.Errorf("pcapng: invalid interface description")
+			}
+			r.interfaces = append(r.interfaces, r.interfaceDescription(body))
+		case pcapngEnhancedPacket, pcapngPacket:
+			if len(body) < 20 {
+				return pcapRecord{}, fmt.Errorf("pcapng: invalid packet block")
+			}
+			id := int(r.order.Uint32(body[0:4]))
+			if blockType == pcapngPacket {
+				id = int(r.order.Uint16(body[0:2]))
+			}
+			if id >= len(r.interfaces) {
+				return pcapRecord{}, fmt.Errorf("pcapng: unknown interface %d", id)
+			}
+			iface := &r.interfaces[id]
+			units := uint64(r.order.Uint32(body[4:8]))<<32 | uint64(r.order.Uint32(body[8:12]))
+			length := int(r.order.Uint32(body[12:16]))
+			if length > len(body)-20 {
+				return pcapRecord{}, fmt.Errorf("pcapng: invalid captured length %d", length)
+			}
+			r.last = microseconds(units, iface.units) + iface.offset
+			return pcapRecord{timestamp: r.last, linktype: iface.linktype, data: body[20 : 20+length]}, nil
+		case pcapngSimplePacket:
+			// Simple packets have no timestamp, they belong to the first interface
+			if len(body) < 4 || len(r.interfaces) == 0 {
+				return pcapRecord{}, fmt.Errorf("pcapng: invalid simple packet block")
+			}
+			iface := &r.interfaces[0]
+			length := int(r.order.Uint32(body[0:4]))
+			if iface.snaplen > 0 && length > iface.snaplen {
+				length = iface.snaplen
+			}
+			if length > len(body)-4 {
+				length = len(body) - 4
+			}
+			return pcapRecord{timestamp: r.last, linktype: iface.linktype, data: body[4 : 4+length]}, nil
+		}
+	}
+}
+
+// interfaceDescription reads the link type and the timestamp options of an interface
+func (r *pcapngReader) interfaceDescription(body []byte) pcapngInterface {
+	iface := pcapngInterface{
+		linktype: int(r.order.Uint16(body[0:2])),
+		snaplen:  int(r.order.Uint32(body[4:8])),
+		units:    1000000,
+	}
+	options := body[8:]
+	for len(options) >= 4 {
+		code := r.order.Uint16(options[0:2])
+		length := int(r.order.Uint16(options[2:4]))
+		if code == pcapngOptionEnd || 4+length > len(options) {
+			break
+		}
+		value := options[4 : 4+length]
+		switch {
+		case code == pcapngOptionTsresol && length == 1:
+			// The most significant bit tells a power of 2 from a power of 10
+			exponent := uint(value[0] & 0x7f)
+			if value[0]&0x80 != 0 && exponent < 64 {
+				iface.units = 1 << exponent
+			} else if value[0]&0x80 == 0 && exponent <= 19 {
+				iface.units = 1
+				for i := uint(0); i < exponent; i++ {
+					iface.units *= 10
+				}
+			}
+		case code == pcapngOptionTsoffset && length == 8:
+			iface.offset = int64(r.order.Uint64(value)) * 1000000
+		}
+		options = options[4+(length+3)&^3:]
+	}
+	return iface
+}
+
+// microseconds converts a timestamp counted in units per second, the fraction would overflow once multiplied first
+func microseconds(timestamp, units uint64) int64 {
+	fraction := timestamp % units
+	if units%1000000 == 0 {
+		fraction /= units / 1000000
+	} else {
+		// Other resolutions are powers of 2, or powers of 10 below the microsecond
+		divisor := units
+		for divisor > 1<<44 {
+			fraction >>= 1
+			divisor >>= 1
+		}
+		fraction = fraction * 1000000 / divisor
+	}
+	return int64(timestamp/units)*1000000 + int64(fraction)
+}
+
+// grow returns a slice of the given length, reusing buffer when it is large enough
+func grow(buffer []byte, length int) []byte {
+	if cap(buffer) < length {
+		return make([]byte, length)
+	}
+	return buffer[:length]
+}
+
+// pcapPacket holds the fields of an IP packet needed to track its connection
+type pcapPacket struct {
+	family   int
+	protocol int
+	src, dst [16]byte
+	sport    int
+	dport    int
+	// icmp is set for icmp and icmpv6 packets
+	icmp     bool
+	icmpType int
+	icmpCode int
+	icmpId   int
+	tcpFlags byte
+	// length counts the bytes from the IP header like the conntrack counters
+	length int
+	// fragmented is set for the fragments of a datagram, told apart by fragmentId
+	fragmented bool
+	fragmentId uint32
+	// trailing fragments have no transport header, their length only counts their payload
+	trailing bool
+	more     bool
+}
+
+// TCP flags
+const (
+	tcpFin = 0x01
+	tcpSyn = 0x02
+	tcpRst = 0x04
+	tcpAck = 0x10
+)
+
+// Ether types
+const (
+	etherTypeIPv4  = 0x0800
+	etherTypeIPv6  = 0x86dd
+	etherTypeVLAN  = 0x8100
+	etherTypeQinQ  = 0x88a8
+	etherTypeVLAN2 = 0x9100
+)
+
+// decodePacket reads the IP packet of a captured frame, it returns false for other frames
+func decodePacket(linktype int, data []byte, packet *pcapPacket) bool {
+	switch linktype {
+	case linktypeEthernet:
+		if len(data) < 14 {
+			return false
+		}
+		etherType := binary.BigEndian.Uint16(data[12:14])
+		data = data[14:]
+		for etherType == etherTypeVLAN || etherType == etherTypeQinQ || etherType == etherTypeVLAN2 {
+			if len(data) < 4 {
+				return false
+			}
+			etherType = binary.BigEndian.Uint16(data[2:4])
+			data = data[4:]
+		}
+		if etherType != etherTypeIPv4 && etherType != etherTypeIPv6 {
+			return false
+		}
+	case linktypeLinuxSLL:
+		if len(data) < 16 {
+			return false
+		}
+		data = data[16:]
+	case linktypeLinuxSLL2:
+		if len(data) < 20 {
+			return false
+		}
+		data = data[20:]
+	case linktypeNull, linktypeLoop:
+		// The address family is in the byte order of the capturing host, the IP version tells anyway
+		if len(data) < 4 {
+			return false
+		}
+		data = data[4:]
+	case linktypeRaw, linktypeIPv4, linktypeIPv6:
+	default:
+		return false
+	}
+	return decodeIP(data, packet)
+}
+
+func decodeIP(data []byte, packet *pcapPacket) bool {
+	if len(data) < 1 {
+		return false
+	}
+	*packet = pcapPacket{}
+	var payload []byte
+	switch data[0] >> 4 {
+	case 4:
+		headerLength := int(data[0]&0x0f) * 4
+		if len(data) < 20 || headerLength < 20 || len(data) < headerLength {
+			return false
+		}
+		packet.family = unix.AF_INET
+		packet.length = int(binary.BigEndian.Uint16(data[2:4]))
+		packet.protocol = int(data[9])
+		copy(packet.src[:], data[12:16])
+		copy(packet.dst[:], data[16:20])
+		// Only the first fragment holds the ports, the tracker accounts the others to its connection
+		fragment := binary.BigEndian.Uint16(data[6:8])
+		if fragment&0x3fff != 0 {
+			packet.fragmented = true
+			packet.fragmentId = uint32(binary.BigEndian.Uint16(data[4:6]))
+			packet.more = fragment&0x2000 != 0
+			if fragment&0x1fff != 0 {
+				packet.trailing = true
+				packet.length -= headerLength
+				return packet.length > 0
+			}
+		}
+		end := packet.length
+		if end > len(data) || end < headerLength {
+			end = len(data)
+		}
+		payload = data[headerLength:end]
+	case 6:
+		if len(data) < 40 {
+			return false
+		}
+		packet.family = unix.AF_INET6
+		packet.length = 40 + int(binary.BigEndian.Uint16(data[4:6]))
+		copy(packet.src[:], data[8:24])
+		copy(packet.dst[:], data[24:40])
+		next := data[6]
+		payload = data[40:]
+		// Skip the extension headers
+		for {
+			var length int
+			switch next {
+			case 0, 43, 60: // hop-by-hop, routing, destination options
+				if len(payload) < 2 {
+					return false
+				}
+				length = (int(payload[1]) + 1) * 8
+			case 44: // fragment
+				if len(payload) < 8 {
+					return false
+				}
+				fragment := binary.BigEndian.Uint16(payload[2:4])
+				packet.fragmented = true
+				packet.fragmentId = binary.BigEndian.Uint32(payload[4:8])
+				packet.more = fragment&1 != 0
+				if fragment&0xfff8 != 0 {
+					packet.trailing = true
+					packet.protocol = int(payload[0])
+					packet.length -= len(data) - len(payload) + 8
+					return packet.length > 0
+				}
+				// The reassembled datagram has no fragment header
+				packet.length -= 8
+				length = 8
+			case 51: // authentication header
+				if len(payload) < 2 {
+					return false
+				}
+				length = (int(payload[1]) + 2) * 4
+			default:
+				length = -1
+			}
+			if length < 0 {
+				break
+			}
+			if len(payload) < length {
+				return false
+			}
+			next = payload[0]
+			payload = payload[length:]
+		}
+		packet.protocol = int(next)
+	default:
+		return false
+	}
+
+	switch packet.protocol {
+	case 6: // tcp
+		if len(payload) < 14 {
+			return false
+		}
+		packet.tcpFlags = payload[13]
+		fallthrough
+	case 17, 33, 132, 136: // udp, dccp, sctp, udplite
+		if len(payload) < 4 {
+			return false
+		}
+		packet.sport = int(binary.BigEndian.Uint16(payload[0:2]))
+		packet.dport = int(binary.BigEndian.Uint16(payload[2:4]))
+	case 1, 58: // icmp, icmpv6
+		if len(payload) < 8 {
+			return false
+		}
+		packet.icmp = true
+		packet.icmpType = int(payload[0])
+		packet.icmpCode = int(payload[1])
+		packet.icmpId = int(binary.BigEndian.Uint16(payload[4:6]))
+	}
+	return true
+}
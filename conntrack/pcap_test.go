@@ -0,0 +1,376 @@
+package conntrack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// capturePacket is a captured frame, at is in microseconds
+type capturePacket struct {
+	at   int64
+	data []byte
+}
+
+func ipv4Packet(protocol uint8, src, dst string, id, fragment uint16, payload []byte) []byte {
+	b := make([]byte, 20, 20+len(payload))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(20+len(payload)))
+	binary.BigEndian.PutUint16(b[4:6], id)
+	binary.BigEndian.PutUint16(b[6:8], fragment)
+	b[8] = 64
+	b[9] = protocol
+	copy(b[12:16], net.ParseIP(src).To4())
+	copy(b[16:20], net.ParseIP(dst).To4())
+	return append(b, payload...)
+}
+
+func ipv6Packet(next uint8, src, dst string, payload []byte) []byte {
+	b := make([]byte, 40, 40+len(payload))
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(payload)))
+	b[6] = next
+	b[7] = 64
+	copy(b[8:24], net.ParseIP(src))
+	copy(b[24:40], net.ParseIP(dst))
+	return append(b, payload...)
+}
+
+// ipv6Fragment builds a fragment extension header, offset counts 8 bytes blocks
+func ipv6Fragment(next uint8, offset uint16, more bool, id uint32, payload []byte) []byte {
+	b := make([]byte, 8, 8+len(payload))
+	b[0] = next
+	fragment := offset << 3
+	if more {
+		fragment |= 1
+	}
+	binary.BigEndian.PutUint16(b[2:4], fragment)
+	binary.BigEndian.PutUint32(b[4:8], id)
+	return append(b, payload...)
+}
+
+func tcpSegment(sport, dport uint16, flags byte, length int) []byte {
+	b := make([]byte, 20+length)
+	binary.BigEndian.PutUint16(b[0:2], sport)
+	binary.BigEndian.PutUint16(b[2:4], dport)
+	b[12] = 0x50
+	b[13] = flags
+	return b
+}
+
+func udpDatagram(sport, dport uint16, length int) []byte {
+	b := make([]byte, 8+length)
+	binary.BigEndian.PutUint16(b[0:2], sport)
+	binary.BigEndian.PutUint16(b[2:4], dport)
+	binary.BigEndian.PutUint16(b[4:6], uint16(8+length))
+	return b
+}
+
+func icmpMessage(icmpType uint8, id, sequence uint16, length int) []byte {
+	b := make([]byte, 8+length)
+	b[0] = icmpType
+	binary.BigEndian.PutUint16(b[4:6], id)
+	binary.BigEndian.PutUint16(b[6:8], sequence)
+	return b
+}
+
+// trackPackets runs the tracker over raw IP packets and returns its events
+func trackPackets(packets []capturePacket) []Flow {
+	var flows []Flow
+	tracker := newPcapTracker(func(flow Flow) bool {
+		flows = append(flows, flow)
+		return true
+	})
+	var packet pcapPacket
+	now := int64(0)
+	for _, p := range packets {
+		if !decodePacket(linktypeRaw, p.data, &packet) {
+			continue
+		}
+		now = p.at
+		tracker.track(now, &packet)
+	}
+	tracker.flush(now)
+	return flows
+}
+
+func TestPcapFragments(t *testing.T) {
+	// A datagram of 3000 bytes split in 3 fragments of 1480, 1480 and 48 bytes
+	datagram := udpDatagram(5000, 53, 3000)
+	ipv4 := []capturePacket{
+		{1000000, ipv4Packet(unix.IPPROTO_UDP, "10.0.0.1", "10.0.0.2", 7, 0x2000, datagram[:1480])},
+		{1000001, ipv4Packet(unix.IPPROTO_UDP, "10.0.0.1", "10.0.0.2", 7, 0x2000|185, datagram[1480:2960])},
+		// A fragment of an unknown datagram
+		{1000002, ipv4Packet(unix.IPPROTO_UDP, "10.0.0.1", "10.0.0.2", 8, 185, datagram[1480:2960])},
+		{1000003, ipv4Packet(unix.IPPROTO_UDP, "10.0.0.1", "10.0.0.2", 7, 370, datagram[2960:])},
+		// The datagram is complete, a duplicate of its last fragment isn't counted
+		{1000004, ipv4Packet(unix.IPPROTO_UDP, "10.0.0.1", "10.0.0.2", 7, 370, datagram[2960:])},
+	}
+	ipv6 := []capturePacket{
+		{1000000, ipv6Packet(44, "2001:db8::1", "2001:db8::2", ipv6Fragment(unix.IPPROTO_UDP, 0, true, 0x12345678, datagram[:1480]))},
+		{1000001, ipv6Packet(44, "2001:db8::1", "2001:db8::2", ipv6Fragment(unix.IPPROTO_UDP, 185, true, 0x12345678, datagram[1480:2960]))},
+		{1000002, ipv6Packet(44, "2001:db8::1", "2001:db8::2", ipv6Fragment(unix.IPPROTO_UDP, 185, true, 0x9999, datagram[1480:2960]))},
+		{1000003, ipv6Packet(44, "2001:db8::1", "2001:db8::2", ipv6Fragment(unix.IPPROTO_UDP, 370, false, 0x12345678, datagram[2960:]))},
+	}
+	tests := []struct {
+		name    string
+		packets []capturePacket
+		want    Counter
+	}{
+		// Conntrack counts the reassembled datagram, as a single packet
+		{"ipv4", ipv4, Counter{Packets: 1, Bytes: 20 + 3008}},
+		{"ipv6", ipv6, Counter{Packets: 1, Bytes: 40 + 3008}},
+	}
+	for _, test := range tests {
+		flows := trackPackets(test.packets)
+		if len(flows) != 2 || flows[0].Type != "NEW" || flows[1].Type != "DESTROY" {
+			t.Fatalf("%s: got %+v, want a NEW and a DESTROY", test.name, flows)
+		}
+		if flows[1].Original.Layer4.Sport != 5000 || flows[1].Original.Layer4.Dport != 53 {
+			t.Errorf("%s: got ports %d %d", test.name, flows[1].Original.Layer4.Sport, flows[1].Original.Layer4.Dport)
+		}
+		if counter := flows[1].Original.Counter; counter != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, counter, test.want)
+		}
+	}
+}
+
+func TestMicroseconds(t *testing.T) {
+	tests := []struct {
+		timestamp, units uint64
+		want             int64
+	}{
+		{1500000000123456, 1000000, 1500000000123456},
+		{1500000000123456789, 1000000000, 1500000000123456},
+		// The fraction of a second times a million overflows 64 bits
+		{9876543210123456789, 10000000000000000000, 987654},
+		{15000001, 10, 1500000100000},
+		{1500000000<<32 | 1<<31, 1 << 32, 1500000000500000},
+		{1<<62 | 1<<61, 1 << 62, 1500000},
+		{1<<63 - 1, 1 << 63, 999999},
+	}
+	for _, test := range tests {
+		if got := microseconds(test.timestamp, test.units); got != test.want {
+			t.Errorf("%d/%d: got %d, want %d", test.timestamp, test.units, got, test.want)
+		}
+	}
+}
+
+func etherFrame(ip []byte, vlans ...uint16) []byte {
+	b := make([]byte, 12, 18+4*len(vlans)+len(ip))
+	for _, vlan := range vlans {
+		b = append(b, 0x81, 0x00, byte(vlan>>8), byte(vlan))
+	}
+	etherType := []byte{0x08, 0x00}
+	if ip[0]>>4 == 6 {
+		etherType = []byte{0x86, 0xdd}
+	}
+	b = append(b, etherType...)
+	return append(b, ip...)
+}
+
+// sllFrame builds a Linux cooked capture header, like tcpdump -i any writes
+func sllFrame(ip []byte) []byte {
+	b := make([]byte, 16, 16+len(ip))
+	binary.BigEndian.PutUint16(b[2:4], 1)
+	binary.BigEndian.PutUint16(b[4:6], 6)
+	binary.BigEndian.PutUint16(b[14:16], etherTypeIPv4)
+	if ip[0]>>4 == 6 {
+		binary.BigEndian.PutUint16(b[14:16], etherTypeIPv6)
+	}
+	return append(b, ip...)
+}
+
+// pcapCapture writes a little endian pcap file, with nanosecond timestamps if nano is set
+func pcapCapture(linktype uint32, nano bool, packets []capturePacket) []byte {
+	magic := uint32(pcapMagicMicro)
+	if nano {
+		magic = pcapMagicNano
+	}
+	b := make([]byte, 24)
+	binary.LittleEndian.PutUint32(b[0:4], magic)
+	binary.LittleEndian.PutUint16(b[4:6], 2)
+	binary.LittleEndian.PutUint16(b[6:8], 4)
+	binary.LittleEndian.PutUint32(b[16:20], 65535)
+	binary.LittleEndian.PutUint32(b[20:24], linktype)
+	for _, packet := range packets {
+		header := make([]byte, 16)
+		fraction := packet.at % 1000000
+		if nano {
+			fraction *= 1000
+		}
+		binary.LittleEndian.PutUint32(header[0:4], uint32(packet.at/1000000))
+		binary.LittleEndian.PutUint32(header[4:8], uint32(fraction))
+		binary.LittleEndian.PutUint32(header[8:12], uint32(len(packet.data)))
+		binary.LittleEndian.PutUint32(header[12:16], uint32(len(packet.data)))
+		b = append(append(b, header...), packet.data...)
+	}
+	return b
+}
+
+// pcapngBlock writes a little endian block, the body is padded to 32 bits
+func pcapngBlock(blockType uint32, body []byte) []byte {
+	body = append(body, make([]byte, -len(body)&3)...)
+	b := make([]byte, 8, 12+len(body))
+	binary.LittleEndian.PutUint32(b[0:4], blockType)
+	binary.LittleEndian.PutUint32(b[4:8], uint32(12+len(body)))
+	b = append(b, body...)
+	return append(b, b[4:8]...)
+}
+
+// pcapngCapture writes a pcapng file with one interface, a tsresol of 0 keeps the default microseconds
+func pcapngCapture(linktype uint16, tsresol byte, packets []capturePacket) []byte {
+	section := make([]byte, 16)
+	binary.LittleEndian.PutUint32(section[0:4], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(section[4:6], 1)
+	binary.LittleEndian.PutUint64(section[8:16], ^uint64(0))
+	b := pcapngBlock(pcapngSectionHeader, section)
+
+	iface := make([]byte, 8)
+	binary.LittleEndian.PutUint16(iface[0:2], linktype)
+	binary.LittleEndian.PutUint32(iface[4:8], 65535)
+	units := int64(1000000)
+	if tsresol != 0 {
+		iface = append(iface, pcapngOptionTsresol, 0, 1, 0, tsresol, 0, 0, 0)
+		units = 1
+		for i := byte(0); i < tsresol; i++ {
+			units *= 10
+		}
+	}
+	iface = append(iface, 0, 0, 0, 0)
+	b = append(b, pcapngBlock(pcapngInterfaceDescription, iface)...)
+
+	for _, packet := range packets {
+		at := uint64(packet.at/1000000*units + packet.at%1000000*units/1000000)
+		body := make([]byte, 20, 20+len(packet.data))
+		binary.LittleEndian.PutUint32(body[4:8], uint32(at>>32))
+		binary.LittleEndian.PutUint32(body[8:12], uint32(at))
+		binary.LittleEndian.PutUint32(body[12:16], uint32(len(packet.data)))
+		binary.LittleEndian.PutUint32(body[16:20], uint32(len(packet.data)))
+		b = append(b, pcapngBlock(pcapngEnhancedPacket, append(body, packet.data...))...)
+	}
+	return b
+}
+
+// pcapFixture is a tcp handshake and teardown, a udp query without reply and an icmp echo
+func pcapFixture() []capturePacket {
+	const client, server, resolver, pinged = "192.168.1.10", "93.184.216.34", "8.8.8.8", "1.1.1.1"
+	tcp := func(src, dst string, sport, dport uint16, flags byte, length int) []byte {
+		return ipv4Packet(unix.IPPROTO_TCP, src, dst, 0, 0x4000, tcpSegment(sport, dport, flags, length))
+	}
+	return []capturePacket{
+		{1000000, tcp(client, server, 40000, 80, tcpSyn, 0)},
+		{1010000, tcp(server, client, 80, 40000, tcpSyn|tcpAck, 0)},
+		{1011000, tcp(client, server, 40000, 80, tcpAck, 0)},
+		{1020000, tcp(client, server, 40000, 80, tcpAck, 100)},
+		{1030000, tcp(server, client, 80, 40000, tcpAck, 500)},
+		{1040000, tcp(client, server, 40000, 80, tcpFin|tcpAck, 0)},
+		{1050000, tcp(server, client, 80, 40000, tcpFin|tcpAck, 0)},
+		{1051000, tcp(client, server, 40000, 80, tcpAck, 0)},
+		{2000000, ipv4Packet(unix.IPPROTO_UDP, client, resolver, 1, 0, udpDatagram(5353, 53, 30))},
+		{40000000, ipv4Packet(unix.IPPROTO_ICMP, client, pinged, 2, 0, icmpMessage(8, 99, 1, 56))},
+		{40020000, ipv4Packet(unix.IPPROTO_ICMP, pinged, client, 3, 0, icmpMessage(0, 99, 1, 56))},
+	}
+}
+
+// readCapture returns the events of the pcap source on a capture
+func readCapture(t *testing.T, capture []byte) []Flow {
+	source, err := newPcapSource(SourceOptions{PcapFile: "fixture"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flowChan := make(chan Flow, 64)
+	if err := source.(*pcapSource).read(bytes.NewReader(capture), flowChan); err != nil {
+		t.Fatal(err)
+	}
+	close(flowChan)
+	var flows []Flow
+	for flow := range flowChan {
+		flows = append(flows, flow)
+	}
+	return flows
+}
+
+func TestPcapCaptures(t *testing.T) {
+	frames := func(frame func(ip []byte) []byte) []capturePacket {
+		packets := pcapFixture()
+		for i := range packets {
+			packets[i].data = frame(packets[i].data)
+		}
+		return packets
+	}
+	ethernet := func(ip []byte) []byte { return etherFrame(ip) }
+	vlan := func(ip []byte) []byte { return etherFrame(ip, 10, 20) }
+	raw := func(ip []byte) []byte { return ip }
+	captures := []struct {
+		name    string
+		capture []byte
+	}{
+		{"pcap ethernet", pcapCapture(linktypeEthernet, false, frames(ethernet))},
+		{"pcap sll nanoseconds", pcapCapture(linktypeLinuxSLL, true, frames(sllFrame))},
+		{"pcap raw", pcapCapture(linktypeRaw, false, frames(raw))},
+		{"pcapng vlan nanoseconds", pcapngCapture(linktypeEthernet, 9, frames(vlan))},
+		{"pcapng sll", pcapngCapture(linktypeLinuxSLL, 0, frames(sllFrame))},
+		{"pcapng raw milliseconds", pcapngCapture(linktypeRaw, 3, frames(raw))},
+	}
+
+	type event struct {
+		Type      string
+		Id        uint32
+		State     string
+		Timestamp int64
+	}
+	want := []event{
+		{"NEW", 1, "SYN_SENT", 1000},
+		{"UPDATE", 1, "SYN_RECV", 1010},
+		{"UPDATE", 1, "ESTABLISHED", 1011},
+		{"UPDATE", 1, "FIN_WAIT", 1040},
+		{"UPDATE", 1, "LAST_ACK", 1050},
+		{"UPDATE", 1, "TIME_WAIT", 1051},
+		{"NEW", 2, "", 2000},
+		// The udp query times out without reply
+		{"DESTROY", 2, "", 32000},
+		{"NEW", 3, "", 40000},
+		// The capture ends
+		{"DESTROY", 1, "TIME_WAIT", 40020},
+		{"DESTROY", 3, "", 40020},
+	}
+	counters := map[uint32][2]Counter{
+		1: {{Packets: 5, Bytes: 300}, {Packets: 3, Bytes: 620}},
+		2: {{Packets: 1, Bytes: 58}, {}},
+		3: {{Packets: 1, Bytes: 84}, {Packets: 1, Bytes: 84}},
+	}
+	for _, c := range captures {
+		flows := readCapture(t, c.capture)
+		got := make([]event, len(flows))
+		for i, flow := range flows {
+			got[i] = event{flow.Type, flow.Id, flow.State, flow.Timestamp}
+		}
+		if len(got) != len(want) {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, want)
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s: event %d: got %+v, want %+v", c.name, i, got[i], want[i])
+			}
+		}
+		for _, flow := range flows {
+			if flow.Type != "DESTROY" {
+				continue
+			}
+			if counter := [2]Counter{flow.Original.Counter, flow.Reply.Counter}; counter != counters[flow.Id] {
+				t.Errorf("%s: flow %d: got counters %+v, want %+v", c.name, flow.Id, counter, counters[flow.Id])
+			}
+			if flow.Id == 1 && (!flow.ASSURED || flow.UNREPLIED) {
+				t.Errorf("%s: got the tcp connection unassured", c.name)
+			}
+			if flow.Id == 2 && (!flow.UNREPLIED || flow.Deltatime != 30) {
+				t.Errorf("%s: got the udp query replied or lasting %ds", c.name, flow.Deltatime)
+			}
+		}
+	}
+}
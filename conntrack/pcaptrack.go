@@ -0,0 +1,512 @@
+package conntrack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	log "gitlab.com/OpenWifiPortal/go-libs/logger"
+	"golang.org/x/sys/unix"
+)
+
+// Default timeouts of nf_conntrack, see net/netfilter/nf_conntrack_proto_*.c
+var pcapTcpTimeouts = map[string]time.Duration{
+	"SYN_SENT":    120 * time.Second,
+	"SYN_RECV":    60 * time.Second,
+	"ESTABLISHED": 5 * 24 * time.Hour,
+	"FIN_WAIT":    120 * time.Second,
+	"CLOSE_WAIT":  60 * time.Second,
+	"LAST_ACK":    30 * time.Second,
+	"TIME_WAIT":   120 * time.Second,
+	"CLOSE":       10 * time.Second,
+}
+
+const (
+	pcapUdpTimeout       = 30 * time.Second
+	pcapUdpStreamTimeout = 120 * time.Second
+	pcapIcmpTimeout      = 30 * time.Second
+	pcapGenericTimeout   = 600 * time.Second
+
+	// pcapSweepInterval is the capture time between two searches of expired connections
+	pcapSweepInterval = int64(time.Second / time.Microsecond)
+
+	// pcapFragmentTimeout is the time the kernel keeps the fragments of a datagram, see ipfrag_time
+	pcapFragmentTimeout = int64(30 * time.Second / time.Microsecond)
+	// pcapMaxFragments bounds the fragmented datagrams waiting for their trailing fragments
+	pcapMaxFragments = 4096
+)
+
+// ICMP requests and their reply, other messages don't start a connection
+var pcapIcmpReplies = map[int]map[int]int{
+	unix.IPPROTO_ICMP:   {8: 0, 13: 14, 15: 16, 17: 18},
+	unix.IPPROTO_ICMPV6: {128: 129},
+}
+
+func init() {
+	RegisterSource("pcap", newPcapSource)
+}
+
+// pcapSource synthesizes the events of the connections seen in a pcap or pcapng capture
+type pcapSource struct {
+	options SourceOptions
+	filter  *filter
+	events  map[string]bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func newPcapSource(options SourceOptions) (Source, error) {
+	if options.PcapFile == "" {
+		return nil, fmt.Errorf("pcap source needs a file")
+	}
+	if options.ReplaySpeed < 0 {
+		return nil, fmt.Errorf("replay speed can't be negative")
+	}
+	if len(options.OtherArgs) > 0 {
+		return nil, fmt.Errorf("pcap source doesn't support conntrack arguments: %v", options.OtherArgs)
+	}
+	if options.Snapshot {
+		return nil, fmt.Errorf("pcap source can't list connections")
+	}
+	if options.NatOnly {
+		return nil, fmt.Errorf("pcap source can't see NAT")
+	}
+	if err := checkEventTypes(options.EventType); err != nil {
+		return nil, err
+	}
+	filter, err := options.Filter.compile()
+	if err != nil {
+		return nil, err
+	}
+	var events map[string]bool
+	if options.EventType != nil {
+		events = make(map[string]bool)
+		for _, event := range options.EventType {
+			events[event] = true
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &pcapSource{
+		options: options,
+		filter:  filter,
+		events:  events,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+func (s *pcapSource) Start(flowChan chan<- Flow, errChan chan<- error) error {
+	file, err := os.Open(s.options.PcapFile)
+	if err != nil {
+		return fmt.Errorf("pcap: %s", err)
+	}
+	go func() {
+		defer close(s.done)
+		defer file.Close()
+		if err := s.read(file, flowChan); err != nil {
+			select {
+			case errChan <- err:
+			case <-s.ctx.Done():
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *pcapSource) Stop() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+// Finished is closed at the end of the capture
+func (s *pcapSource) Finished() <-chan struct{} {
+	return s.done
+}
+
+func (s *pcapSource) read(file io.Reader, flowChan chan<- Flow) error {
+	log.Infof("reading capture %s...", s.options.PcapFile)
+	reader, err := newPcapReader(file)
+	if err != nil {
+		return err
+	}
+	count := 0
+	tracker := newPcapTracker(func(flow Flow) bool {
+		if s.events != nil && !s.events[flow.Type] || !s.filter.match(&flow) {
+			return true
+		}
+		flow.Netns = s.options.Netns
+		select {
+		case flowChan <- flow:
+			count++
+			return true
+		case <-s.ctx.Done():
+			return false
+		}
+	})
+
+	pacer := newPacer(s.options.ReplaySpeed)
+	var packet pcapPacket
+	packets := 0
+	now := int64(0)
+	for {
+		record, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("pcap: %s", err)
+		}
+		if !decodePacket(record.linktype, record.data, &packet) {
+			continue
+		}
+		packets++
+		// Packets of several interfaces may be slightly out of order
+		if record.timestamp > now {
+			now = record.timestamp
+		}
+		if !pacer.wait(s.ctx, now) || !tracker.track(now, &packet) {
+			return nil
+		}
+	}
+	if !tracker.flush(now) {
+		return nil
+	}
+	log.Infof("capture %s finished, %d packets, %d events", s.options.PcapFile, packets, count)
+	return nil
+}
+
+// pcapKey is the original tuple of a connection, icmp ones use the id and the request type as ports
+type pcapKey struct {
+	protocol int
+	src, dst [16]byte
+	sport    int
+	dport    int
+}
+
+// pcapFragmentKey identifies the fragments of a datagram
+type pcapFragmentKey struct {
+	protocol int
+	src, dst [16]byte
+	id       uint32
+}
+
+// pcapFragment is the connection of a datagram, found from its first fragment
+type pcapFragment struct {
+	connection *pcapConnection
+	reply      bool
+	expires    int64
+}
+
+// pcapConnection is a connection tracked from the captured packets, times are in microseconds
+type pcapConnection struct {
+	key     pcapKey
+	flow    Flow
+	start   int64
+	expires int64
+	fin     [2]bool
+}
+
+// pcapTracker follows the connections like nf_conntrack with the capture time as clock
+type pcapTracker struct {
+	connections map[pcapKey]*pcapConnection
+	fragments   map[pcapFragmentKey]pcapFragment
+	id          uint32
+	swept       int64
+	emit        func(flow Flow) bool
+}
+
+func newPcapTracker(emit func(flow Flow) bool) *pcapTracker {
+	return &pcapTracker{
+		connections: make(map[pcapKey]*pcapConnection),
+		fragments:   make(map[pcapFragmentKey]pcapFragment),
+		emit:        emit,
+	}
+}
+
+// track accounts the packet to its connection, it returns false once emit did
+func (t *pcapTracker) track(now int64, packet *pcapPacket) bool {
+	if now-t.swept >= pcapSweepInterval {
+		if !t.expire(now) {
+			return false
+		}
+	}
+
+	if packet.trailing {
+		t.trackFragment(now, packet)
+		return true
+	}
+
+	key := pcapKey{protocol: packet.protocol, src: packet.src, dst: packet.dst, sport: packet.sport, dport: packet.dport}
+	reverse := pcapKey{protocol: packet.protocol, src: packet.dst, dst: packet.src, sport: packet.dport, dport: packet.sport}
+	request := true
+	if packet.icmp {
+		replies := pcapIcmpReplies[packet.protocol]
+		if _, ok := replies[packet.icmpType]; ok {
+			key.sport, key.dport = packet.icmpId, packet.icmpType
+		} else {
+			request = false
+			for requestType, replyType := range replies {
+				if replyType == packet.icmpType {
+					reverse.sport, reverse.dport = packet.icmpId, requestType
+				}
+			}
+			// Errors are related to the connection they report about
+			if reverse.dport == 0 {
+				return true
+			}
+		}
+	}
+
+	reply := false
+	var connection *pcapConnection
+	if request {
+		connection = t.connections[key]
+	}
+	// An icmp request of the other side is another connection
+	if connection == nil && !(packet.icmp && request) {
+		if connection = t.connections[reverse]; connection != nil {
+			reply = true
+		}
+	}
+	// A closed tcp connection is reopened by a new SYN
+	if connection != nil && (connection.expires <= now || !reply && packet.tcpFlags&(tcpSyn|tcpAck) == tcpSyn &&
+		(connection.flow.State == "TIME_WAIT" || connection.flow.State == "CLOSE")) {
+		at := connection.expires
+		if at > now {
+			at = now
+		}
+		if !t.destroy(connection, at) {
+			return false
+		}
+		connection = nil
+		reply = false
+	}
+
+	if connection == nil {
+		if !request || packet.protocol == unix.IPPROTO_TCP && packet.tcpFlags&tcpRst != 0 {
+			return true
+		}
+		connection = t.open(now, key, packet)
+		connection.update(now, packet, false)
+		t.fragmented(now, packet, connection, false)
+		flow := connection.flow
+		flow.Type = "NEW"
+		flow.Timestamp = now / 1000
+		return t.emit(flow)
+	}
+
+	state, assured := connection.flow.State, connection.flow.ASSURED
+	connection.update(now, packet, reply)
+	t.fragmented(now, packet, connection, reply)
+	if connection.flow.State == state && connection.flow.ASSURED == assured {
+		return true
+	}
+	flow := connection.flow
+	flow.Type = "UPDATE"
+	flow.Timestamp = now / 1000
+	return t.emit(flow)
+}
+
+// fragmented remembers the connection of a first fragment for the trailing ones
+func (t *pcapTracker) fragmented(now int64, packet *pcapPacket, connection *pcapConnection, reply bool) {
+	if !packet.more || len(t.fragments) >= pcapMaxFragments {
+		return
+	}
+	key := pcapFragmentKey{protocol: packet.protocol, src: packet.src, dst: packet.dst, id: packet.fragmentId}
+	t.fragments[key] = pcapFragment{connection: connection, reply: reply, expires: now + pcapFragmentTimeout}
+}
+
+// trackFragment adds a trailing fragment to the connection of the datagram, conntrack counts
+// the reassembled datagram as one packet. Fragments captured before the first one are lost.
+func (t *pcapTracker) trackFragment(now int64, packet *pcapPacket) {
+	key := pcapFragmentKey{protocol: packet.protocol, src: packet.src, dst: packet.dst, id: packet.fragmentId}
+	fragment, ok := t.fragments[key]
+	if !ok {
+		return
+	}
+	if !packet.more || fragment.expires <= now {
+		delete(t.fragments, key)
+	}
+	connection := fragment.connection
+	if fragment.expires <= now || t.connections[connection.key] != connection {
+		return
+	}
+	counter := &connection.flow.Original.Counter
+	if fragment.reply {
+		counter = &connection.flow.Reply.Counter
+	}
+	counter.Bytes += uint64(packet.length)
+}
+
+// open starts a connection from its first packet
+func (t *pcapTracker) open(now int64, key pcapKey, packet *pcapPacket) *pcapConnection {
+	t.id++
+	connection := &pcapConnection{key: key, start: now}
+	flow := &connection.flow
+	flow.Id = t.id
+	flow.UNREPLIED = true
+
+	layer3 := Layer3{Protonum: unix.AF_INET, Protoname: "ipv4"}
+	src, dst := net.IP(append([]byte(nil), packet.src[:4]...)), net.IP(append([]byte(nil), packet.dst[:4]...))
+	if packet.family == unix.AF_INET6 {
+		layer3 = Layer3{Protonum: unix.AF_INET6, Protoname: "ipv6"}
+		src, dst = net.IP(append([]byte(nil), packet.src[:]...)), net.IP(append([]byte(nil), packet.dst[:]...))
+	}
+	layer4 := Layer4{Protonum: packet.protocol, Protoname: "unknown"}
+	if name, ok := layer4Protonames[packet.protocol]; ok {
+		layer4.Protoname = name
+	}
+
+	flow.Original.Layer3, flow.Reply.Layer3 = layer3, layer3
+	flow.Original.Layer3.Src, flow.Original.Layer3.Dst = src, dst
+	flow.Reply.Layer3.Src, flow.Reply.Layer3.Dst = dst, src
+	flow.Original.Layer4, flow.Reply.Layer4 = layer4, layer4
+	if packet.icmp {
+		flow.Original.Layer4.Icmp = &Icmp{Type: packet.icmpType, Code: packet.icmpCode, Id: packet.icmpId}
+		flow.Reply.Layer4.Icmp = &Icmp{Type: pcapIcmpReplies[packet.protocol][packet.icmpType], Id: packet.icmpId}
+	} else {
+		flow.Original.Layer4.Sport, flow.Original.Layer4.Dport = packet.sport, packet.dport
+		flow.Reply.Layer4.Sport, flow.Reply.Layer4.Dport = packet.dport, packet.sport
+	}
+	t.connections[key] = connection
+	return connection
+}
+
+// update accounts the packet and moves the connection to its next state
+func (c *pcapConnection) update(now int64, packet *pcapPacket, reply bool) {
+	flow := &c.flow
+	counter := &flow.Original.Counter
+	if reply {
+		counter = &flow.Reply.Counter
+		flow.UNREPLIED = false
+	}
+	counter.Packets++
+	counter.Bytes += uint64(packet.length)
+
+	timeout := pcapGenericTimeout
+	switch packet.protocol {
+	case unix.IPPROTO_TCP:
+		flow.State = c.tcpState(packet.tcpFlags, reply)
+		if flow.State == "ESTABLISHED" && !flow.UNREPLIED {
+			flow.ASSURED = true
+		}
+		timeout = pcapTcpTimeouts[flow.State]
+	case unix.IPPROTO_UDP, unix.IPPROTO_UDPLITE:
+		timeout = pcapUdpTimeout
+		if !flow.UNREPLIED {
+			flow.ASSURED = true
+			timeout = pcapUdpStreamTimeout
+		}
+	case unix.IPPROTO_ICMP, unix.IPPROTO_ICMPV6:
+		timeout = pcapIcmpTimeout
+	}
+	flow.Timeout = int(timeout / time.Second)
+	c.expires = now + int64(timeout/time.Microsecond)
+}
+
+// tcpState follows the handshake and the teardown, a connection picked up midstream is established
+func (c *pcapConnection) tcpState(flags byte, reply bool) string {
+	state := c.flow.State
+	direction := 0
+	if reply {
+		direction = 1
+	}
+	switch {
+	case state == "CLOSE":
+	case flags&tcpRst != 0:
+		state = "CLOSE"
+	case flags&(tcpSyn|tcpAck) == tcpSyn && !reply:
+		if state == "" {
+			state = "SYN_SENT"
+		}
+	case flags&(tcpSyn|tcpAck) == tcpSyn|tcpAck && reply:
+		if state == "SYN_SENT" {
+			state = "SYN_RECV"
+		}
+	case flags&tcpFin != 0:
+		c.fin[direction] = true
+		if c.fin[0] && c.fin[1] {
+			state = "LAST_ACK"
+		} else {
+			state = "FIN_WAIT"
+		}
+	case flags&tcpAck != 0:
+		switch {
+		case state == "SYN_RECV" && !reply:
+			state = "ESTABLISHED"
+		case state == "LAST_ACK":
+			state = "TIME_WAIT"
+		case state == "FIN_WAIT" && c.fin[1-direction]:
+			state = "CLOSE_WAIT"
+		}
+	}
+	if state == "" {
+		state = "ESTABLISHED"
+	}
+	return state
+}
+
+// expire destroys the connections whose timeout elapsed
+func (t *pcapTracker) expire(now int64) bool {
+	t.swept = now
+	for key, fragment := range t.fragments {
+		if fragment.expires <= now {
+			delete(t.fragments, key)
+		}
+	}
+	var expired []*pcapConnection
+	for _, connection := range t.connections {
+		if connection.expires <= now {
+			expired = append(expired, connection)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		if expired[i].expires != expired[j].expires {
+			return expired[i].expires < expired[j].expires
+		}
+		return expired[i].flow.Id < expired[j].flow.Id
+	})
+	for _, connection := range expired {
+		if !t.destroy(connection, connection.expires) {
+			return false
+		}
+	}
+	return true
+}
+
+// flush destroys the connections left at the end of the capture
+func (t *pcapTracker) flush(now int64) bool {
+	if !t.expire(now) {
+		return false
+	}
+	remaining := make([]*pcapConnection, 0, len(t.connections))
+	for _, connection := range t.connections {
+		remaining = append(remaining, connection)
+	}
+	sort.Slice(remaining, func(i, j int) bool {
+		return remaining[i].flow.Id < remaining[j].flow.Id
+	})
+	for _, connection := range remaining {
+		if !t.destroy(connection, now) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *pcapTracker) destroy(connection *pcapConnection, at int64) bool {
+	delete(t.connections, connection.key)
+	flow := connection.flow
+	flow.Type = "DESTROY"
+	flow.Timestamp = at / 1000
+	flow.Timeout = 0
+	flow.Deltatime = (at - connection.start) / int64(time.Second/time.Microsecond)
+	return t.emit(flow)
+}
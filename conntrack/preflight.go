@@ -0,0 +1,177 @@
+package conntrack
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Outcomes of a preflight check, FAIL prevents the source from working and WARN degrades the events
+const (
+	CheckOk   = "OK"
+	CheckWarn = "WARN"
+	CheckFail = "FAIL"
+)
+
+// Sysctls of the namespace filling the counters and the deltatime of the events
+const (
+	procNfConntrackAcct      = "/proc/sys/net/netfilter/nf_conntrack_acct"
+	procNfConntrackTimestamp = "/proc/sys/net/netfilter/nf_conntrack_timestamp"
+)
+
+// capNetAdmin is the CAP_NET_ADMIN bit, see linux/capability.h
+const capNetAdmin = 12
+
+// Check is the result of a preflight check
+type Check struct {
+	Name   string
+	Status string
+	Detail string
+}
+
+// Preflight checks that the source can read the events of the namespace and that they will be complete,
+// enableSysctl turns the accounting and timestamp sysctls on when they are off
+func Preflight(name string, options SourceOptions, enableSysctl bool) []Check {
+	switch name {
+	case "replay", "pcap":
+		// Offline sources don't depend on the host
+		return nil
+	}
+	var checks []Check
+	err := inNetns(options.Netns, func() error {
+		if _, err := os.Stat(procNfConntrackCount); err != nil {
+			checks = append(checks, Check{Name: "nf_conntrack", Status: CheckFail, Detail: "module not loaded: " + err.Error()})
+			return nil
+		}
+		checks = append(checks, Check{Name: "nf_conntrack", Status: CheckOk, Detail: "module loaded"})
+
+		switch name {
+		case "exec":
+			checks = append(checks, checkCapability(CheckWarn, "conntrack needs it unless it has the file capability"))
+			checks = append(checks, checkConntrackBinary())
+		case "netlink":
+			checks = append(checks, checkCapability(CheckFail, "ctnetlink events need it"))
+			checks = append(checks, checkNetlink())
+		case "proc":
+			checks = append(checks, checkProc(options.Netns))
+		}
+
+		checks = append(checks,
+			checkSysctl("nf_conntrack_acct", procNfConntrackAcct, "the counters are 0", enableSysctl),
+			checkSysctl("nf_conntrack_timestamp", procNfConntrackTimestamp, "deltatime is missing", enableSysctl))
+		return nil
+	})
+	if err != nil {
+		checks = append(checks, Check{Name: "netns", Status: CheckFail, Detail: err.Error()})
+	}
+	return checks
+}
+
+// checkCapability reads CAP_NET_ADMIN in the effective set of the process
+func checkCapability(status string, reason string) Check {
+	check := Check{Name: "CAP_NET_ADMIN"}
+	effective, err := capabilities("CapEff")
+	if err != nil {
+		check.Status, check.Detail = CheckWarn, err.Error()
+		return check
+	}
+	if effective&(1<<capNetAdmin) == 0 {
+		check.Status, check.Detail = status, "missing, "+reason
+		return check
+	}
+	check.Status, check.Detail = CheckOk, "effective"
+	return check
+}
+
+func capabilities(set string) (uint64, error) {
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == set+":" {
+			return strconv.ParseUint(fields[1], 16, 64)
+		}
+	}
+	return 0, fmt.Errorf("/proc/self/status: %s not found", set)
+}
+
+// checkConntrackBinary counts the connections, which needs the same access as the events
+func checkConntrackBinary() Check {
+	check := Check{Name: "conntrack"}
+	path, err := exec.LookPath("conntrack")
+	if err != nil {
+		check.Status, check.Detail = CheckFail, "not found in PATH, install conntrack-tools"
+		return check
+	}
+	output, err := exec.Command(path, "-C").CombinedOutput()
+	if err != nil {
+		check.Status, check.Detail = CheckFail, fmt.Sprintf("%s -C: %s: %s", path, err, strings.TrimSpace(string(output)))
+		return check
+	}
+	version, _ := exec.Command(path, "--version").CombinedOutput()
+	check.Status, check.Detail = CheckOk, strings.TrimSpace(path+" "+strings.SplitN(string(version), "\n", 2)[0])
+	return check
+}
+
+// checkNetlink subscribes to the event groups like the netlink source
+func checkNetlink() Check {
+	check := Check{Name: "netlink"}
+	conn, err := dialNetlink("", 1<<(nfnlgrpConntrackNew-1)|1<<(nfnlgrpConntrackDestroy-1))
+	if err != nil {
+		check.Status, check.Detail = CheckFail, err.Error()
+		return check
+	}
+	conn.Close()
+	check.Status, check.Detail = CheckOk, "subscribed to the events"
+	return check
+}
+
+func checkProc(netns string) Check {
+	path := procNfConntrack
+	if netns != "" {
+		path = procThreadNfConntrack
+	}
+	check := Check{Name: "proc"}
+	file, err := os.Open(path)
+	if err != nil {
+		check.Status, check.Detail = CheckFail, err.Error()
+		return check
+	}
+	file.Close()
+	check.Status, check.Detail = CheckOk, path+" readable"
+	return check
+}
+
+// checkSysctl expects the sysctl to be 1, enable writes it otherwise
+func checkSysctl(name string, path string, consequence string, enable bool) Check {
+	check := Check{Name: name}
+	value, err := ioutil.ReadFile(path)
+	if err != nil {
+		check.Status, check.Detail = CheckWarn, err.Error()
+		return check
+	}
+	if strings.TrimSpace(string(value)) != "0" {
+		check.Status, check.Detail = CheckOk, "enabled"
+		return check
+	}
+	if !enable {
+		check.Status = CheckWarn
+		check.Detail = fmt.Sprintf("disabled, %s: sysctl -w net.netfilter.%s=1 or --enable-sysctl", consequence, name)
+		return check
+	}
+	if err := ioutil.WriteFile(path, []byte("1\n"), 0644); err != nil {
+		check.Status, check.Detail = CheckWarn, fmt.Sprintf("disabled, %s, can't enable: %s", consequence, err)
+		return check
+	}
+	// The connections created before keep their extension missing
+	check.Status, check.Detail = CheckOk, "enabled by the collector, for the new connections"
+	return check
+}
@@ -0,0 +1,53 @@
+package conntrack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckSysctl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "preflight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		value  string
+		enable bool
+		status string
+		after  string
+	}{
+		{"1\n", false, CheckOk, "1\n"},
+		{"0\n", false, CheckWarn, "0\n"},
+		{"0\n", true, CheckOk, "1\n"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, "nf_conntrack_acct")
+		if err := ioutil.WriteFile(path, []byte(test.value), 0644); err != nil {
+			t.Fatal(err)
+		}
+		check := checkSysctl("nf_conntrack_acct", path, "the counters are 0", test.enable)
+		if check.Name != "nf_conntrack_acct" || check.Status != test.status {
+			t.Errorf("%q enable %v: got %+v, want %s", test.value, test.enable, check, test.status)
+		}
+		if value, _ := ioutil.ReadFile(path); string(value) != test.after {
+			t.Errorf("%q enable %v: got the sysctl %q, want %q", test.value, test.enable, value, test.after)
+		}
+	}
+
+	// A missing sysctl only degrades the events
+	if check := checkSysctl("nf_conntrack_timestamp", filepath.Join(dir, "missing"), "deltatime is missing", true); check.Status != CheckWarn {
+		t.Errorf("got %+v, want %s", check, CheckWarn)
+	}
+}
+
+func TestPreflightOffline(t *testing.T) {
+	for _, name := range []string{"replay", "pcap"} {
+		if checks := Preflight(name, SourceOptions{Netns: "missing"}, false); checks != nil {
+			t.Errorf("%s: got %+v, want no checks", name, checks)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package conntrack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	log "gitlab.com/OpenWifiPortal/go-libs/logger"
+)
+
+// The table as seen by the current process, thread-self follows the namespace of the thread
+const (
+	procNfConntrack       = "/proc/net/nf_conntrack"
+	procThreadNfConntrack = "/proc/thread-self/net/nf_conntrack"
+)
+
+func init() {
+	RegisterSource("proc", newProcSource)
+}
+
+// procSource polls /proc/net/nf_conntrack and diffs the successive tables into NEW and DESTROY events
+type procSource struct {
+	options SourceOptions
+	filter  *filter
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func newProcSource(options SourceOptions) (Source, error) {
+	if len(options.OtherArgs) > 0 {
+		return nil, fmt.Errorf("proc source doesn't support conntrack arguments: %v", options.OtherArgs)
+	}
+	if err := checkEventTypes(options.EventType); err != nil {
+		return nil, err
+	}
+	for _, event := range options.EventType {
+		if event == "UPDATE" {
+			// Also added by --track-state
+			return nil, fmt.Errorf("proc source doesn't support UPDATE events, only the NEW and DESTROY ones are found between polls")
+		}
+	}
+	if options.PollInterval <= 0 {
+		return nil, fmt.Errorf("proc source needs a poll interval")
+	}
+	filter, err := options.Filter.compile()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &procSource{
+		options: options,
+		filter:  filter,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+func (s *procSource) Start(flowChan chan<- Flow, errChan chan<- error) error {
+	go func() {
+		defer close(s.done)
+		newSupervisor("proc", s.options).run(s.ctx, errChan, func(ctx context.Context) error {
+			return s.runProc(ctx, flowChan)
+		})
+	}()
+	return nil
+}
+
+func (s *procSource) Stop() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+// Dump reads the table once
+func (s *procSource) Dump(fn func(flow Flow) bool) error {
+	return s.read(fn)
+}
+
+func (s *procSource) runProc(ctx context.Context, flowChan chan<- Flow) error {
+	log.Infoln("starting proc polling...")
+	if s.options.Snapshot {
+		if err := snapshot(s, s.options.Netns, flowChan, ctx.Done()); err != nil {
+			return err
+		}
+	}
+
+	// The connections existing at start are the reference, like for the other sources
+	previous, err := s.table()
+	if err != nil {
+		return err
+	}
+	newEvents, destroyEvents := s.options.EventType == nil, s.options.EventType == nil
+	for _, event := range s.options.EventType {
+		newEvents = newEvents || event == "NEW"
+		destroyEvents = destroyEvents || event == "DESTROY"
+	}
+
+	ticker := time.NewTicker(s.options.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		current, err := s.table()
+		if err != nil {
+			return err
+		}
+		timestamp := time.Now().UnixNano() / int64(time.Millisecond)
+		events := procDiff(previous, current, newEvents, destroyEvents, timestamp)
+		previous = current
+
+		for _, flow := range events {
+			select {
+			case flowChan <- flow:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+// procDiff returns the NEW events of the connections found in current and the DESTROY events of the ones gone
+func procDiff(previous, current map[uint64]Flow, newEvents, destroyEvents bool, timestamp int64) []Flow {
+	var events []Flow
+	if newEvents {
+		for key, flow := range current {
+			if _, ok := previous[key]; !ok {
+				flow.Type = "NEW"
+				events = append(events, flow)
+			}
+		}
+	}
+	// A destroyed connection keeps the counters of its last observation
+	if destroyEvents {
+		for key, flow := range previous {
+			if _, ok := current[key]; !ok {
+				flow.Type = "DESTROY"
+				flow.Timestamp = timestamp
+				events = append(events, flow)
+			}
+		}
+	}
+	return events
+}
+
+// table reads the connections by tuple
+func (s *procSource) table() (map[uint64]Flow, error) {
+	return procTable(s.read)
+}
+
+func procTable(read func(fn func(flow Flow) bool) error) (map[uint64]Flow, error) {
+	connections := make(map[uint64]Flow)
+	err := read(func(flow Flow) bool {
+		connections[flow.TupleHash()] = flow
+		return true
+	})
+	return connections, err
+}
+
+// read parses the table as DUMP events until fn returns false
+func (s *procSource) read(fn func(flow Flow) bool) error {
+	var file *os.File
+	err := inNetns(s.options.Netns, func() (err error) {
+		path := procNfConntrack
+		if s.options.Netns != "" {
+			path = procThreadNfConntrack
+		}
+		file, err = os.Open(path)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("proc: %s", err)
+	}
+	defer file.Close()
+	if err := s.parse(file, fn); err != nil {
+		return fmt.Errorf("proc: %s", err)
+	}
+	return nil
+}
+
+// parse reads the lines of a table, keeping the connections selected by the options
+func (s *procSource) parse(r io.Reader, fn func(flow Flow) bool) error {
+	return parseListing(r, func(flow Flow) bool {
+		if s.options.NatOnly && !flow.nat() || !s.filter.match(&flow) {
+			return true
+		}
+		flow.Netns = s.options.Netns
+		return fn(flow)
+	})
+}
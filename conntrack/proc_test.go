@@ -0,0 +1,70 @@
+package conntrack
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// procTables are two successive reads of /proc/net/nf_conntrack
+var procTables = []string{
+	`ipv4     2 tcp      6 431999 ESTABLISHED src=192.168.1.10 dst=1.2.3.4 sport=42216 dport=80 packets=4 bytes=305 src=1.2.3.4 dst=192.168.0.5 sport=80 dport=42216 packets=3 bytes=291 [ASSURED] mark=0 zone=0 use=2
+ipv4     2 udp      17 25 src=10.0.0.1 dst=8.8.8.8 sport=5353 dport=53 packets=1 bytes=58 src=8.8.8.8 dst=10.0.0.1 sport=53 dport=5353 packets=1 bytes=120 mark=0 zone=0 use=2
+ipv4     2 icmp     1 20 src=10.0.0.1 dst=1.1.1.1 type=8 code=0 id=99 packets=1 bytes=84 src=1.1.1.1 dst=10.0.0.1 type=0 code=0 id=99 packets=1 bytes=84 mark=0 zone=0 use=2
+`,
+	`ipv4     2 tcp      6 431998 ESTABLISHED src=192.168.1.10 dst=1.2.3.4 sport=42216 dport=80 packets=10 bytes=900 src=1.2.3.4 dst=192.168.0.5 sport=80 dport=42216 packets=8 bytes=4000 [ASSURED] mark=0 zone=0 use=2
+ipv6     10 udp      17 29 src=2001:db8::10 dst=2001:db8::1 sport=5353 dport=53 packets=1 bytes=78 [UNREPLIED] src=2001:db8::20 dst=2001:db8::10 sport=53 dport=5353 packets=0 bytes=0 mark=0 zone=0 use=2
+this line isn't a connection
+`,
+}
+
+func TestProcDiff(t *testing.T) {
+	tests := []struct {
+		name    string
+		options SourceOptions
+		new     bool
+		destroy bool
+		want    []string
+	}{
+		// A destroyed connection keeps the counters of the last table it was in
+		{"all", SourceOptions{}, true, true, []string{"DESTROY icmp 1/84", "DESTROY udp 1/58", "NEW udp 1/78"}},
+		{"new", SourceOptions{}, true, false, []string{"NEW udp 1/78"}},
+		{"destroy", SourceOptions{}, false, true, []string{"DESTROY icmp 1/84", "DESTROY udp 1/58"}},
+		// The filters apply to the tables, the NAT of the tcp connection is constant
+		{"nat only", SourceOptions{NatOnly: true}, true, true, []string{"NEW udp 1/78"}},
+		{"filter", SourceOptions{Filter: Filter{Family: "ipv4"}}, true, true, []string{"DESTROY icmp 1/84", "DESTROY udp 1/58"}},
+	}
+	for _, test := range tests {
+		test.options.PollInterval = 1
+		source, err := newProcSource(test.options)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		s := source.(*procSource)
+		var tables []map[uint64]Flow
+		for _, table := range procTables {
+			connections, err := procTable(func(fn func(flow Flow) bool) error {
+				return s.parse(strings.NewReader(table), fn)
+			})
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			tables = append(tables, connections)
+		}
+
+		events := procDiff(tables[0], tables[1], test.new, test.destroy, 1508566186345)
+		var got []string
+		for _, flow := range events {
+			got = append(got, fmt.Sprintf("%s %s %d/%d", flow.Type, flow.Original.Layer4.Protoname, flow.Original.Counter.Packets, flow.Original.Counter.Bytes))
+			if flow.Type == "DESTROY" && flow.Timestamp != 1508566186345 {
+				t.Errorf("%s: got the DESTROY at %d", test.name, flow.Timestamp)
+			}
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
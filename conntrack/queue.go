@@ -0,0 +1,167 @@
+package conntrack
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	log "gitlab.com/OpenWifiPortal/go-libs/logger"
+)
+
+// Policies of a full FlowQueue
+const (
+	// QueueBlock stops reading the sources, conntrack may then lose events in the kernel
+	QueueBlock = "block"
+	// QueueDropNewest drops the incoming flow
+	QueueDropNewest = "drop-newest"
+	// QueueDropOldest drops the oldest queued flow
+	QueueDropOldest = "drop-oldest"
+	// QueuePreferDestroy drops the incoming flow, unless it's a DESTROY which replaces the oldest other flow
+	QueuePreferDestroy = "prefer-destroy"
+)
+
+// QueueStats counts the flows dropped by the queue since the start, by event type
+type QueueStats struct {
+	Policy         string `json:"policy"`
+	Size           int    `json:"size"`
+	Length         int    `json:"length"`
+	Dropped        uint64 `json:"dropped"`
+	DroppedNew     uint64 `json:"dropped_new"`
+	DroppedUpdate  uint64 `json:"dropped_update"`
+	DroppedDestroy uint64 `json:"dropped_destroy"`
+}
+
+// FlowQueue buffers the flows between the sources and the publisher, and applies its policy when full.
+// The sources send to its unbuffered input and block until it takes the flow or they're stopped:
+// with the block policy a full queue stops them reading, with the others the flow is taken and may be dropped
+type FlowQueue struct {
+	// First for the 64-bit alignment of the atomic operations on 32-bit platforms
+	dropped [4]uint64 // total, NEW, UPDATE, DESTROY
+	policy  string
+	ring    []Flow
+	head    int
+	length  int32
+	full    bool
+}
+
+func NewFlowQueue(policy string, size int) (*FlowQueue, error) {
+	switch policy {
+	case QueueBlock, QueueDropNewest, QueueDropOldest, QueuePreferDestroy:
+	default:
+		return nil, fmt.Errorf("queue: unknown policy %q", policy)
+	}
+	if size < 1 {
+		return nil, fmt.Errorf("queue: size must be positive, got %d", size)
+	}
+	return &FlowQueue{policy: policy, ring: make([]Flow, size)}, nil
+}
+
+// Run queues the flows of in until it's closed, the returned channel is closed once the queue is empty
+func (q *FlowQueue) Run(in <-chan Flow) <-chan Flow {
+	out := make(chan Flow)
+	go func() {
+		defer close(out)
+		for in != nil || q.len() > 0 {
+			input := in
+			if q.policy == QueueBlock && q.len() == len(q.ring) {
+				input = nil
+			}
+			var output chan<- Flow
+			var next Flow
+			if q.len() > 0 {
+				output = out
+				next = q.ring[q.head]
+			}
+			select {
+			case flow, ok := <-input:
+				if !ok {
+					in = nil
+					continue
+				}
+				q.push(flow)
+			case output <- next:
+				q.remove(0)
+			}
+		}
+	}()
+	return out
+}
+
+// Stats can be called from any goroutine
+func (q *FlowQueue) Stats() QueueStats {
+	return QueueStats{
+		Policy:         q.policy,
+		Size:           len(q.ring),
+		Length:         q.len(),
+		Dropped:        atomic.LoadUint64(&q.dropped[0]),
+		DroppedNew:     atomic.LoadUint64(&q.dropped[1]),
+		DroppedUpdate:  atomic.LoadUint64(&q.dropped[2]),
+		DroppedDestroy: atomic.LoadUint64(&q.dropped[3]),
+	}
+}
+
+func (q *FlowQueue) len() int {
+	return int(atomic.LoadInt32(&q.length))
+}
+
+func (q *FlowQueue) push(flow Flow) {
+	if q.len() < len(q.ring) {
+		q.full = false
+		q.ring[(q.head+q.len())%len(q.ring)] = flow
+		atomic.AddInt32(&q.length, 1)
+		return
+	}
+	if !q.full {
+		// Logged once until the queue has room again
+		q.full = true
+		log.Warnf("queue full, %s", q.policy)
+	}
+	switch q.policy {
+	case QueueDropNewest:
+		q.drop(&flow)
+		return
+	case QueuePreferDestroy:
+		if flow.Type != "DESTROY" {
+			q.drop(&flow)
+			return
+		}
+		// The oldest flow which isn't a DESTROY, the oldest DESTROY otherwise
+		victim := 0
+		for i := 0; i < q.len(); i++ {
+			if q.ring[(q.head+i)%len(q.ring)].Type != "DESTROY" {
+				victim = i
+				break
+			}
+		}
+		q.drop(&q.ring[(q.head+victim)%len(q.ring)])
+		q.remove(victim)
+	default:
+		q.drop(&q.ring[q.head])
+		q.remove(0)
+	}
+	q.ring[(q.head+q.len())%len(q.ring)] = flow
+	atomic.AddInt32(&q.length, 1)
+}
+
+// remove deletes the i-th queued flow, the older ones are shifted
+func (q *FlowQueue) remove(i int) {
+	size := len(q.ring)
+	for ; i > 0; i-- {
+		q.ring[(q.head+i)%size] = q.ring[(q.head+i-1)%size]
+	}
+	// Release the references of the flow
+	q.ring[q.head] = Flow{}
+	q.head = (q.head + 1) % size
+	atomic.AddInt32(&q.length, -1)
+}
+
+func (q *FlowQueue) drop(flow *Flow) {
+	atomic.AddUint64(&q.dropped[0], 1)
+	switch flow.Type {
+	case "NEW":
+		atomic.AddUint64(&q.dropped[1], 1)
+	case "UPDATE":
+		atomic.AddUint64(&q.dropped[2], 1)
+	case "DESTROY":
+		atomic.AddUint64(&q.dropped[3], 1)
+	}
+}
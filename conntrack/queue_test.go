@@ -0,0 +1,174 @@
+package conntrack
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// queueFlow is a flow told apart by its id
+func queueFlow(id uint32, eventType string) Flow {
+	return Flow{Id: id, Type: eventType}
+}
+
+// drain removes the queued flows, oldest first
+func drain(q *FlowQueue) []uint32 {
+	var ids []uint32
+	for q.len() > 0 {
+		ids = append(ids, q.ring[q.head].Id)
+		q.remove(0)
+	}
+	return ids
+}
+
+func TestFlowQueuePolicies(t *testing.T) {
+	tests := []struct {
+		policy string
+		flows  []Flow
+		want   []uint32
+		stats  QueueStats
+	}{
+		{
+			policy: QueueDropNewest,
+			flows:  []Flow{queueFlow(1, "NEW"), queueFlow(2, "UPDATE"), queueFlow(3, "DESTROY"), queueFlow(4, "NEW"), queueFlow(5, "DESTROY")},
+			want:   []uint32{1, 2, 3},
+			stats:  QueueStats{Dropped: 2, DroppedNew: 1, DroppedDestroy: 1},
+		},
+		{
+			policy: QueueDropOldest,
+			flows:  []Flow{queueFlow(1, "NEW"), queueFlow(2, "UPDATE"), queueFlow(3, "DESTROY"), queueFlow(4, "NEW"), queueFlow(5, "UPDATE")},
+			want:   []uint32{3, 4, 5},
+			stats:  QueueStats{Dropped: 2, DroppedNew: 1, DroppedUpdate: 1},
+		},
+		{
+			policy: QueueDropOldest,
+			flows:  []Flow{queueFlow(1, "DESTROY"), queueFlow(2, "DESTROY"), queueFlow(3, "DESTROY"), queueFlow(4, "DESTROY")},
+			want:   []uint32{2, 3, 4},
+			stats:  QueueStats{Dropped: 1, DroppedDestroy: 1},
+		},
+		{
+			policy: QueuePreferDestroy,
+			flows: []Flow{
+				queueFlow(1, "NEW"), queueFlow(2, "UPDATE"), queueFlow(3, "DESTROY"),
+				// Dropped as it isn't a DESTROY
+				queueFlow(4, "NEW"),
+				// Replace the oldest other flows, 1 then 2
+				queueFlow(5, "DESTROY"), queueFlow(6, "DESTROY"),
+			},
+			want:  []uint32{3, 5, 6},
+			stats: QueueStats{Dropped: 3, DroppedNew: 2, DroppedUpdate: 1},
+		},
+		{
+			policy: QueuePreferDestroy,
+			flows: []Flow{
+				queueFlow(1, "DESTROY"), queueFlow(2, "DESTROY"), queueFlow(3, "DESTROY"),
+				// Only DESTROY events are queued, the oldest is replaced
+				queueFlow(4, "DESTROY"),
+				queueFlow(5, "UPDATE"),
+			},
+			want:  []uint32{2, 3, 4},
+			stats: QueueStats{Dropped: 2, DroppedUpdate: 1, DroppedDestroy: 1},
+		},
+		{
+			policy: QueuePreferDestroy,
+			flows: []Flow{
+				queueFlow(1, "DESTROY"), queueFlow(2, "NEW"), queueFlow(3, "DESTROY"),
+				// The NEW in the middle is removed, the order of the others is kept
+				queueFlow(4, "DESTROY"),
+			},
+			want:  []uint32{1, 3, 4},
+			stats: QueueStats{Dropped: 1, DroppedNew: 1},
+		},
+	}
+	for _, test := range tests {
+		q, err := NewFlowQueue(test.policy, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, flow := range test.flows {
+			q.push(flow)
+		}
+		stats := q.Stats()
+		if stats.Length != 3 {
+			t.Errorf("%s: got length %d, want 3", test.policy, stats.Length)
+		}
+		test.stats.Policy, test.stats.Size, test.stats.Length = test.policy, 3, 3
+		if stats != test.stats {
+			t.Errorf("%s: got %+v, want %+v", test.policy, stats, test.stats)
+		}
+		if ids := drain(q); !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("%s: got %v, want %v", test.policy, ids, test.want)
+		}
+	}
+}
+
+func TestFlowQueueWrap(t *testing.T) {
+	q, err := NewFlowQueue(QueueDropOldest, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := uint32(1); id <= 3; id++ {
+		q.push(queueFlow(id, "NEW"))
+	}
+	q.remove(0)
+	// The ring wraps around its end
+	for id := uint32(4); id <= 6; id++ {
+		q.push(queueFlow(id, "NEW"))
+	}
+	if ids := drain(q); !reflect.DeepEqual(ids, []uint32{4, 5, 6}) {
+		t.Errorf("got %v, want [4 5 6]", ids)
+	}
+	if stats := q.Stats(); stats.Dropped != 2 || stats.DroppedNew != 2 || stats.Length != 0 {
+		t.Errorf("got %+v", stats)
+	}
+}
+
+func TestFlowQueueBlock(t *testing.T) {
+	q, err := NewFlowQueue(QueueBlock, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := make(chan Flow)
+	out := q.Run(in)
+	sent := make(chan uint32, 10)
+	go func() {
+		for id := uint32(1); id <= 5; id++ {
+			in <- queueFlow(id, "NEW")
+			sent <- id
+		}
+		close(in)
+	}()
+
+	// The queue takes its size, then stops reading until the output is read
+	for i := 0; i < 3; i++ {
+		<-sent
+	}
+	select {
+	case id := <-sent:
+		t.Fatalf("flow %d taken by a full queue", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if stats := q.Stats(); stats.Length != 3 || stats.Dropped != 0 {
+		t.Errorf("got %+v", stats)
+	}
+
+	var ids []uint32
+	for flow := range out {
+		ids = append(ids, flow.Id)
+	}
+	if !reflect.DeepEqual(ids, []uint32{1, 2, 3, 4, 5}) {
+		t.Errorf("got %v, want every flow in order", ids)
+	}
+	if stats := q.Stats(); stats.Length != 0 || stats.Dropped != 0 {
+		t.Errorf("got %+v", stats)
+	}
+}
+
+func TestNewFlowQueueInvalid(t *testing.T) {
+	if _, err := NewFlowQueue("drop-random", 3); err == nil {
+		t.Error("unknown policy accepted")
+	}
+	if _, err := NewFlowQueue(QueueBlock, 0); err == nil {
+		t.Error("empty queue accepted")
+	}
+}
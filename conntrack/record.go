@@ -0,0 +1,67 @@
+package conntrack
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Record writes the raw conntrack events to w until ctx is cancelled, it returns the number of events written.
+// Each line is prefixed by its arrival time in microseconds, the replay source reproduces this timing.
+func Record(ctx context.Context, options SourceOptions, w io.Writer) (int, error) {
+	source, err := newExecSource(options)
+	if err != nil {
+		return 0, err
+	}
+	args := source.(*execSource).eventArgs()
+	cmd := exec.CommandContext(ctx, "conntrack", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdoutPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, fmt.Errorf("error conntrack record: %s", err)
+	}
+	if err := inNetns(options.Netns, cmd.Start); err != nil {
+		return 0, fmt.Errorf("error conntrack record: %s", err)
+	}
+
+	stdout := bufio.NewReader(stdoutPipe)
+	output := bufio.NewWriter(w)
+	fmt.Fprintf(output, "# conntrack %s\n", strings.Join(args, " "))
+	count := 0
+	var writeErr error
+	for writeErr == nil {
+		line, err := stdout.ReadString('\n')
+		if err != nil {
+			break
+		}
+		arrival := time.Now().UnixNano() / int64(time.Microsecond)
+		if _, writeErr = fmt.Fprintf(output, "%d %s", arrival, line); writeErr != nil {
+			break
+		}
+		count++
+		// Flush when conntrack is idle so the file can be read while recording
+		if stdout.Buffered() == 0 {
+			writeErr = output.Flush()
+		}
+	}
+	if writeErr == nil {
+		writeErr = output.Flush()
+	}
+	if writeErr != nil {
+		cmd.Process.Kill()
+	}
+	waitErr := cmd.Wait()
+	if writeErr != nil {
+		return count, fmt.Errorf("error conntrack record: %s", writeErr)
+	}
+	if ctx.Err() == nil && waitErr != nil {
+		return count, fmt.Errorf("conntrack exited: %s: %s", waitErr, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return count, nil
+}
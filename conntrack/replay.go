@@ -0,0 +1,208 @@
+package conntrack
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "gitlab.com/OpenWifiPortal/go-libs/logger"
+)
+
+func init() {
+	RegisterSource("replay", newReplaySource)
+}
+
+// replaySource feeds a file recorded by Record, or a conntrack -E capture, to the parser
+type replaySource struct {
+	options SourceOptions
+	filter  *filter
+	events  map[string]bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func newReplaySource(options SourceOptions) (Source, error) {
+	if options.ReplayFile == "" {
+		return nil, fmt.Errorf("replay source needs a file")
+	}
+	if options.ReplaySpeed < 0 {
+		return nil, fmt.Errorf("replay speed can't be negative")
+	}
+	if options.Snapshot {
+		return nil, fmt.Errorf("replay source can't list connections")
+	}
+	if err := checkEventTypes(options.EventType); err != nil {
+		return nil, err
+	}
+	filter, err := options.Filter.compile()
+	if err != nil {
+		return nil, err
+	}
+	var events map[string]bool
+	if options.EventType != nil {
+		events = make(map[string]bool)
+		for _, event := range options.EventType {
+			events[event] = true
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &replaySource{
+		options: options,
+		filter:  filter,
+		events:  events,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+func (s *replaySource) Start(flowChan chan<- Flow, errChan chan<- error) error {
+	file, err := os.Open(s.options.ReplayFile)
+	if err != nil {
+		return fmt.Errorf("replay: %s", err)
+	}
+	go func() {
+		defer close(s.done)
+		defer file.Close()
+		if err := s.replay(file, flowChan); err != nil {
+			select {
+			case errChan <- err:
+			case <-s.ctx.Done():
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *replaySource) Stop() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+// Finished is closed at the end of the file
+func (s *replaySource) Finished() <-chan struct{} {
+	return s.done
+}
+
+func (s *replaySource) replay(file io.Reader, flowChan chan<- Flow) error {
+	log.Infof("replaying %s...", s.options.ReplayFile)
+	reader := bufio.NewReader(file)
+	pacer := newPacer(s.options.ReplaySpeed)
+	count := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("replay: %s", err)
+		}
+		// Skip the comments and the summary conntrack prints on exit
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" && trimmed[0] != '#' && !strings.HasPrefix(trimmed, "conntrack v") {
+			arrival, event := replayLine(trimmed)
+			if arrival >= 0 && !pacer.wait(s.ctx, arrival) {
+				return nil
+			}
+
+			// The recorded conntrack may have been run with other options, filter like it would
+			flow, err := Parse([]byte(event))
+			if err != nil {
+				log.Debugln("replay: ", err)
+			} else if (s.events == nil || s.events[flow.Type]) && (!s.options.NatOnly || flow.nat()) && s.filter.match(&flow) {
+				flow.Netns = s.options.Netns
+				select {
+				case flowChan <- flow:
+					count++
+				case <-s.ctx.Done():
+					return nil
+				}
+			}
+		}
+		if err == io.EOF {
+			log.Infof("replay of %s finished, %d events", s.options.ReplayFile, count)
+			return nil
+		}
+	}
+}
+
+// replayLine returns the arrival time in microseconds, -1 if unknown, and the line in the format of the exec source.
+// Lines of conntrack -E without timestamp or extended output are completed.
+func replayLine(line string) (int64, string) {
+	// The timestamp may be padded: "[1508566165.785132 ]"
+	for strings.Contains(line, " ]") {
+		line = strings.Replace(line, " ]", "]", -1)
+	}
+	fields := strings.Fields(line)
+
+	arrival := int64(-1)
+	if value, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+		arrival = value
+		fields = fields[1:]
+	}
+
+	var timestamp float64
+	var err error
+	if len(fields) > 0 {
+		timestamp, err = strconv.ParseFloat(strings.Trim(fields[0], "[]"), 64)
+	}
+	if len(fields) == 0 || err != nil {
+		now := arrival
+		if now < 0 {
+			now = time.Now().UnixNano() / int64(time.Microsecond)
+		}
+		fields = append([]string{fmt.Sprintf("[%d.%06d]", now/1000000, now%1000000)}, fields...)
+	} else if arrival < 0 {
+		arrival = int64(timestamp * 1000000)
+	}
+
+	// Without extended output the layer 3 protocol is missing after the event type
+	if len(fields) > 2 && fields[2] != "ipv4" && fields[2] != "ipv6" {
+		layer3 := []string{"ipv4", "2"}
+		for _, field := range fields {
+			if strings.HasPrefix(field, "src=") {
+				if strings.Contains(field, ":") {
+					layer3 = []string{"ipv6", "10"}
+				}
+				break
+			}
+		}
+		fields = append(fields[:2], append(layer3, fields[2:]...)...)
+	}
+	return arrival, strings.Join(fields, " ")
+}
+
+// pacer delays events by their scaled interval since the first one, a speed of 0 disables it
+type pacer struct {
+	speed float64
+	first int64
+	start time.Time
+}
+
+func newPacer(speed float64) *pacer {
+	return &pacer{speed: speed, first: -1}
+}
+
+// wait blocks until the event at the given time in microseconds is due, it returns false if ctx is done
+func (p *pacer) wait(ctx context.Context, at int64) bool {
+	if p.speed <= 0 {
+		return true
+	}
+	if p.first < 0 {
+		p.first = at
+		p.start = time.Now()
+	}
+	interval := float64(at-p.first) * float64(time.Microsecond) / p.speed
+	if delay := time.Duration(interval) - time.Since(p.start); delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,137 @@
+package conntrack
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		arrival int64
+		event   string
+	}{
+		{
+			name:    "record",
+			line:    "1508566165790000 [1508566165.785132]\t    [NEW] ipv4     2 udp      17 30 src=10.0.0.1 dst=8.8.8.8 sport=5353 dport=53 [UNREPLIED] src=8.8.8.8 dst=10.0.0.1 sport=53 dport=5353 id=1",
+			arrival: 1508566165790000,
+			event:   "[1508566165.785132] [NEW] ipv4 2 udp 17 30 src=10.0.0.1 dst=8.8.8.8 sport=5353 dport=53 [UNREPLIED] src=8.8.8.8 dst=10.0.0.1 sport=53 dport=5353 id=1",
+		},
+		{
+			name:    "padded timestamp",
+			line:    "[1508566165.785132 ]\t[DESTROY] ipv4     2 udp      17 src=10.0.0.1 dst=8.8.8.8 sport=5353 dport=53 src=8.8.8.8 dst=10.0.0.1 sport=53 dport=5353 id=1",
+			arrival: 1508566165785132,
+			event:   "[1508566165.785132] [DESTROY] ipv4 2 udp 17 src=10.0.0.1 dst=8.8.8.8 sport=5353 dport=53 src=8.8.8.8 dst=10.0.0.1 sport=53 dport=5353 id=1",
+		},
+		{
+			name:    "record of plain conntrack -E",
+			line:    "1508566165790000     [NEW] tcp      6 120 SYN_SENT src=2001:db8::10 dst=2001:db8::1 sport=51234 dport=443 [UNREPLIED] src=2001:db8::1 dst=2001:db8::10 sport=443 dport=51234",
+			arrival: 1508566165790000,
+			event:   "[1508566165.790000] [NEW] ipv6 10 tcp 6 120 SYN_SENT src=2001:db8::10 dst=2001:db8::1 sport=51234 dport=443 [UNREPLIED] src=2001:db8::1 dst=2001:db8::10 sport=443 dport=51234",
+		},
+	}
+	for _, test := range tests {
+		arrival, event := replayLine(test.line)
+		if arrival != test.arrival || event != test.event {
+			t.Errorf("%s: got %d %q, want %d %q", test.name, arrival, event, test.arrival, test.event)
+		}
+		if _, err := Parse([]byte(event)); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+	}
+
+	// Plain conntrack -E lines are stamped when read, the arrival is unknown
+	before := time.Now().Unix()
+	arrival, event := replayLine("    [NEW] udp      17 30 src=10.0.0.1 dst=8.8.8.8 sport=5353 dport=53 [UNREPLIED] src=8.8.8.8 dst=10.0.0.1 sport=53 dport=5353")
+	flow, err := Parse([]byte(event))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arrival != -1 || flow.Timestamp/1000 < before || flow.Original.Layer3.Protoname != "ipv4" {
+		t.Errorf("got %d %q", arrival, event)
+	}
+}
+
+func TestReplayFilter(t *testing.T) {
+	const capture = `# conntrack -E -o timestamp,extended,id
+1508566165790000 [1508566165.785132]	    [NEW] ipv4     2 udp      17 30 src=10.0.0.1 dst=8.8.8.8 sport=5353 dport=53 [UNREPLIED] src=8.8.8.8 dst=10.0.0.1 sport=53 dport=5353 id=1
+1508566165800000 [1508566165.795132]	    [NEW] ipv4     2 tcp      6 120 SYN_SENT src=192.168.1.10 dst=1.2.3.4 sport=42216 dport=80 [UNREPLIED] src=1.2.3.4 dst=192.168.0.5 sport=80 dport=42216 id=2
+1508566165810000 [1508566165.805132]	 [UPDATE] ipv4     2 tcp      6 60 SYN_RECV src=192.168.1.10 dst=1.2.3.4 sport=42216 dport=80 src=1.2.3.4 dst=192.168.0.5 sport=80 dport=42216 id=2
+1508566165820000 [1508566165.815132]	[DESTROY] ipv4     2 udp      17 src=10.0.0.1 dst=8.8.8.8 sport=5353 dport=53 src=8.8.8.8 dst=10.0.0.1 sport=53 dport=5353 id=1
+not an event
+conntrack v1.4.6 (conntrack-tools): 4 flow events have been shown.
+`
+	tests := []struct {
+		name    string
+		options SourceOptions
+		want    []string
+	}{
+		{"all", SourceOptions{}, []string{"NEW 1", "NEW 2", "UPDATE 2", "DESTROY 1"}},
+		{"event types", SourceOptions{EventType: []string{"NEW", "DESTROY"}}, []string{"NEW 1", "NEW 2", "DESTROY 1"}},
+		{"nat only", SourceOptions{NatOnly: true}, []string{"NEW 2", "UPDATE 2"}},
+		{"filter", SourceOptions{Filter: Filter{Protocol: "udp"}, EventType: []string{"DESTROY"}}, []string{"DESTROY 1"}},
+	}
+	for _, test := range tests {
+		test.options.ReplayFile = "capture"
+		source, err := newReplaySource(test.options)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		flowChan := make(chan Flow, 8)
+		if err := source.(*replaySource).replay(strings.NewReader(capture), flowChan); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		close(flowChan)
+		var got []string
+		for flow := range flowChan {
+			got = append(got, flow.Type+" "+strconv.FormatUint(uint64(flow.Id), 10))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	if _, err := newReplaySource(SourceOptions{ReplayFile: "capture", EventType: []string{"DUMP"}}); err == nil {
+		t.Error("got no error with an unknown event type")
+	}
+}
+
+func TestPacer(t *testing.T) {
+	// Events 200ms apart are replayed 20ms apart at 10 times the speed
+	p := newPacer(10)
+	start := time.Now()
+	if !p.wait(context.Background(), 1000000) || !p.wait(context.Background(), 1200000) {
+		t.Fatal("pacer stopped")
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond || elapsed > 150*time.Millisecond {
+		t.Errorf("got %s, want 20ms", elapsed)
+	}
+
+	// An event late already isn't delayed
+	start = time.Now()
+	if !p.wait(context.Background(), 1100000) || time.Since(start) > 10*time.Millisecond {
+		t.Errorf("got a late event delayed by %s", time.Since(start))
+	}
+
+	// Speed 0 doesn't wait
+	p = newPacer(0)
+	start = time.Now()
+	p.wait(context.Background(), 0)
+	p.wait(context.Background(), 3600000000)
+	if time.Since(start) > 10*time.Millisecond {
+		t.Errorf("got a delay at speed 0")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p = newPacer(1)
+	p.wait(ctx, 0)
+	if p.wait(ctx, 3600000000) {
+		t.Error("got a wait through a cancelled context")
+	}
+}
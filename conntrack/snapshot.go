@@ -0,0 +1,190 @@
+package conntrack
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+
+	log "gitlab.com/OpenWifiPortal/go-libs/logger"
+	"golang.org/x/sys/unix"
+)
+
+// Dumper is implemented by sources able to list the current connections
+type Dumper interface {
+	// Dump calls fn for every connection with a DUMP event until fn returns false
+	Dump(fn func(flow Flow) bool) error
+}
+
+// newMarker builds an event that doesn't describe a connection but the stream itself
+func newMarker(eventType string, netns string, count int) Flow {
+	return Flow{
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		Type:      eventType,
+		Netns:     netns,
+		Count:     count,
+	}
+}
+
+// snapshot publishes the connections as SNAPSHOT events followed by a SNAPSHOT_END marker
+func snapshot(dumper Dumper, netns string, flowChan chan<- Flow, stop <-chan struct{}) error {
+	count := 0
+	stopped := false
+	err := dumper.Dump(func(flow Flow) bool {
+		flow.Type = "SNAPSHOT"
+		select {
+		case flowChan <- flow:
+			count++
+			return true
+		case <-stop:
+			stopped = true
+			return false
+		}
+	})
+	if err != nil || stopped {
+		return err
+	}
+	select {
+	case flowChan <- newMarker("SNAPSHOT_END", netns, count):
+	case <-stop:
+	}
+	return nil
+}
+
+// Dump lists the table with conntrack -L
+func (s *execSource) Dump(fn func(flow Flow) bool) error {
+	args := []string{"-L", "-o", "extended,id"}
+	if s.options.Format == FormatXML {
+		args[len(args)-1] = "xml,id"
+	}
+	if s.options.NatOnly {
+		args = append(args, "-n")
+	}
+	args = append(args, s.args...)
+	if s.options.OtherArgs != nil {
+		args = append(args, s.options.OtherArgs...)
+	}
+	cmd := exec.CommandContext(s.ctx, "conntrack", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdoutPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("error conntrack dump: %s", err)
+	}
+	if err := inNetns(s.options.Netns, cmd.Start); err != nil {
+		return fmt.Errorf("error conntrack dump: %s", err)
+	}
+
+	stopped := false
+	emit := func(flow Flow) bool {
+		if !s.filter.match(&flow) {
+			return true
+		}
+		flow.Netns = s.options.Netns
+		stopped = !fn(flow)
+		return !stopped
+	}
+	if s.options.Format == FormatXML {
+		err = xmlParse(xml.NewDecoder(stdoutPipe), "DUMP", emit)
+	} else {
+		err = parseListing(stdoutPipe, emit)
+	}
+	if stopped || err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("error conntrack dump: %s: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// Dump lists the table with a ctnetlink dump request
+func (s *netlinkSource) Dump(fn func(flow Flow) bool) error {
+	conn, err := dialNetlink(s.options.Netns, 0)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// The kernel filters the dump by family and mark, the rest is filtered here
+	family := uint8(unix.AF_UNSPEC)
+	if s.filter.family != -1 {
+		family = uint8(s.filter.family)
+	}
+	var attributes []netlinkAttribute
+	if s.filter.markMask != 0 {
+		attributes = append(attributes, uint32Attribute(ctaMark, s.filter.mark), uint32Attribute(ctaMarkMask, s.filter.markMask))
+	}
+	seq := uint32(time.Now().UnixNano())
+	err = conn.Request(nfnlSubsysCtnetlink<<8|ipctnlMsgCtGet, unix.NLM_F_REQUEST|unix.NLM_F_DUMP, family, seq, attributes...)
+	if err != nil {
+		return fmt.Errorf("netlink dump: %s", err)
+	}
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return nil
+		default:
+		}
+		messages, err := conn.Receive()
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("netlink dump: %s", err)
+		}
+		for _, message := range messages {
+			if message.Seq != seq {
+				continue
+			}
+			switch message.Type {
+			case unix.NLMSG_DONE:
+				return nil
+			case unix.NLMSG_ERROR:
+				if err := netlinkError(message); err != nil {
+					return fmt.Errorf("netlink dump: %s", err)
+				}
+				continue
+			}
+			flow, ok := netlinkParse(message)
+			if !ok {
+				continue
+			}
+			if s.options.NatOnly && flow.status&(ipsSrcNat|ipsDstNat) == 0 || !s.filter.match(&flow.Flow) {
+				continue
+			}
+			flow.Type = "DUMP"
+			flow.Netns = s.options.Netns
+			if !fn(flow.Flow) {
+				return nil
+			}
+		}
+	}
+}
+
+// parseListing reads the lines of conntrack -L or of /proc/net/nf_conntrack as DUMP events until fn returns false.
+// Listings have no event header, one is added so the event parser can be used.
+func parseListing(r io.Reader, fn func(flow Flow) bool) error {
+	now := time.Now()
+	header := fmt.Sprintf("[%d.%06d] [DUMP] ", now.Unix(), now.Nanosecond()/1000)
+	line := []byte(header)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line = append(line[:len(header)], scanner.Bytes()...)
+		flow, err := Parse(line)
+		if err != nil {
+			log.Errorln(err)
+			continue
+		}
+		if !fn(flow) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
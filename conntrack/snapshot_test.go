@@ -0,0 +1,69 @@
+package conntrack
+
+import (
+	"strings"
+	"testing"
+)
+
+// conntrackListFixture is conntrack -L -o extended,id
+const conntrackListFixture = `ipv4     2 tcp      6 431999 ESTABLISHED src=192.168.1.10 dst=1.2.3.4 sport=42216 dport=80 packets=4 bytes=305 src=1.2.3.4 dst=192.168.0.5 sport=80 dport=42216 packets=3 bytes=291 [ASSURED] mark=0 zone=0 use=1 id=3391145824
+ipv4     2 udp      17 25 src=10.0.0.1 dst=8.8.8.8 sport=5353 dport=53 packets=1 bytes=58 src=8.8.8.8 dst=10.0.0.1 sport=53 dport=5353 packets=1 bytes=120 mark=0 zone=0 use=1 id=1832950272
+not a connection
+ipv4     2 icmp     1 20 src=10.0.0.1 dst=1.1.1.1 type=8 code=0 id=99 packets=1 bytes=84 src=1.1.1.1 dst=10.0.0.1 type=0 code=0 id=99 packets=1 bytes=84 mark=0 zone=0 use=1 id=2190375424
+`
+
+type listingDumper string
+
+func (d listingDumper) Dump(fn func(flow Flow) bool) error {
+	return parseListing(strings.NewReader(string(d)), fn)
+}
+
+func TestSnapshot(t *testing.T) {
+	flowChan := make(chan Flow, 10)
+	if err := snapshot(listingDumper(conntrackListFixture), "blue", flowChan, nil); err != nil {
+		t.Fatal(err)
+	}
+	close(flowChan)
+
+	var flows []Flow
+	for flow := range flowChan {
+		flows = append(flows, flow)
+	}
+	// The unparsable line is skipped
+	if len(flows) != 4 {
+		t.Fatalf("got %d events, want 3 connections and the marker", len(flows))
+	}
+	for i, protoname := range []string{"tcp", "udp", "icmp"} {
+		if flows[i].Type != "SNAPSHOT" || flows[i].Original.Layer4.Protoname != protoname || flows[i].Timestamp == 0 {
+			t.Errorf("event %d: got %s %s at %d, want a SNAPSHOT of the %s connection", i, flows[i].Type, flows[i].Original.Layer4.Protoname, flows[i].Timestamp, protoname)
+		}
+	}
+	if end := flows[3]; end.Type != "SNAPSHOT_END" || end.Netns != "blue" || end.Count != 3 {
+		t.Errorf("got %s in %q with %d connections, want SNAPSHOT_END in blue with 3", end.Type, end.Netns, end.Count)
+	}
+}
+
+func TestSnapshotStop(t *testing.T) {
+	flowChan := make(chan Flow, 1)
+	stop := make(chan struct{})
+	close(stop)
+	done := make(chan error)
+	go func() {
+		done <- snapshot(listingDumper(conntrackListFixture), "", flowChan, stop)
+	}()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	close(flowChan)
+	// Stopped when the channel is full, without the marker
+	count := 0
+	for flow := range flowChan {
+		if flow.Type == "SNAPSHOT_END" {
+			t.Error("got the SNAPSHOT_END marker of an interrupted snapshot")
+		}
+		count++
+	}
+	if count > 1 {
+		t.Errorf("got %d events, want the stop to interrupt the dump", count)
+	}
+}
@@ -0,0 +1,97 @@
+package conntrack
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Source is a backend emitting conntrack events
+type Source interface {
+	// Start launches the source in background, flows and errors are sent on the given channels
+	Start(flowChan chan<- Flow, errChan chan<- error) error
+	// Stop terminates the source, no flow is sent after it returns
+	Stop() error
+}
+
+// SourceOptions are the settings shared by every source
+type SourceOptions struct {
+	EventType []string
+	NatOnly   bool
+	OtherArgs []string
+	// Format is the conntrack output parsed by the exec source, FormatText or FormatXML
+	Format string
+	// Filter selects the connections, in the kernel when the source allows it
+	Filter Filter
+	// Snapshot publishes the existing connections as SNAPSHOT events before the live events
+	Snapshot bool
+	// Resync publishes a snapshot after events were lost
+	Resync bool
+	// MaxRestarts is the number of consecutive failures before giving up, 0 for unlimited
+	MaxRestarts int
+	// MinBackoff and MaxBackoff bound the delay between restarts
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Netns is the name or path of the network namespace to watch, empty for the current one
+	Netns string
+	// PollInterval is the delay between two reads of the table by the proc source
+	PollInterval time.Duration
+	// UlogdInput is the JSON file or the unix:path socket read by the ulogd source
+	UlogdInput string
+	// ReplayFile is the file read by the replay source
+	ReplayFile string
+	// ReplaySpeed scales the recorded timing, 1 is the original speed and 0 as fast as possible
+	ReplaySpeed float64
+	// PcapFile is the pcap or pcapng capture read by the pcap source, paced by ReplaySpeed
+	PcapFile string
+	// Workers parse the text events of the exec source on several goroutines, sharded by connection
+	Workers int
+}
+
+// Finisher is implemented by the sources that end, like a replayed file
+type Finisher interface {
+	// Finished is closed once every event was sent
+	Finished() <-chan struct{}
+}
+
+// SourceFactory builds a source from its options
+type SourceFactory func(options SourceOptions) (Source, error)
+
+var (
+	sourceFactories      = make(map[string]SourceFactory)
+	sourceFactoriesMutex sync.RWMutex
+)
+
+// RegisterSource makes a source available by name, it panics if the name is already used
+func RegisterSource(name string, factory SourceFactory) {
+	sourceFactoriesMutex.Lock()
+	defer sourceFactoriesMutex.Unlock()
+	if _, exists := sourceFactories[name]; exists {
+		panic(fmt.Sprintf("conntrack: source %q registered twice", name))
+	}
+	sourceFactories[name] = factory
+}
+
+// NewSource builds the source registered under name
+func NewSource(name string, options SourceOptions) (Source, error) {
+	sourceFactoriesMutex.RLock()
+	factory, ok := sourceFactories[name]
+	sourceFactoriesMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("conntrack: unknown source %q", name)
+	}
+	return factory(options)
+}
+
+// Sources returns the sorted names of registered sources
+func Sources() []string {
+	sourceFactoriesMutex.RLock()
+	defer sourceFactoriesMutex.RUnlock()
+	names := make([]string, 0, len(sourceFactories))
+	for name := range sourceFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
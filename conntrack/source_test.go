@@ -0,0 +1,40 @@
+package conntrack
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSources(t *testing.T) {
+	expected := []string{"exec", "netlink", "pcap", "proc", "replay", "ulogd"}
+	if sources := Sources(); !reflect.DeepEqual(sources, expected) {
+		t.Errorf("got %v, want %v", sources, expected)
+	}
+	if _, err := NewSource("nflog", SourceOptions{}); err == nil {
+		t.Error("got no error for an unknown source")
+	}
+}
+
+func TestRegisterSource(t *testing.T) {
+	failure := errors.New("no input")
+	RegisterSource("test", func(options SourceOptions) (Source, error) {
+		return nil, failure
+	})
+	defer func() {
+		sourceFactoriesMutex.Lock()
+		delete(sourceFactories, "test")
+		sourceFactoriesMutex.Unlock()
+	}()
+	// The factory errors are returned as is
+	if _, err := NewSource("test", SourceOptions{}); err != failure {
+		t.Errorf("got %v, want the factory error", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("got no panic registering a name twice")
+		}
+	}()
+	RegisterSource("test", nil)
+}
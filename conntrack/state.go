@@ -0,0 +1,106 @@
+package conntrack
+
+// Entries not refreshed after their timeout plus this delay are considered lost
+const stateTrackerSlack = 60 * 1000
+
+const stateTrackerSweepInterval = 60 * 1000
+
+// StateTracker follows connections through UPDATE events and keeps only the meaningful ones
+type StateTracker struct {
+	connections map[uint64]*connectionState
+	lastSweep   int64
+}
+
+type connectionState struct {
+	state   string
+	since   int64
+	assured bool
+	mark    uint32
+	expires int64
+}
+
+func NewStateTracker() *StateTracker {
+	return &StateTracker{
+		connections: make(map[uint64]*connectionState),
+	}
+}
+
+// Track updates the connection state and sets flow.Transition, it returns false if the flow should be dropped
+func (t *StateTracker) Track(flow *Flow) bool {
+	t.sweep(flow.Timestamp)
+	key := flow.TupleHash()
+	current, known := t.connections[key]
+
+	switch flow.Type {
+	case "NEW", "SNAPSHOT":
+		t.connections[key] = &connectionState{
+			state:   flow.State,
+			since:   flow.Timestamp,
+			assured: flow.ASSURED,
+			mark:    flow.Mark,
+			expires: flow.expires(),
+		}
+		return true
+	case "UPDATE":
+		if !known {
+			// Connection created before we started, track it from now
+			t.connections[key] = &connectionState{
+				state:   flow.State,
+				since:   flow.Timestamp,
+				assured: flow.ASSURED,
+				mark:    flow.Mark,
+				expires: flow.expires(),
+			}
+			return true
+		}
+		current.expires = flow.expires()
+		changed := false
+		if flow.State != current.state {
+			flow.Transition = &Transition{
+				From:     current.state,
+				To:       flow.State,
+				Duration: flow.Timestamp - current.since,
+			}
+			current.state = flow.State
+			current.since = flow.Timestamp
+			changed = true
+		}
+		if flow.ASSURED != current.assured || flow.Mark != current.mark {
+			current.assured = flow.ASSURED
+			current.mark = flow.Mark
+			changed = true
+		}
+		return changed
+	case "DESTROY":
+		if known {
+			flow.Transition = &Transition{
+				From:     current.state,
+				Duration: flow.Timestamp - current.since,
+			}
+			delete(t.connections, key)
+		}
+		return true
+	}
+	return true
+}
+
+// Len returns the number of tracked connections
+func (t *StateTracker) Len() int {
+	return len(t.connections)
+}
+
+func (t *StateTracker) sweep(now int64) {
+	if now-t.lastSweep < stateTrackerSweepInterval {
+		return
+	}
+	t.lastSweep = now
+	for key, connection := range t.connections {
+		if connection.expires < now {
+			delete(t.connections, key)
+		}
+	}
+}
+
+func (f *Flow) expires() int64 {
+	return f.Timestamp + int64(f.Timeout)*1000 + stateTrackerSlack
+}
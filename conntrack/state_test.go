@@ -0,0 +1,89 @@
+package conntrack
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func stateFlow(sport int, eventType, state string, timestamp int64, timeout int) Flow {
+	return Flow{
+		Type:      eventType,
+		State:     state,
+		Timestamp: timestamp,
+		Timeout:   timeout,
+		Original: Meta{
+			Layer3: Layer3{Src: net.IP{10, 0, 0, 1}, Dst: net.IP{10, 0, 0, 2}},
+			Layer4: Layer4{Protoname: "tcp", Sport: sport, Dport: 80},
+		},
+	}
+}
+
+func TestStateTrackerTransitions(t *testing.T) {
+	tests := []struct {
+		eventType  string
+		state      string
+		assured    bool
+		mark       uint32
+		timestamp  int64
+		keep       bool
+		transition *Transition
+	}{
+		{"NEW", "SYN_SENT", false, 0, 1000000, true, nil},
+		// Nothing changed
+		{"UPDATE", "SYN_SENT", false, 0, 1000005, false, nil},
+		{"UPDATE", "ESTABLISHED", false, 0, 1000010, true, &Transition{From: "SYN_SENT", To: "ESTABLISHED", Duration: 10}},
+		{"UPDATE", "ESTABLISHED", true, 0, 1000020, true, nil},
+		{"UPDATE", "ESTABLISHED", true, 0, 1000030, false, nil},
+		{"UPDATE", "ESTABLISHED", true, 7, 1000040, true, nil},
+		// The duration counts from the transition, not from the last kept update
+		{"UPDATE", "FIN_WAIT", true, 7, 1005010, true, &Transition{From: "ESTABLISHED", To: "FIN_WAIT", Duration: 5000}},
+		{"UPDATE", "CLOSE", true, 7, 1005110, true, &Transition{From: "FIN_WAIT", To: "CLOSE", Duration: 100}},
+		// DESTROY events have no state, they carry the last one
+		{"DESTROY", "", true, 7, 1005120, true, &Transition{From: "CLOSE", Duration: 10}},
+	}
+	tracker := NewStateTracker()
+	for i, test := range tests {
+		flow := stateFlow(1234, test.eventType, test.state, test.timestamp, 120)
+		flow.ASSURED, flow.Mark = test.assured, test.mark
+		if keep := tracker.Track(&flow); keep != test.keep {
+			t.Errorf("event %d %s %s: got kept %v, want %v", i, test.eventType, test.state, keep, test.keep)
+		}
+		if !reflect.DeepEqual(flow.Transition, test.transition) {
+			t.Errorf("event %d %s %s: got transition %+v, want %+v", i, test.eventType, test.state, flow.Transition, test.transition)
+		}
+	}
+	if tracker.Len() != 0 {
+		t.Errorf("got %d connections after the DESTROY, want none", tracker.Len())
+	}
+}
+
+func TestStateTrackerSweep(t *testing.T) {
+	tracker := NewStateTracker()
+	// Expires at 100000 + 30s + the slack
+	a := stateFlow(1, "NEW", "SYN_SENT", 100000, 30)
+	tracker.Track(&a)
+	b := stateFlow(2, "NEW", "ESTABLISHED", 150000, 600)
+	tracker.Track(&b)
+
+	b = stateFlow(2, "UPDATE", "FIN_WAIT", 190000, 120)
+	tracker.Track(&b)
+	if tracker.Len() != 2 {
+		t.Fatalf("got %d connections, want the expiring one kept", tracker.Len())
+	}
+	b = stateFlow(2, "UPDATE", "CLOSE", 250001, 10)
+	tracker.Track(&b)
+	if tracker.Len() != 1 {
+		t.Fatalf("got %d connections, want the expired one swept", tracker.Len())
+	}
+
+	// A swept connection is tracked again from its next update
+	a = stateFlow(1, "UPDATE", "ESTABLISHED", 250002, 600)
+	if !tracker.Track(&a) || a.Transition != nil {
+		t.Errorf("got %+v, want the update kept without transition", a.Transition)
+	}
+	unknown := stateFlow(3, "DESTROY", "", 250003, 0)
+	if !tracker.Track(&unknown) || unknown.Transition != nil {
+		t.Errorf("got %+v, want the destroy kept without transition", unknown.Transition)
+	}
+}
@@ -0,0 +1,265 @@
+package conntrack
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The table size and the per-CPU counters of the namespace of the current thread
+const (
+	procNfConntrackCount      = "/proc/sys/net/netfilter/nf_conntrack_count"
+	procNfConntrackMax        = "/proc/sys/net/netfilter/nf_conntrack_max"
+	procStatNfConntrack       = "/proc/net/stat/nf_conntrack"
+	procThreadStatNfConntrack = "/proc/thread-self/net/stat/nf_conntrack"
+)
+
+// TableStats is a sample of the table health, Type is STATS or a watermark alert
+type TableStats struct {
+	Timestamp     int64       `json:"timestamp"`
+	Type          string      `json:"type"`
+	Count         int         `json:"count"`
+	Max           int         `json:"max"`
+	Usage         float64     `json:"usage"` // percent of Max
+	Watermark     float64     `json:"watermark,omitempty"`
+	InsertFailed  uint64      `json:"insert_failed"`
+	Drop          uint64      `json:"drop"`
+	EarlyDrop     uint64      `json:"early_drop"`
+	SearchRestart uint64      `json:"search_restart"`
+	Cpus          []CpuStats  `json:"cpus"`
+	Queue         *QueueStats `json:"queue,omitempty"`
+	Netns         string      `json:"netns,omitempty"`
+}
+
+// CpuStats holds the counters of conntrack -S for a CPU since boot
+type CpuStats struct {
+	Cpu           int    `json:"cpu"`
+	InsertFailed  uint64 `json:"insert_failed"`
+	Drop          uint64 `json:"drop"`
+	EarlyDrop     uint64 `json:"early_drop"`
+	SearchRestart uint64 `json:"search_restart"`
+}
+
+// StatsReporter periodically publishes the table health, and an alert when the usage crosses the watermark
+type StatsReporter struct {
+	netns     string
+	interval  time.Duration
+	watermark float64
+	cpuStats  func() ([]CpuStats, error)
+	queue     *FlowQueue
+	above     bool
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// NewStatsReporter reads the per-CPU counters with conntrack -S for the exec source, from /proc otherwise.
+// The drops of queue are added to the stats when it isn't nil
+func NewStatsReporter(name string, options SourceOptions, interval time.Duration, watermark float64, queue *FlowQueue) *StatsReporter {
+	reporter := &StatsReporter{
+		netns:     options.Netns,
+		interval:  interval,
+		watermark: watermark,
+		queue:     queue,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	path := procStatNfConntrack
+	if options.Netns != "" {
+		path = procThreadStatNfConntrack
+	}
+	reporter.cpuStats = func() ([]CpuStats, error) {
+		return procCpuStats(path)
+	}
+	if name == "exec" {
+		reporter.cpuStats = conntrackCpuStats
+	}
+	return reporter
+}
+
+func (r *StatsReporter) Start(statsChan chan<- TableStats, errChan chan<- error) error {
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			if err := r.report(statsChan); err != nil {
+				select {
+				case errChan <- err:
+				case <-r.stop:
+					return
+				}
+			}
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+func (r *StatsReporter) Stop() error {
+	close(r.stop)
+	<-r.done
+	return nil
+}
+
+func (r *StatsReporter) report(statsChan chan<- TableStats) error {
+	stats, err := r.sample()
+	if err != nil {
+		return err
+	}
+	messages := []TableStats{stats}
+	// The alert is published once until the usage falls back below the watermark
+	if r.watermark > 0 {
+		alert := stats
+		alert.Watermark = r.watermark
+		switch {
+		case !r.above && stats.Usage >= r.watermark:
+			r.above = true
+			alert.Type = "HIGH_WATERMARK"
+			messages = append(messages, alert)
+		case r.above && stats.Usage < r.watermark:
+			r.above = false
+			alert.Type = "HIGH_WATERMARK_CLEAR"
+			messages = append(messages, alert)
+		}
+	}
+	for _, message := range messages {
+		select {
+		case statsChan <- message:
+		case <-r.stop:
+			return nil
+		}
+	}
+	return nil
+}
+
+// sample reads the table size and the counters in the namespace
+func (r *StatsReporter) sample() (TableStats, error) {
+	stats := TableStats{
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		Type:      "STATS",
+		Netns:     r.netns,
+	}
+	err := inNetns(r.netns, func() (err error) {
+		if stats.Count, err = readSysctl(procNfConntrackCount); err != nil {
+			return err
+		}
+		if stats.Max, err = readSysctl(procNfConntrackMax); err != nil {
+			return err
+		}
+		stats.Cpus, err = r.cpuStats()
+		return err
+	})
+	if err != nil {
+		return stats, fmt.Errorf("stats: %s", err)
+	}
+	if stats.Max > 0 {
+		stats.Usage = float64(stats.Count) * 100 / float64(stats.Max)
+	}
+	for _, cpu := range stats.Cpus {
+		stats.InsertFailed += cpu.InsertFailed
+		stats.Drop += cpu.Drop
+		stats.EarlyDrop += cpu.EarlyDrop
+		stats.SearchRestart += cpu.SearchRestart
+	}
+	if r.queue != nil {
+		queue := r.queue.Stats()
+		stats.Queue = &queue
+	}
+	return stats, nil
+}
+
+func readSysctl(path string) (int, error) {
+	value, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(value)))
+}
+
+// conntrackCpuStats parses conntrack -S: "cpu=0 found=0 invalid=0 ... insert_failed=0 drop=0 early_drop=0 ..."
+func conntrackCpuStats() ([]CpuStats, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("conntrack", "-S")
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("conntrack -S: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	var cpus []CpuStats
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := make(map[string]uint64)
+		for _, field := range strings.Fields(scanner.Text()) {
+			i := strings.IndexByte(field, '=')
+			if i < 1 {
+				continue
+			}
+			if value, err := strconv.ParseUint(field[i+1:], 10, 64); err == nil {
+				fields[field[:i]] = value
+			}
+		}
+		cpu, ok := fields["cpu"]
+		if !ok {
+			continue
+		}
+		cpus = append(cpus, CpuStats{
+			Cpu:           int(cpu),
+			InsertFailed:  fields["insert_failed"],
+			Drop:          fields["drop"],
+			EarlyDrop:     fields["early_drop"],
+			SearchRestart: fields["search_restart"],
+		})
+	}
+	return cpus, nil
+}
+
+// procCpuStats reads /proc/net/stat/nf_conntrack, a row of hexadecimal counters per possible CPU
+func procCpuStats(path string) ([]CpuStats, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	columns := make(map[string]int)
+	if scanner.Scan() {
+		for i, name := range strings.Fields(scanner.Text()) {
+			columns[name] = i
+		}
+	}
+	for _, name := range []string{"insert_failed", "drop", "early_drop", "search_restart"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("%s: missing column %s", path, name)
+		}
+	}
+	value := func(fields []string, name string) uint64 {
+		value, _ := strconv.ParseUint(fields[columns[name]], 16, 64)
+		return value
+	}
+	var cpus []CpuStats
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < len(columns) {
+			continue
+		}
+		cpus = append(cpus, CpuStats{
+			Cpu:           len(cpus),
+			InsertFailed:  value(fields, "insert_failed"),
+			Drop:          value(fields, "drop"),
+			EarlyDrop:     value(fields, "early_drop"),
+			SearchRestart: value(fields, "search_restart"),
+		})
+	}
+	return cpus, scanner.Err()
+}
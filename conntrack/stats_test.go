@@ -0,0 +1,50 @@
+package conntrack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// procNetStatFixture is /proc/net/stat/nf_conntrack of a 2 CPUs host, the first column repeats the entries
+const procNetStatFixture = `entries  clashres found new invalid ignore delete delete_list insert insert_failed drop early_drop icmp_error  expect_new expect_create expect_delete search_restart
+000001a4  00000000 00000000 00000000 00000012 0000b3d1 00000000 00000000 00000000 00000003 0000000a 00000001 00000000  00000000 00000000 00000000 00000100
+000001a4  00000000 00000000 00000000 00000004 0000a0f2 00000000 00000000 00000000 00000000 00000002 00000000 00000000  00000000 00000000 00000000 0000000f
+`
+
+func TestProcCpuStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "nf_conntrack")
+	if err := ioutil.WriteFile(path, []byte(procNetStatFixture), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cpus, err := procCpuStats(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []CpuStats{
+		{Cpu: 0, InsertFailed: 3, Drop: 10, EarlyDrop: 1, SearchRestart: 256},
+		{Cpu: 1, InsertFailed: 0, Drop: 2, EarlyDrop: 0, SearchRestart: 15},
+	}
+	if !reflect.DeepEqual(cpus, expected) {
+		t.Errorf("got %+v, want %+v", cpus, expected)
+	}
+
+	// Kernels before 4.x have no search_restart column
+	if err := ioutil.WriteFile(path, []byte("entries searched found new invalid ignore delete delete_list insert insert_failed drop early_drop\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := procCpuStats(path); err == nil {
+		t.Error("got no error without the search_restart column")
+	}
+	if _, err := procCpuStats(filepath.Join(dir, "missing")); err == nil {
+		t.Error("got no error without the file")
+	}
+}
@@ -0,0 +1,99 @@
+package conntrack
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	log "gitlab.com/OpenWifiPortal/go-libs/logger"
+)
+
+const (
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = time.Minute
+)
+
+// RestartError is sent on the error channel when a source gives up restarting
+type RestartError struct {
+	Restarts int
+	Err      error
+}
+
+func (e *RestartError) Error() string {
+	return fmt.Sprintf("giving up after %d restarts: %s", e.Restarts, e.Err)
+}
+
+// supervisor runs a function until its context is cancelled, restarting it with an exponential backoff
+type supervisor struct {
+	name        string
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	maxRestarts int
+}
+
+func newSupervisor(name string, options SourceOptions) *supervisor {
+	sv := &supervisor{
+		name:        name,
+		minBackoff:  options.MinBackoff,
+		maxBackoff:  options.MaxBackoff,
+		maxRestarts: options.MaxRestarts,
+	}
+	if sv.minBackoff <= 0 {
+		sv.minBackoff = defaultMinBackoff
+	}
+	if sv.maxBackoff < sv.minBackoff {
+		sv.maxBackoff = defaultMaxBackoff
+		if sv.maxBackoff < sv.minBackoff {
+			sv.maxBackoff = sv.minBackoff
+		}
+	}
+	return sv
+}
+
+// run blocks until ctx is cancelled or maxRestarts consecutive failures, a run longer than maxBackoff resets the count
+func (sv *supervisor) run(ctx context.Context, errChan chan<- error, fn func(ctx context.Context) error) {
+	backoff := sv.minBackoff
+	restarts := 0
+	for {
+		started := time.Now()
+		err := fn(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("%s stopped", sv.name)
+		}
+		if time.Since(started) > sv.maxBackoff {
+			backoff = sv.minBackoff
+			restarts = 0
+		}
+		restarts++
+		if sv.maxRestarts > 0 && restarts > sv.maxRestarts {
+			select {
+			case errChan <- &RestartError{Restarts: restarts - 1, Err: err}:
+			case <-ctx.Done():
+			}
+			return
+		}
+
+		select {
+		case errChan <- err:
+		case <-ctx.Done():
+			return
+		}
+
+		// Equal jitter: wait between half and the whole backoff
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		log.Warnf("%s: restart %d in %s", sv.name, restarts, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > sv.maxBackoff {
+			backoff = sv.maxBackoff
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package conntrack
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNewSupervisorBackoff(t *testing.T) {
+	tests := []struct {
+		min, max       time.Duration
+		expMin, expMax time.Duration
+	}{
+		{0, 0, defaultMinBackoff, defaultMaxBackoff},
+		{time.Millisecond, 10 * time.Millisecond, time.Millisecond, 10 * time.Millisecond},
+		// A maximum below the minimum falls back to the default
+		{2 * time.Second, time.Second, 2 * time.Second, defaultMaxBackoff},
+		{2 * time.Minute, 0, 2 * time.Minute, 2 * time.Minute},
+	}
+	for _, test := range tests {
+		sv := newSupervisor("test", SourceOptions{MinBackoff: test.min, MaxBackoff: test.max})
+		if sv.minBackoff != test.expMin || sv.maxBackoff != test.expMax {
+			t.Errorf("%s-%s: got %s-%s, want %s-%s", test.min, test.max, sv.minBackoff, sv.maxBackoff, test.expMin, test.expMax)
+		}
+	}
+}
+
+func TestSupervisorGivesUp(t *testing.T) {
+	sv := newSupervisor("test", SourceOptions{MaxRestarts: 3, MinBackoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond})
+	failure := errors.New("exit status 1")
+	runs := 0
+	errChan := make(chan error, 10)
+	done := make(chan struct{})
+	go func() {
+		sv.run(context.Background(), errChan, func(ctx context.Context) error {
+			runs++
+			return failure
+		})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the supervisor didn't give up")
+	}
+	close(errChan)
+
+	var errs []error
+	for err := range errChan {
+		errs = append(errs, err)
+	}
+	if runs != 4 || len(errs) != 4 {
+		t.Fatalf("got %d runs and %d errors, want 4", runs, len(errs))
+	}
+	for _, err := range errs[:3] {
+		if err != failure {
+			t.Errorf("got %v, want the failure of the run", err)
+		}
+	}
+	if restart, ok := errs[3].(*RestartError); !ok || restart.Restarts != 3 || restart.Err != failure {
+		t.Errorf("got %#v, want a RestartError after 3 restarts", errs[3])
+	}
+}
+
+func TestSupervisorCancel(t *testing.T) {
+	sv := newSupervisor("test", SourceOptions{MinBackoff: time.Hour})
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error, 10)
+	done := make(chan struct{})
+	go func() {
+		// A run returning without error is restarted too
+		sv.run(ctx, errChan, func(ctx context.Context) error {
+			return nil
+		})
+		close(done)
+	}()
+	if err := <-errChan; err == nil || err.Error() != "test stopped" {
+		t.Errorf("got %v, want the stop reported", err)
+	}
+	// Cancelled while waiting for the restart
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the supervisor didn't stop on cancel")
+	}
+}
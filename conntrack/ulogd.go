@@ -0,0 +1,374 @@
+package conntrack
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "gitlab.com/OpenWifiPortal/go-libs/logger"
+	"golang.org/x/sys/unix"
+)
+
+// Prefix of an ulogd input read from a unix socket instead of a file
+const ulogdUnixPrefix = "unix:"
+
+// ulogdPollInterval is the delay between two reads at the end of the file
+var ulogdPollInterval = time.Second
+
+// ct.event values of the NFCT plugin, see libnetfilter_conntrack
+var ulogdEventTypes = map[int]string{
+	1: "NEW",
+	2: "UPDATE",
+	4: "DESTROY",
+}
+
+func init() {
+	RegisterSource("ulogd", newUlogdSource)
+}
+
+// ulogdSource reads the JSON output of ulogd2 fed by the NFCT plugin
+type ulogdSource struct {
+	options SourceOptions
+	filter  *filter
+	events  map[string]bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func newUlogdSource(options SourceOptions) (Source, error) {
+	if options.UlogdInput == "" || options.UlogdInput == ulogdUnixPrefix {
+		return nil, fmt.Errorf("ulogd source needs an input file or socket")
+	}
+	if len(options.OtherArgs) > 0 {
+		return nil, fmt.Errorf("ulogd source doesn't support conntrack arguments: %v", options.OtherArgs)
+	}
+	if options.Snapshot {
+		return nil, fmt.Errorf("ulogd source can't list connections")
+	}
+	if err := checkEventTypes(options.EventType); err != nil {
+		return nil, err
+	}
+	filter, err := options.Filter.compile()
+	if err != nil {
+		return nil, err
+	}
+	var events map[string]bool
+	if options.EventType != nil {
+		events = make(map[string]bool)
+		for _, event := range options.EventType {
+			events[event] = true
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ulogdSource{
+		options: options,
+		filter:  filter,
+		events:  events,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+func (s *ulogdSource) Start(flowChan chan<- Flow, errChan chan<- error) error {
+	go func() {
+		defer close(s.done)
+		newSupervisor("ulogd", s.options).run(s.ctx, errChan, func(ctx context.Context) error {
+			if strings.HasPrefix(s.options.UlogdInput, ulogdUnixPrefix) {
+				return s.runSocket(ctx, strings.TrimPrefix(s.options.UlogdInput, ulogdUnixPrefix), flowChan)
+			}
+			return s.runFile(ctx, s.options.UlogdInput, flowChan)
+		})
+	}()
+	return nil
+}
+
+func (s *ulogdSource) Stop() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+// runFile follows the file like tail -F, from its end and across rotations
+func (s *ulogdSource) runFile(ctx context.Context, path string, flowChan chan<- Flow) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("ulogd: %s", err)
+	}
+	// file is reopened on rotation
+	defer func() {
+		file.Close()
+	}()
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("ulogd: %s", err)
+	}
+	log.Infof("reading ulogd %s...", path)
+
+	reader := bufio.NewReader(file)
+	var partial []byte
+	for {
+		line, err := reader.ReadBytes('\n')
+		offset += int64(len(line))
+		if err == nil {
+			if len(partial) > 0 {
+				line = append(partial, line...)
+				partial = nil
+			}
+			if !s.send(ctx, line, flowChan) {
+				return nil
+			}
+			continue
+		}
+		if err != io.EOF {
+			return fmt.Errorf("ulogd: %s", err)
+		}
+		// ulogd may be writing the end of the line
+		partial = append(partial, line...)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(ulogdPollInterval):
+		}
+		rotated, err := ulogdRotated(file, path, offset)
+		if err != nil {
+			return fmt.Errorf("ulogd: %s", err)
+		}
+		if rotated {
+			log.Infof("ulogd %s rotated, reopening...", path)
+			file.Close()
+			if file, err = os.Open(path); err != nil {
+				return fmt.Errorf("ulogd: %s", err)
+			}
+			reader.Reset(file)
+			offset = 0
+			partial = nil
+		}
+	}
+}
+
+// ulogdRotated tells if path was replaced or truncated since it was opened
+func ulogdRotated(file *os.File, path string, offset int64) (bool, error) {
+	opened, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	current, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		// The new file isn't created yet
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !os.SameFile(opened, current) || current.Size() < offset, nil
+}
+
+// runSocket listens on the unix socket the JSON plugin connects to with mode="unix"
+func (s *ulogdSource) runSocket(ctx context.Context, path string, flowChan chan<- Flow) error {
+	// A socket left by a previous run prevents listening
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	var listener net.Listener
+	err := inNetns(s.options.Netns, func() (err error) {
+		listener, err = net.Listen("unix", path)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("ulogd: %s", err)
+	}
+	log.Infof("listening ulogd on %s...", path)
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	connections := make(map[net.Conn]bool)
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+		mutex.Lock()
+		for conn := range connections {
+			conn.Close()
+		}
+		mutex.Unlock()
+	}()
+	defer wg.Wait()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			listener.Close()
+			return fmt.Errorf("ulogd: %s", err)
+		}
+		mutex.Lock()
+		connections[conn] = true
+		mutex.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reader := bufio.NewReader(conn)
+			for {
+				line, err := reader.ReadBytes('\n')
+				if len(line) > 0 && !s.send(ctx, line, flowChan) {
+					break
+				}
+				if err != nil {
+					if err != io.EOF && ctx.Err() == nil {
+						log.Warnln("ulogd: ", err)
+					}
+					break
+				}
+			}
+			mutex.Lock()
+			delete(connections, conn)
+			mutex.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// send parses and publishes a JSON line, it returns false once the source is stopped
+func (s *ulogdSource) send(ctx context.Context, line []byte, flowChan chan<- Flow) bool {
+	flow, err := ulogdParse(line)
+	if err != nil {
+		log.Errorln(err)
+		return true
+	}
+	if s.events != nil && !s.events[flow.Type] || s.options.NatOnly && !flow.nat() || !s.filter.match(&flow) {
+		return true
+	}
+	flow.Netns = s.options.Netns
+	select {
+	case flowChan <- flow:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// ulogdRecord is a JSON line of ulogd, numbers are kept as json.Number
+type ulogdRecord map[string]interface{}
+
+func (r ulogdRecord) int(key string) (int, bool) {
+	switch value := r[key].(type) {
+	case json.Number:
+		i, err := value.Int64()
+		return int(i), err == nil
+	case string:
+		i, err := json.Number(value).Int64()
+		return int(i), err == nil
+	}
+	return 0, false
+}
+
+// uint64 reads a counter, which doesn't fit an int on 32-bit routers
+func (r ulogdRecord) uint64(key string) (uint64, bool) {
+	switch value := r[key].(type) {
+	case json.Number:
+		i, err := strconv.ParseUint(string(value), 10, 64)
+		return i, err == nil
+	case string:
+		i, err := strconv.ParseUint(value, 10, 64)
+		return i, err == nil
+	}
+	return 0, false
+}
+
+// ip reads an address printed by the JSON plugin or converted by the IP2STR plugin
+func (r ulogdRecord) ip(key string) net.IP {
+	for _, key := range []string{key + ".str", key} {
+		if value, ok := r[key].(string); ok {
+			if ip := net.ParseIP(value); ip != nil {
+				return ip
+			}
+		}
+	}
+	return nil
+}
+
+func (r ulogdRecord) meta(direction string, meta *Meta) {
+	meta.Layer3.Src = r.ip(direction + ".ip.saddr")
+	meta.Layer3.Dst = r.ip(direction + ".ip.daddr")
+	meta.Layer4.Protonum, _ = r.int(direction + ".ip.protocol")
+	meta.Layer4.Sport, _ = r.int(direction + ".l4.sport")
+	meta.Layer4.Dport, _ = r.int(direction + ".l4.dport")
+	meta.Counter.Packets, _ = r.uint64(direction + ".raw.pktcount")
+	meta.Counter.Bytes, _ = r.uint64(direction + ".raw.pktlen")
+}
+
+// ulogdParse maps a JSON line of the NFCT plugin to a flow
+func ulogdParse(line []byte) (Flow, error) {
+	var flow = Flow{}
+	record := ulogdRecord{}
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	if err := decoder.Decode(&record); err != nil {
+		return flow, fmt.Errorf("ulogd parse error of: %s: %s", strings.TrimSpace(string(line)), err)
+	}
+
+	record.meta("orig", &flow.Original)
+	record.meta("reply", &flow.Reply)
+	if flow.Original.Layer3.Src == nil || flow.Original.Layer3.Dst == nil {
+		return flow, fmt.Errorf("ulogd parse error of: %s", strings.TrimSpace(string(line)))
+	}
+	if flow.Reply.Layer4.Protonum == 0 {
+		flow.Reply.Layer4.Protonum = flow.Original.Layer4.Protonum
+	}
+
+	// Accounting records without event are written when the connection is destroyed
+	flow.Type = "DESTROY"
+	if event, ok := record.int("ct.event"); ok {
+		if eventType, ok := ulogdEventTypes[event]; ok {
+			flow.Type = eventType
+		}
+	}
+	if id, ok := record.int("ct.id"); ok {
+		flow.Id = uint32(id)
+	}
+	if mark, ok := record.int("ct.mark"); ok {
+		flow.Mark = uint32(mark)
+	}
+	flow.Zone, _ = record.int("ct.zone")
+
+	flow.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+	for _, prefix := range []string{"flow.end", "flow.start"} {
+		if sec, ok := record.int(prefix + ".sec"); ok && sec > 0 {
+			usec, _ := record.int(prefix + ".usec")
+			flow.Timestamp = int64(sec)*1000 + int64(usec)/1000
+			break
+		}
+	}
+
+	layer3 := Layer3{Protonum: unix.AF_INET, Protoname: "ipv4"}
+	if flow.Original.Layer3.Src.To4() == nil {
+		layer3 = Layer3{Protonum: unix.AF_INET6, Protoname: "ipv6"}
+	}
+	for _, meta := range []*Meta{&flow.Original, &flow.Reply} {
+		meta.Layer3.Protonum = layer3.Protonum
+		meta.Layer3.Protoname = layer3.Protoname
+		if name, ok := layer4Protonames[meta.Layer4.Protonum]; ok {
+			meta.Layer4.Protoname = name
+		} else {
+			meta.Layer4.Protoname = "unknown"
+		}
+	}
+	if icmpType, ok := record.int("icmp.type"); ok {
+		code, _ := record.int("icmp.code")
+		flow.Original.Layer4.Icmp = &Icmp{Type: icmpType, Code: code}
+	}
+	return flow, nil
+}
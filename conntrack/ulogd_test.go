@@ -0,0 +1,153 @@
+package conntrack
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ulogdRecords are lines of the JSON output plugin stacked on NFCT, with and without IP2STR
+var ulogdRecords = []string{
+	`{"timestamp": "2017-10-21T06:09:46", "dvc": "Netfilter", "orig.ip.saddr.str": "192.168.1.10", "orig.ip.daddr.str": "1.2.3.4", "orig.ip.protocol": 6, "orig.l4.sport": 34277, "orig.l4.dport": 80, "orig.raw.pktlen": 305, "orig.raw.pktcount": 4, "reply.ip.saddr.str": "1.2.3.4", "reply.ip.daddr.str": "192.168.0.5", "reply.ip.protocol": 6, "reply.l4.sport": 80, "reply.l4.dport": 34277, "reply.raw.pktlen": 291, "reply.raw.pktcount": 3, "ct.mark": 16, "ct.id": 12, "ct.event": 4, "flow.start.sec": 1508566166, "flow.start.usec": 12000, "flow.end.sec": 1508566186, "flow.end.usec": 345123, "oob.family": 2, "oob.protocol": 0}`,
+	`{"timestamp": "2017-10-21T06:09:25", "dvc": "Netfilter", "orig.ip.saddr": "2001:db8::10", "orig.ip.daddr": "2001:db8::1", "orig.ip.protocol": 17, "orig.l4.sport": 5353, "orig.l4.dport": 53, "orig.raw.pktlen": 0, "orig.raw.pktcount": 0, "reply.ip.saddr": "2001:db8::1", "reply.ip.daddr": "2001:db8::10", "reply.l4.sport": 53, "reply.l4.dport": 5353, "ct.mark": 0, "ct.id": 99, "ct.zone": 3, "ct.event": 1, "flow.start.sec": 1508566165, "flow.start.usec": 785132}`,
+	`{"orig.ip.saddr.str": "10.0.0.1", "orig.ip.daddr.str": "8.8.8.8", "orig.ip.protocol": 1, "orig.raw.pktlen": "4200000000", "orig.raw.pktcount": "5000000000", "reply.ip.saddr.str": "8.8.8.8", "reply.ip.daddr.str": "10.0.0.1", "reply.ip.protocol": 1, "icmp.type": 8, "icmp.code": 0, "ct.id": 77, "flow.end.sec": 1508566186, "flow.end.usec": 0}`,
+}
+
+func TestUlogdParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		line  string
+		check func(flow Flow) bool
+	}{
+		{
+			name: "tcp destroy",
+			line: ulogdRecords[0],
+			check: func(flow Flow) bool {
+				return flow.Type == "DESTROY" && flow.Id == 12 && flow.Mark == 16 && flow.Timestamp == 1508566186345 &&
+					flow.Original.Layer3.Protoname == "ipv4" && flow.Original.Layer3.Src.Equal(net.IP{192, 168, 1, 10}) &&
+					flow.Original.Layer4.Protoname == "tcp" && flow.Original.Layer4.Sport == 34277 && flow.Original.Layer4.Dport == 80 &&
+					flow.Original.Counter == Counter{Packets: 4, Bytes: 305} &&
+					flow.Reply.Layer3.Dst.Equal(net.IP{192, 168, 0, 5}) && flow.Reply.Layer4.Sport == 80 &&
+					flow.Reply.Counter == Counter{Packets: 3, Bytes: 291}
+			},
+		},
+		{
+			name: "ipv6 new without reply protocol",
+			line: ulogdRecords[1],
+			check: func(flow Flow) bool {
+				return flow.Type == "NEW" && flow.Id == 99 && flow.Zone == 3 && flow.Timestamp == 1508566165785 &&
+					flow.Original.Layer3.Protoname == "ipv6" && flow.Original.Layer3.Protonum == 10 &&
+					flow.Original.Layer3.Dst.Equal(net.ParseIP("2001:db8::1")) &&
+					flow.Reply.Layer4.Protoname == "udp" && flow.Reply.Layer4.Dport == 5353
+			},
+		},
+		{
+			name: "icmp accounting record",
+			line: ulogdRecords[2],
+			check: func(flow Flow) bool {
+				return flow.Type == "DESTROY" && flow.Original.Layer4.Protoname == "icmp" &&
+					flow.Original.Layer4.Icmp != nil && *flow.Original.Layer4.Icmp == Icmp{Type: 8} &&
+					flow.Original.Counter == Counter{Packets: 5000000000, Bytes: 4200000000}
+			},
+		},
+	}
+	for _, test := range tests {
+		flow, err := ulogdParse([]byte(test.line))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !test.check(flow) {
+			t.Errorf("%s: got %+v", test.name, flow)
+		}
+	}
+
+	for _, line := range []string{`{"orig.ip.protocol": 6}`, `{"orig.ip.saddr.str": "10.0.0.1",`, `[]`} {
+		if _, err := ulogdParse([]byte(line)); err == nil {
+			t.Errorf("%s: got no error", line)
+		}
+	}
+}
+
+func TestUlogdTail(t *testing.T) {
+	defer func(interval time.Duration) { ulogdPollInterval = interval }(ulogdPollInterval)
+	ulogdPollInterval = 10 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "ulogd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ulogd.json")
+	// Records written before the start are skipped
+	if err := ioutil.WriteFile(path, []byte(ulogdRecords[2]+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := newUlogdSource(SourceOptions{UlogdInput: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	flowChan := make(chan Flow, 8)
+	done := make(chan error)
+	go func() {
+		done <- source.(*ulogdSource).runFile(ctx, path, flowChan)
+	}()
+	wait := func() {
+		time.Sleep(10 * ulogdPollInterval)
+	}
+	write := func(flag int, data string) {
+		file, err := os.OpenFile(path, flag|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if _, err := file.WriteString(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive := func(step string, id uint32) {
+		select {
+		case flow := <-flowChan:
+			if flow.Id != id {
+				t.Errorf("%s: got flow %d, want %d", step, flow.Id, id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: no flow", step)
+		}
+	}
+
+	wait()
+	// A line is read once ulogd wrote its end
+	write(os.O_APPEND, ulogdRecords[0][:100])
+	wait()
+	write(os.O_APPEND, ulogdRecords[0][100:]+"\n")
+	receive("appended", 12)
+
+	// The file is truncated, then written from its start
+	write(os.O_TRUNC, "")
+	wait()
+	write(os.O_APPEND, ulogdRecords[1]+"\n")
+	receive("truncated", 99)
+
+	// The file is renamed and replaced by a new one
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	wait()
+	write(os.O_CREATE|os.O_EXCL, ulogdRecords[2]+"\n")
+	receive("renamed", 77)
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if len(flowChan) > 0 {
+		t.Errorf("got %d more flows", len(flowChan))
+	}
+}
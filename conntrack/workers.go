@@ -0,0 +1,106 @@
+package conntrack
+
+import (
+	"bytes"
+	"context"
+	"hash/fnv"
+	"sync"
+)
+
+// parseWorkers parse the lines of the exec source on several goroutines,
+// the lines of a connection are parsed by the same worker to keep their order
+type parseWorkers struct {
+	lines []chan []byte
+	// free holds the line buffers of each worker, returned once parsed
+	free []chan []byte
+	wg   sync.WaitGroup
+}
+
+// lineBuffers is the number of buffers of a worker, one parsed while the next line is copied
+const lineBuffers = 2
+
+func newParseWorkers(ctx context.Context, s *execSource, flowChan chan<- Flow) *parseWorkers {
+	w := &parseWorkers{
+		lines: make([]chan []byte, s.options.Workers),
+		free:  make([]chan []byte, s.options.Workers),
+	}
+	for i := range w.lines {
+		lines := make(chan []byte)
+		free := make(chan []byte, lineBuffers)
+		for j := 0; j < lineBuffers; j++ {
+			free <- make([]byte, 0, 512)
+		}
+		w.lines[i] = lines
+		w.free[i] = free
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			var parser Parser
+			for line := range lines {
+				ok := s.parseEvent(ctx, &parser, line, flowChan)
+				free <- line[:0]
+				if !ok {
+					// Drain to unblock dispatch until close
+					for line := range lines {
+						free <- line[:0]
+					}
+					return
+				}
+			}
+		}()
+	}
+	return w
+}
+
+// dispatch queues a copy of line to its worker, it returns false when ctx is done
+func (w *parseWorkers) dispatch(ctx context.Context, line []byte) bool {
+	shard := lineShard(line, len(w.lines))
+	var buffer []byte
+	select {
+	case buffer = <-w.free[shard]:
+	case <-ctx.Done():
+		return false
+	}
+	select {
+	case w.lines[shard] <- append(buffer, line...):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// close waits for the queued lines to be parsed
+func (w *parseWorkers) close() {
+	for _, lines := range w.lines {
+		close(lines)
+	}
+	w.wg.Wait()
+}
+
+// lineShard hashes the original tuple of an unparsed line, the counters which change between events are skipped
+func lineShard(line []byte, shards int) int {
+	hash := fnv.New32a()
+	tuple := false
+	for pos := 0; pos < len(line); {
+		var field []byte
+		_, field, pos = token(line, pos)
+		i := bytes.IndexByte(field, '=')
+		if i < 0 {
+			continue
+		}
+		switch key := field[:i]; {
+		case bytes.Equal(key, []byte("src")):
+			if tuple {
+				// Start of the reply tuple
+				return int(hash.Sum32() % uint32(shards))
+			}
+			tuple = true
+		case bytes.Equal(key, []byte("packets")), bytes.Equal(key, []byte("bytes")):
+			continue
+		}
+		if tuple {
+			hash.Write(field)
+		}
+	}
+	return int(hash.Sum32() % uint32(shards))
+}
@@ -0,0 +1,55 @@
+package conntrack
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestParseWorkers(t *testing.T) {
+	filter, err := Filter{}.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &execSource{options: SourceOptions{Workers: 3}, filter: filter}
+	flowChan := make(chan Flow)
+	w := newParseWorkers(context.Background(), s, flowChan)
+
+	const rounds = 100
+	// The flows are compared by their encoding
+	got := make(map[string]int)
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		for flow := range flowChan {
+			b, _ := flow.AppendJSON(nil)
+			got[string(b)]++
+		}
+	}()
+	line := make([]byte, 0, 512)
+	for i := 0; i < rounds; i++ {
+		for _, sample := range sampleLines {
+			// The caller reuses its buffer like the exec source
+			line = append(line[:0], sample...)
+			if !w.dispatch(context.Background(), line) {
+				t.Fatal("dispatch stopped")
+			}
+		}
+	}
+	w.close()
+	close(flowChan)
+	<-received
+
+	want := make(map[string]int)
+	for _, sample := range sampleLines {
+		flow, err := Parse([]byte(sample))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := flow.AppendJSON(nil)
+		want[string(b)] += rounds
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d distinct flows, want %d", len(got), len(want))
+	}
+}
@@ -0,0 +1,175 @@
+package conntrack
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Output formats of conntrack parsed by the exec source
+const (
+	FormatText = "text"
+	FormatXML  = "xml"
+)
+
+// xmlFlow is a <flow> element of conntrack -o xml, see libnetfilter_conntrack output/xml.c
+type xmlFlow struct {
+	Type  string    `xml:"type,attr"`
+	Metas []xmlMeta `xml:"meta"`
+	When  *xmlWhen  `xml:"when"`
+}
+
+// xmlMeta holds a tuple for the original and reply directions, the other fields for the independent one
+type xmlMeta struct {
+	Direction string `xml:"direction,attr"`
+	Layer3    struct {
+		Protonum  int    `xml:"protonum,attr"`
+		Protoname string `xml:"protoname,attr"`
+		Src       string `xml:"src"`
+		Dst       string `xml:"dst"`
+	} `xml:"layer3"`
+	Layer4 struct {
+		Protonum  int     `xml:"protonum,attr"`
+		Protoname string  `xml:"protoname,attr"`
+		Sport     int     `xml:"sport"`
+		Dport     int     `xml:"dport"`
+		Type      *int    `xml:"type"`
+		Code      int     `xml:"code"`
+		Id        int     `xml:"id"`
+		Srckey    *string `xml:"srckey"`
+		Dstkey    string  `xml:"dstkey"`
+	} `xml:"layer4"`
+	Counters struct {
+		Packets uint64 `xml:"packets"`
+		Bytes   uint64 `xml:"bytes"`
+	} `xml:"counters"`
+
+	State     string    `xml:"state"`
+	Timeout   int       `xml:"timeout"`
+	Mark      uint32    `xml:"mark"`
+	Zone      int       `xml:"zone"`
+	Use       int       `xml:"use"`
+	Id        uint32    `xml:"id"`
+	Secctx    string    `xml:"secctx"`
+	Assured   *struct{} `xml:"assured"`
+	Unreplied *struct{} `xml:"unreplied"`
+	Deltatime int64     `xml:"deltatime"`
+}
+
+// xmlWhen is the local time the event was received
+type xmlWhen struct {
+	Hour  int `xml:"hour"`
+	Min   int `xml:"min"`
+	Sec   int `xml:"sec"`
+	Day   int `xml:"day"`
+	Month int `xml:"month"`
+	Year  int `xml:"year"`
+}
+
+// readXMLEvents decodes the <flow> elements as they are printed, a nil error means the output ended
+func (s *execSource) readXMLEvents(ctx context.Context, stdout io.Reader, flowChan chan<- Flow) error {
+	decoder := xml.NewDecoder(stdout)
+	return xmlParse(decoder, "", func(flow Flow) bool {
+		if !s.filter.match(&flow) {
+			return true
+		}
+		flow.Netns = s.options.Netns
+		select {
+		case flowChan <- flow:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	})
+}
+
+// xmlParse calls fn for every flow of the stream until fn returns false, eventType replaces a missing type
+func xmlParse(decoder *xml.Decoder, eventType string, fn func(flow Flow) bool) error {
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		// conntrack was stopped before closing the document
+		if syntaxErr, ok := err.(*xml.SyntaxError); ok && syntaxErr.Msg == "unexpected EOF" {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("xml parse error: %s", err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "flow" {
+			continue
+		}
+		var element xmlFlow
+		if err := decoder.DecodeElement(&element, &start); err != nil {
+			return fmt.Errorf("xml parse error: %s", err)
+		}
+		flow := element.flow()
+		if flow.Type == "" {
+			flow.Type = eventType
+		}
+		if !fn(flow) {
+			return nil
+		}
+	}
+}
+
+func (e *xmlFlow) flow() Flow {
+	var flow = Flow{}
+	flow.Type = strings.ToUpper(e.Type)
+	if e.When != nil {
+		when := time.Date(e.When.Year, time.Month(e.When.Month), e.When.Day, e.When.Hour, e.When.Min, e.When.Sec, 0, time.Local)
+		flow.Timestamp = when.UnixNano() / int64(time.Millisecond)
+	} else {
+		flow.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+
+	for i := range e.Metas {
+		meta := &e.Metas[i]
+		switch meta.Direction {
+		case "original":
+			meta.tuple(&flow.Original)
+		case "reply":
+			meta.tuple(&flow.Reply)
+		case "independent":
+			flow.State = meta.State
+			flow.Timeout = meta.Timeout
+			flow.Mark = meta.Mark
+			flow.Zone = meta.Zone
+			flow.Use = meta.Use
+			flow.Id = meta.Id
+			flow.Secctx = meta.Secctx
+			flow.ASSURED = meta.Assured != nil
+			flow.UNREPLIED = meta.Unreplied != nil
+			flow.Deltatime = meta.Deltatime
+		}
+	}
+	return flow
+}
+
+func (m *xmlMeta) tuple(meta *Meta) {
+	meta.Layer3.Protonum = m.Layer3.Protonum
+	meta.Layer3.Protoname = m.Layer3.Protoname
+	meta.Layer3.Src = net.ParseIP(m.Layer3.Src)
+	meta.Layer3.Dst = net.ParseIP(m.Layer3.Dst)
+	meta.Layer4.Protonum = m.Layer4.Protonum
+	meta.Layer4.Protoname = m.Layer4.Protoname
+	meta.Layer4.Sport = m.Layer4.Sport
+	meta.Layer4.Dport = m.Layer4.Dport
+	if m.Layer4.Type != nil {
+		meta.Layer4.Icmp = &Icmp{Type: *m.Layer4.Type, Code: m.Layer4.Code, Id: m.Layer4.Id}
+	}
+	if m.Layer4.Srckey != nil {
+		srcKey, _ := strconv.ParseUint(*m.Layer4.Srckey, 0, 32)
+		dstKey, _ := strconv.ParseUint(m.Layer4.Dstkey, 0, 32)
+		meta.Layer4.Gre = &Gre{SrcKey: uint32(srcKey), DstKey: uint32(dstKey)}
+	}
+	meta.Counter.Packets = m.Counters.Packets
+	meta.Counter.Bytes = m.Counters.Bytes
+}
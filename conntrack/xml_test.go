@@ -0,0 +1,85 @@
+package conntrack
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+)
+
+// xmlEvents is conntrack -E -o xml,timestamp stopped before the end of the document
+const xmlEvents = `<?xml version="1.0" encoding="utf-8"?>
+<conntrack>
+<flow type="new"><meta direction="original"><layer3 protonum="2" protoname="ipv4"><src>192.168.1.10</src><dst>1.2.3.4</dst></layer3><layer4 protonum="6" protoname="tcp"><sport>42216</sport><dport>80</dport></layer4></meta><meta direction="reply"><layer3 protonum="2" protoname="ipv4"><src>1.2.3.4</src><dst>192.168.0.5</dst></layer3><layer4 protonum="6" protoname="tcp"><sport>80</sport><dport>42216</dport></layer4></meta><meta direction="independent"><state>SYN_SENT</state><timeout>120</timeout><mark>0</mark><zone>3</zone><use>1</use><id>3894123456</id><unreplied/></meta><when><hour>6</hour><min>9</min><sec>25</sec><wday>7</wday><day>21</day><month>10</month><year>2017</year></when></flow>
+<flow type="update"><meta direction="original"><layer3 protonum="2" protoname="ipv4"><src>10.0.0.1</src><dst>8.8.8.8</dst></layer3><layer4 protonum="1" protoname="icmp"><type>8</type><code>0</code><id>4455</id></layer4></meta><meta direction="reply"><layer3 protonum="2" protoname="ipv4"><src>8.8.8.8</src><dst>10.0.0.1</dst></layer3><layer4 protonum="1" protoname="icmp"><type>0</type><code>0</code><id>4455</id></layer4></meta><meta direction="independent"><timeout>29</timeout><mark>0</mark><use>1</use><id>77</id></meta><when><hour>6</hour><min>9</min><sec>46</sec><wday>7</wday><day>21</day><month>10</month><year>2017</year></when></flow>
+<flow type="destroy"><meta direction="original"><layer3 protonum="2" protoname="ipv4"><src>192.168.1.10</src><dst>1.2.3.4</dst></layer3><layer4 protonum="6" protoname="tcp"><sport>34277</sport><dport>80</dport></layer4><counters><packets>4</packets><bytes>305</bytes></counters></meta><meta direction="reply"><layer3 protonum="2" protoname="ipv4"><src>1.2.3.4</src><dst>192.168.0.5</dst></layer3><layer4 protonum="6" protoname="tcp"><sport>80</sport><dport>34277</dport></layer4><counters><packets>3</packets><bytes>291</bytes></counters></meta><meta direction="independent"><mark>16</mark><use>1</use><id>12</id><assured/><timestamp><start>1508566166</start><stop>1508566186</stop></timestamp><deltatime>20</deltatime></meta><when><hour>6</hour><min>9</min><sec>46</sec><wday>7</wday><day>21</day><month>10</month><year>2017</year></when></flow>
+`
+
+func TestXMLParse(t *testing.T) {
+	// The same events printed as text
+	lines := []string{
+		"[1508566165.000000]\t    [NEW] ipv4     2 tcp      6 120 SYN_SENT src=192.168.1.10 dst=1.2.3.4 sport=42216 dport=80 [UNREPLIED] src=1.2.3.4 dst=192.168.0.5 sport=80 dport=42216 mark=0 zone=3 use=1 id=3894123456",
+		"[1508566186.000000]\t [UPDATE] ipv4     2 icmp     1 29 src=10.0.0.1 dst=8.8.8.8 type=8 code=0 id=4455 src=8.8.8.8 dst=10.0.0.1 type=0 code=0 id=4455 mark=0 use=1 id=77",
+		"[1508566186.000000]\t[DESTROY] ipv4     2 tcp      6 src=192.168.1.10 dst=1.2.3.4 sport=34277 dport=80 packets=4 bytes=305 src=1.2.3.4 dst=192.168.0.5 sport=80 dport=34277 packets=3 bytes=291 [ASSURED] mark=16 use=1 id=12 delta-time=20",
+	}
+	// when is the local time of the event, to the second
+	when := []time.Time{
+		time.Date(2017, 10, 21, 6, 9, 25, 0, time.Local),
+		time.Date(2017, 10, 21, 6, 9, 46, 0, time.Local),
+		time.Date(2017, 10, 21, 6, 9, 46, 0, time.Local),
+	}
+
+	var flows []Flow
+	err := xmlParse(xml.NewDecoder(strings.NewReader(xmlEvents)), "", func(flow Flow) bool {
+		flows = append(flows, flow)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != len(lines) {
+		t.Fatalf("got %d flows, want %d", len(flows), len(lines))
+	}
+	for i, flow := range flows {
+		if want := when[i].UnixNano() / int64(time.Millisecond); flow.Timestamp != want {
+			t.Errorf("flow %d: got timestamp %d, want %d", i, flow.Timestamp, want)
+		}
+		want, err := Parse([]byte(lines[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		flow.Timestamp = want.Timestamp
+		got, _ := flow.AppendJSON(nil)
+		wanted, _ := want.AppendJSON(nil)
+		if string(got) != string(wanted) {
+			t.Errorf("flow %d:\ngot  %s\nwant %s", i, got, wanted)
+		}
+	}
+}
+
+func TestXMLParseDump(t *testing.T) {
+	// conntrack -L -o xml prints no type, the dump gives it
+	const dump = `<?xml version="1.0" encoding="utf-8"?>
+<conntrack>
+<flow><meta direction="original"><layer3 protonum="2" protoname="ipv4"><src>10.0.0.1</src><dst>10.0.0.2</dst></layer3><layer4 protonum="47" protoname="gre"><srckey>0x0</srckey><dstkey>0x1f</dstkey></layer4></meta><meta direction="reply"><layer3 protonum="2" protoname="ipv4"><src>10.0.0.2</src><dst>10.0.0.1</dst></layer3><layer4 protonum="47" protoname="gre"><srckey>0x1f</srckey><dstkey>0x0</dstkey></layer4></meta><meta direction="independent"><timeout>29</timeout><id>100</id><unreplied/></meta></flow>
+</conntrack>
+`
+	var flows []Flow
+	err := xmlParse(xml.NewDecoder(strings.NewReader(dump)), "DUMP", func(flow Flow) bool {
+		flows = append(flows, flow)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 1 || flows[0].Type != "DUMP" || flows[0].Id != 100 || !flows[0].UNREPLIED {
+		t.Fatalf("got %+v", flows)
+	}
+	if gre := flows[0].Original.Layer4.Gre; gre == nil || *gre != (Gre{SrcKey: 0, DstKey: 0x1f}) {
+		t.Errorf("got gre keys %+v", gre)
+	}
+
+	if err := xmlParse(xml.NewDecoder(strings.NewReader("<conntrack><flow><meta></flow>")), "", func(Flow) bool { return true }); err == nil {
+		t.Error("got no error on a malformed flow")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"gitlab.com/OpenWifiPortal/conntrack-event-collector/config"
+	"gitlab.com/OpenWifiPortal/conntrack-event-collector/conntrack"
+	log "gitlab.com/OpenWifiPortal/go-libs/logger"
+)
+
+// message is a flow encoded by a worker, published as is, its buffer is released once published
+type message struct {
+	buffer *conntrack.Buffer
+}
+
+// pendingFlows counts the flows taken from the queue and not published yet, the ones held by the workers and the batch
+var pendingFlows int64
+
+// encodeFlows tracks and marshals the flows on several goroutines, the output is closed after flowChan.
+// The flows of a connection are handled by the same worker, which keeps their order and their state tracker.
+// The channels are unbuffered so that the flows wait in the queue, where its policy applies
+func encodeFlows(flowChan <-chan conntrack.Flow, workers int) <-chan message {
+	messageChan := make(chan message)
+	shards := make([]chan conntrack.Flow, workers)
+	var wg sync.WaitGroup
+	for i := range shards {
+		flows := make(chan conntrack.Flow)
+		shards[i] = flows
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			encodeShard(flows, messageChan)
+		}()
+	}
+
+	go func() {
+		for flow := range flowChan {
+			atomic.AddInt64(&pendingFlows, 1)
+			shards[flow.TupleHash()%uint64(workers)] <- flow
+		}
+		for _, flows := range shards {
+			close(flows)
+		}
+		wg.Wait()
+		close(messageChan)
+	}()
+	return messageChan
+}
+
+func encodeShard(flowChan <-chan conntrack.Flow, messageChan chan<- message) {
+	var tracker *conntrack.StateTracker
+	if config.Config.TrackState {
+		tracker = conntrack.NewStateTracker()
+	}
+	for flow := range flowChan {
+		if tracker != nil && !tracker.Track(&flow) || flow.Type == "" {
+			atomic.AddInt64(&pendingFlows, -1)
+			continue
+		}
+		buffer, err := conntrack.EncodeFlow(&flow)
+		if err != nil {
+			log.Errorln(err)
+			atomic.AddInt64(&pendingFlows, -1)
+			continue
+		}
+		messageChan <- message{buffer: buffer}
+	}
+}